@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/vgough/go-fuse-c/fuse"
@@ -89,15 +90,9 @@ func (h *helloFS) ReadDir(ino int64, fi *fuse.FileInfo, off int64, size int,
 		return fuse.ENOTDIR
 	}
 
-	if off < 1 {
-		w.Add(".", 1, 0, 1)
-	}
-	if off < 2 {
-		w.Add("..", 1, 0, 2)
-	}
-	if off < 3 {
-		w.Add("hello", 2, 0, 3)
-	}
+	fuse.WriteDir(w, off, 1, 1, slices.Values([]fuse.DirEntry{
+		{Name: "hello", Ino: 2, Mode: fuse.S_IFREG},
+	}))
 	return fuse.OK
 }
 
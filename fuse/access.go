@@ -0,0 +1,252 @@
+package fuse
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Access mask bits, as passed to Access.
+const (
+	F_OK = 0 // The file exists.
+	X_OK = 1 // Execute, or search for directories.
+	W_OK = 2 // Write.
+	R_OK = 4 // Read.
+)
+
+// Caller identifies the process which made a request.  It is available from the context passed
+// to filesystem methods, with CallerFromContext.
+type Caller struct {
+	UID int
+	GID int
+	PID int
+
+	// Umask is the file mode creation mask of the process, for requests which create files.  The
+	// kernel has already applied it to the mode, unless CAP_DONT_MASK is negotiated.  See
+	// InheritACL.
+	Umask int
+
+	groupsOnce sync.Once
+	groups     []int
+}
+
+func newCaller(uid, gid, pid int) *Caller {
+	return &Caller{UID: uid, GID: gid, PID: pid}
+}
+
+type callerKey struct{}
+
+func withCaller(ctx context.Context, c *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFromContext returns the caller of the request which ctx belongs to.  Returns false if
+// ctx is not from a request, such as for Init.
+func CallerFromContext(ctx context.Context) (*Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(*Caller)
+	return c, ok
+}
+
+// Groups returns the caller's group and supplementary groups.  The supplementary groups are read
+// from /proc on Linux, and are not available elsewhere or if the process has exited.
+func (c *Caller) Groups() []int {
+	c.groupsOnce.Do(func() {
+		c.groups = []int{c.GID}
+		for _, g := range procGroups(c.PID) {
+			if g != c.GID {
+				c.groups = append(c.groups, g)
+			}
+		}
+	})
+	return c.groups
+}
+
+// InGroup returns true if the caller is a member of gid.
+func (c *Caller) InGroup(gid int) bool {
+	return c.GID == gid || slices.Contains(c.Groups(), gid)
+}
+
+// procGroups returns the supplementary groups of a process, from /proc.
+func procGroups(pid int) []int {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		list, ok := strings.CutPrefix(s.Text(), "Groups:")
+		if !ok {
+			continue
+		}
+		var groups []int
+		for _, field := range strings.Fields(list) {
+			if g, err := strconv.Atoi(field); err == nil {
+				groups = append(groups, g)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// owner returns the owner and group of a file.  Unset values default to the current process, in
+// the same way as replies to the kernel.
+func owner(attr *InoAttr) (uid, gid int) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if attr.UID != nil {
+		uid = *attr.UID
+	}
+	if attr.GID != nil {
+		gid = *attr.GID
+	}
+	return uid, gid
+}
+
+// CheckAccess checks whether the caller has the permissions in mask for a file, using the file's
+// mode.  It can be used to implement Access, or to check permissions in other operations when the
+// filesystem is not mounted with default_permissions.  Returns EACCES if access is denied.
+//
+// The superuser is granted read and write access, and execute access if any execute bit is set
+// or the file is a directory.
+func CheckAccess(attr *InoAttr, caller *Caller, mask int) Status {
+	return CheckAccessACL(attr, nil, caller, mask)
+}
+
+// CheckAccessACL is CheckAccess for a file with an access ACL.  If acl is nil, the mode is used.
+func CheckAccessACL(attr *InoAttr, acl ACL, caller *Caller, mask int) Status {
+	mask &= R_OK | W_OK | X_OK
+	if mask == F_OK {
+		return OK
+	}
+
+	if caller.UID == 0 {
+		if mask&X_OK == 0 || attr.Mode&0o111 != 0 || attr.Mode&syscall.S_IFMT == S_IFDIR {
+			return OK
+		}
+		return EACCES
+	}
+
+	if acl == nil {
+		acl = ACLFromMode(attr.Mode)
+	}
+	uid, gid := owner(attr)
+	if acl.Allows(caller.UID, caller.Groups(), uid, gid, mask) {
+		return OK
+	}
+	return EACCES
+}
+
+// CheckSearch checks that the caller may search each directory on a path, as is needed to look up
+// a file.  Returns EACCES if any directory may not be searched.
+func CheckSearch(caller *Caller, dirs ...*InoAttr) Status {
+	for _, dir := range dirs {
+		if err := CheckAccess(dir, caller, X_OK); err != OK {
+			return err
+		}
+	}
+	return OK
+}
+
+// CheckRemove checks that the caller may remove or rename a file in a directory.  The caller
+// needs write and search permission on the directory, and if the directory is sticky, must also
+// own the file or the directory.  Returns EACCES or EPERM otherwise.
+func CheckRemove(dir, file *InoAttr, caller *Caller) Status {
+	if err := CheckAccess(dir, caller, W_OK|X_OK); err != OK {
+		return err
+	}
+	if dir.Mode&syscall.S_ISVTX == 0 || caller.UID == 0 {
+		return OK
+	}
+	if fileUID, _ := owner(file); fileUID == caller.UID {
+		return OK
+	}
+	if dirUID, _ := owner(dir); dirUID == caller.UID {
+		return OK
+	}
+	return EPERM
+}
+
+// InheritOwner returns the owner, group and mode for a new file created by the caller in dir.
+// If the directory has the setgid bit set, the file takes the directory's group, and new
+// directories also inherit the setgid bit.  Otherwise the file takes the caller's group.
+//
+// The setgid bit is cleared from a new group executable file if the caller is not a member of its
+// group, as by Linux.
+func InheritOwner(dir *InoAttr, caller *Caller, mode int) (uid, gid, newMode int) {
+	uid, gid, newMode = caller.UID, caller.GID, mode
+	if dir.Mode&syscall.S_ISGID != 0 {
+		_, gid = owner(dir)
+		if mode&syscall.S_IFMT == S_IFDIR {
+			newMode |= syscall.S_ISGID
+		}
+	}
+	if mode&syscall.S_IFMT != S_IFDIR && newMode&(syscall.S_ISGID|syscall.S_IXGRP) ==
+		syscall.S_ISGID|syscall.S_IXGRP && caller.UID != 0 && !caller.InGroup(gid) {
+		newMode &^= syscall.S_ISGID
+	}
+	return uid, gid, newMode
+}
+
+// CheckSetAttr checks that the caller may make the changes in req to a file, and applies the side
+// effects of a change of mode or owner to req.  Returns EPERM if not permitted.
+//
+//   - Only the owner or the superuser may change the mode.  The setgid bit is cleared if the caller
+//     is not a member of the file's group.
+//   - Only the superuser may change the owner.  The owner may change the group to one of their own
+//     groups.
+//   - Changing the owner or group of a non-directory clears the setuid and setgid bits, even if
+//     the caller is the superuser, as on Linux.
+//   - Setting the times to the current time requires write access, or ownership.  Setting other
+//     times requires ownership.
+//
+// Size changes are not checked, as write access is checked when the file is opened.
+func CheckSetAttr(attr *InoAttr, caller *Caller, req *SetAttrRequest) Status {
+	uid, gid := owner(attr)
+	isOwner := caller.UID == uid || caller.UID == 0
+
+	if req.UID != nil && *req.UID != uid && caller.UID != 0 {
+		return EPERM
+	}
+	if req.GID != nil && *req.GID != gid && caller.UID != 0 &&
+		(caller.UID != uid || !caller.InGroup(*req.GID)) {
+		return EPERM
+	}
+
+	if req.Mode != nil {
+		if !isOwner {
+			return EPERM
+		}
+		newGID := gid
+		if req.GID != nil {
+			newGID = *req.GID
+		}
+		if caller.UID != 0 && !caller.InGroup(newGID) {
+			mode := *req.Mode &^ syscall.S_ISGID
+			req.Mode = &mode
+		}
+	}
+
+	chown := (req.UID != nil && *req.UID != uid) || (req.GID != nil && *req.GID != gid)
+	if chown && attr.Mode&syscall.S_IFMT != S_IFDIR {
+		req.KillSUID = true
+		req.KillSGID = true
+	}
+
+	for _, t := range []SetTime{req.ATime, req.MTime} {
+		switch {
+		case t.Op == TimeSet && !isOwner:
+			return EPERM
+		case t.Op == TimeNow && !isOwner && CheckAccess(attr, caller, W_OK) != OK:
+			return EACCES
+		}
+	}
+	return OK
+}
@@ -0,0 +1,163 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testAttr(mode, uid, gid int) *InoAttr {
+	return &InoAttr{Mode: mode, UID: &uid, GID: &gid}
+}
+
+func TestCheckAccess(t *testing.T) {
+	file := testAttr(S_IFREG|0o640, 1000, 100)
+	owner := newCaller(1000, 1000, 0)
+	member := &Caller{UID: 1001, GID: 100}
+	other := &Caller{UID: 1002, GID: 200}
+	root := newCaller(0, 0, 0)
+
+	require.Equal(t, OK, CheckAccess(file, owner, R_OK|W_OK))
+	require.Equal(t, EACCES, CheckAccess(file, owner, X_OK))
+	require.Equal(t, OK, CheckAccess(file, member, R_OK))
+	require.Equal(t, EACCES, CheckAccess(file, member, W_OK))
+	require.Equal(t, EACCES, CheckAccess(file, other, R_OK))
+	require.Equal(t, OK, CheckAccess(file, other, F_OK))
+	require.Equal(t, OK, CheckAccess(file, root, R_OK|W_OK))
+	require.Equal(t, EACCES, CheckAccess(file, root, X_OK))
+	require.Equal(t, OK, CheckAccess(testAttr(S_IFDIR|0o700, 1000, 100), root, X_OK))
+
+	acl := ACL{
+		{Tag: ACL_USER_OBJ, Perm: 6},
+		{Tag: ACL_USER, Perm: 6, ID: 1002},
+		{Tag: ACL_GROUP_OBJ, Perm: 4},
+		{Tag: ACL_MASK, Perm: 4},
+		{Tag: ACL_OTHER, Perm: 0},
+	}
+	require.Equal(t, OK, CheckAccessACL(file, acl, other, R_OK))
+	require.Equal(t, EACCES, CheckAccessACL(file, acl, other, W_OK))
+
+	dir := testAttr(S_IFDIR|0o750, 1000, 100)
+	require.Equal(t, OK, CheckSearch(member, dir, dir))
+	require.Equal(t, EACCES, CheckSearch(other, dir))
+}
+
+func TestCheckRemove(t *testing.T) {
+	tmp := testAttr(S_IFDIR|syscall.S_ISVTX|0o777, 0, 0)
+	file := testAttr(S_IFREG|0o666, 1000, 100)
+
+	require.Equal(t, OK, CheckRemove(tmp, file, &Caller{UID: 1000, GID: 100}))
+	require.Equal(t, EPERM, CheckRemove(tmp, file, &Caller{UID: 1001, GID: 100}))
+	require.Equal(t, OK, CheckRemove(tmp, file, &Caller{UID: 0, GID: 0}))
+
+	tmp.Mode &^= syscall.S_ISVTX
+	require.Equal(t, OK, CheckRemove(tmp, file, &Caller{UID: 1001, GID: 100}))
+	require.Equal(t, EACCES, CheckRemove(testAttr(S_IFDIR|0o755, 0, 0), file,
+		&Caller{UID: 1000, GID: 100}))
+}
+
+func TestInheritOwner(t *testing.T) {
+	caller := &Caller{UID: 1000, GID: 100}
+
+	uid, gid, mode := InheritOwner(testAttr(S_IFDIR|0o755, 0, 0), caller, S_IFREG|0o644)
+	require.Equal(t, []int{1000, 100, S_IFREG | 0o644}, []int{uid, gid, mode})
+
+	setgid := testAttr(S_IFDIR|syscall.S_ISGID|0o775, 0, 50)
+	uid, gid, mode = InheritOwner(setgid, caller, S_IFDIR|0o755)
+	require.Equal(t, []int{1000, 50, S_IFDIR | syscall.S_ISGID | 0o755}, []int{uid, gid, mode})
+
+	// The caller is not in the inherited group, so cannot create a setgid executable.
+	_, _, mode = InheritOwner(setgid, caller, S_IFREG|syscall.S_ISGID|0o755)
+	require.Equal(t, S_IFREG|0o755, mode)
+}
+
+func TestCheckSetAttr(t *testing.T) {
+	file := testAttr(S_IFREG|syscall.S_ISUID|syscall.S_ISGID|0o755, 1000, 100)
+	owner := &Caller{UID: 1000, GID: 100, groups: []int{100, 101}}
+	owner.groupsOnce.Do(func() {})
+	other := &Caller{UID: 1001, GID: 100}
+
+	mode := 0o700
+	require.Equal(t, EPERM, CheckSetAttr(file, other, &SetAttrRequest{Mode: &mode}))
+	require.Equal(t, OK, CheckSetAttr(file, owner, &SetAttrRequest{Mode: &mode}))
+
+	uid := 1001
+	require.Equal(t, EPERM, CheckSetAttr(file, owner, &SetAttrRequest{UID: &uid}))
+	// A chown by the superuser clears setuid and setgid too, but not on a directory.
+	req := &SetAttrRequest{UID: &uid}
+	require.Equal(t, OK, CheckSetAttr(file, newCaller(0, 0, 0), req))
+	require.True(t, req.KillSUID)
+	require.True(t, req.KillSGID)
+	req = &SetAttrRequest{UID: &uid}
+	dir := testAttr(S_IFDIR|syscall.S_ISGID|0o755, 1000, 100)
+	require.Equal(t, OK, CheckSetAttr(dir, newCaller(0, 0, 0), req))
+	require.False(t, req.KillSUID)
+	require.False(t, req.KillSGID)
+
+	// The owner may change the group to one of their groups, which clears setuid and setgid.
+	gid := 101
+	req = &SetAttrRequest{GID: &gid}
+	require.Equal(t, OK, CheckSetAttr(file, owner, req))
+	require.True(t, req.KillSUID)
+	require.True(t, req.KillSGID)
+	gid = 102
+	require.Equal(t, EPERM, CheckSetAttr(file, owner, &SetAttrRequest{GID: &gid}))
+
+	// The setgid bit is cleared by a chmod from outside the group.
+	mode = syscall.S_ISGID | 0o755
+	req = &SetAttrRequest{Mode: &mode}
+	require.Equal(t, OK, CheckSetAttr(testAttr(S_IFREG|0o755, 1000, 200), owner, req))
+	require.Equal(t, 0o755, *req.Mode)
+
+	// Touching a file needs write access, and setting other times needs ownership.
+	now := &SetAttrRequest{MTime: SetTime{Op: TimeNow}}
+	require.Equal(t, EACCES, CheckSetAttr(file, other, now))
+	require.Equal(t, OK, CheckSetAttr(testAttr(S_IFREG|0o666, 1000, 100), other, now))
+	require.Equal(t, EPERM, CheckSetAttr(file, other, &SetAttrRequest{MTime: SetTime{Op: TimeSet}}))
+}
+
+func TestCaller(t *testing.T) {
+	_, ok := CallerFromContext(context.Background())
+	require.False(t, ok)
+
+	self := newCaller(os.Getuid(), os.Getgid(), os.Getpid())
+	c, ok := CallerFromContext(withCaller(context.Background(), self))
+	require.True(t, ok)
+	require.Equal(t, self, c)
+	require.Equal(t, os.Getgid(), c.Groups()[0])
+	require.True(t, c.InGroup(os.Getgid()))
+}
+
+func TestMemFSAccess(t *testing.T) {
+	fs := NewMemFS()
+	owner := fs.WithContext(withCaller(context.Background(), newCaller(1000, 100, 0)))
+	other := fs.WithContext(withCaller(context.Background(), newCaller(1001, 100, 0)))
+
+	mode := 0o777
+	_, err := fs.SetAttr(&SetAttrRequest{Ino: 1, Mode: &mode})
+	require.Equal(t, OK, err)
+	file, err := owner.Mknod(1, "file", S_IFREG|0o600, 0)
+	require.Equal(t, OK, err)
+	require.Equal(t, 1000, *file.Attr.UID)
+	require.Equal(t, 100, *file.Attr.GID)
+
+	require.Equal(t, OK, owner.Access(file.Ino, R_OK|W_OK))
+	require.Equal(t, EACCES, other.Access(file.Ino, R_OK))
+
+	acl := ACL{
+		{Tag: ACL_USER_OBJ, Perm: 6},
+		{Tag: ACL_USER, Perm: 4, ID: 1001},
+		{Tag: ACL_GROUP_OBJ, Perm: 0},
+		{Tag: ACL_MASK, Perm: 4},
+		{Tag: ACL_OTHER, Perm: 0},
+	}
+	require.Equal(t, OK, owner.SetXAttr(file.Ino, XATTR_POSIX_ACL_ACCESS, acl.Encode(), 0))
+	require.Equal(t, OK, other.Access(file.Ino, R_OK))
+	require.Equal(t, EACCES, other.Access(file.Ino, W_OK))
+
+	_, err = other.SetAttr(&SetAttrRequest{Ino: file.Ino, Mode: &mode})
+	require.Equal(t, EPERM, err)
+}
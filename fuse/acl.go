@@ -0,0 +1,294 @@
+package fuse
+
+import (
+	"cmp"
+	"encoding/binary"
+	"slices"
+)
+
+// Names of the extended attributes which hold POSIX ACLs.
+const (
+	XATTR_POSIX_ACL_ACCESS  = "system.posix_acl_access"
+	XATTR_POSIX_ACL_DEFAULT = "system.posix_acl_default"
+)
+
+// ACLTag identifies the kind of an ACL entry.
+type ACLTag uint16
+
+const (
+	ACL_USER_OBJ  = ACLTag(0x01) // The file owner.
+	ACL_USER      = ACLTag(0x02) // A user, identified by ID.
+	ACL_GROUP_OBJ = ACLTag(0x04) // The file group.
+	ACL_GROUP     = ACLTag(0x08) // A group, identified by ID.
+	ACL_MASK      = ACLTag(0x10) // The maximum permissions for the group class.
+	ACL_OTHER     = ACLTag(0x20) // Everyone else.
+)
+
+// ACL permission bits, which match the access mask used by Access.
+const (
+	ACL_READ    = 4
+	ACL_WRITE   = 2
+	ACL_EXECUTE = 1
+)
+
+const (
+	aclVersion     = 2
+	aclUndefinedID = 0xffffffff
+	aclHeaderSize  = 4
+	aclEntrySize   = 8
+)
+
+// ACLEntry is an entry in a POSIX ACL.
+type ACLEntry struct {
+	Tag  ACLTag
+	Perm int // ACL_READ, ACL_WRITE and ACL_EXECUTE.
+	ID   int // User or group ID, for ACL_USER and ACL_GROUP.
+}
+
+// ACL is a POSIX access control list, as stored in the system.posix_acl_access and
+// system.posix_acl_default extended attributes.
+//
+// The kernel enforces ACLs when CAP_POSIX_ACL is negotiated, which also enables the
+// default_permissions mount option, so Access is no longer called.  The filesystem stores the
+// attributes, keeps the mode in sync with the access ACL, and applies default ACLs to new files.
+// CAP_DONT_MASK should be requested as well, as the umask must not be applied when a default ACL
+// is inherited.  See InheritACL.
+type ACL []ACLEntry
+
+// ACLFromMode returns the minimal ACL which is equivalent to the permission bits of mode.
+func ACLFromMode(mode int) ACL {
+	return ACL{
+		{Tag: ACL_USER_OBJ, Perm: mode >> 6 & 7},
+		{Tag: ACL_GROUP_OBJ, Perm: mode >> 3 & 7},
+		{Tag: ACL_OTHER, Perm: mode & 7},
+	}
+}
+
+// DecodeACL decodes an ACL from the extended attribute format.  Returns EINVAL if the data is not
+// a valid ACL.  A header without entries decodes to a nil ACL, which, as on Linux, removes the
+// ACL when it is set.
+func DecodeACL(data []byte) (ACL, Status) {
+	if len(data) < aclHeaderSize || (len(data)-aclHeaderSize)%aclEntrySize != 0 ||
+		binary.LittleEndian.Uint32(data) != aclVersion {
+		return nil, EINVAL
+	}
+
+	var acl ACL
+	for b := data[aclHeaderSize:]; len(b) > 0; b = b[aclEntrySize:] {
+		e := ACLEntry{
+			Tag:  ACLTag(binary.LittleEndian.Uint16(b)),
+			Perm: int(binary.LittleEndian.Uint16(b[2:])),
+		}
+		if e.Tag == ACL_USER || e.Tag == ACL_GROUP {
+			e.ID = int(binary.LittleEndian.Uint32(b[4:]))
+		}
+		acl = append(acl, e)
+	}
+	if acl == nil {
+		return nil, OK
+	}
+	if err := acl.Validate(); err != OK {
+		return nil, err
+	}
+	return acl, OK
+}
+
+// Encode returns the ACL in the extended attribute format, with the entries in canonical order.
+func (a ACL) Encode() []byte {
+	sorted := slices.SortedFunc(slices.Values(a), compareACLEntries)
+
+	data := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, e := range sorted {
+		id := uint32(aclUndefinedID)
+		if e.Tag == ACL_USER || e.Tag == ACL_GROUP {
+			id = uint32(e.ID)
+		}
+		data = binary.LittleEndian.AppendUint16(data, uint16(e.Tag))
+		data = binary.LittleEndian.AppendUint16(data, uint16(e.Perm))
+		data = binary.LittleEndian.AppendUint32(data, id)
+	}
+	return data
+}
+
+func compareACLEntries(a, b ACLEntry) int {
+	return cmp.Or(cmp.Compare(a.Tag, b.Tag), cmp.Compare(a.ID, b.ID))
+}
+
+// Validate checks that the ACL has exactly one owner, group and other entry, that user and group
+// IDs are not repeated, and that there is a mask entry if there are user or group entries.
+// Returns EINVAL otherwise.
+func (a ACL) Validate() Status {
+	counts := make(map[ACLTag]int)
+	seen := make(map[ACLEntry]bool)
+	for _, e := range a {
+		if e.Perm&^7 != 0 {
+			return EINVAL
+		}
+		switch e.Tag {
+		case ACL_USER, ACL_GROUP:
+			key := ACLEntry{Tag: e.Tag, ID: e.ID}
+			if seen[key] {
+				return EINVAL
+			}
+			seen[key] = true
+		case ACL_USER_OBJ, ACL_GROUP_OBJ, ACL_MASK, ACL_OTHER:
+		default:
+			return EINVAL
+		}
+		counts[e.Tag]++
+	}
+
+	if counts[ACL_USER_OBJ] != 1 || counts[ACL_GROUP_OBJ] != 1 || counts[ACL_OTHER] != 1 ||
+		counts[ACL_MASK] > 1 {
+		return EINVAL
+	}
+	if counts[ACL_MASK] == 0 && counts[ACL_USER]+counts[ACL_GROUP] > 0 {
+		return EINVAL
+	}
+	return OK
+}
+
+// entry returns the first entry with a tag, or nil.
+func (a ACL) entry(tag ACLTag) *ACLEntry {
+	for i := range a {
+		if a[i].Tag == tag {
+			return &a[i]
+		}
+	}
+	return nil
+}
+
+// IsMinimal returns true if the ACL only has owner, group and other entries, so that it is fully
+// represented by the mode.
+func (a ACL) IsMinimal() bool {
+	return len(a) == 3 && a.entry(ACL_MASK) == nil
+}
+
+// Mode returns the permission bits represented by the ACL.  The group bits are taken from the
+// mask entry if there is one.
+func (a ACL) Mode() int {
+	var mode int
+	for _, e := range a {
+		switch e.Tag {
+		case ACL_USER_OBJ:
+			mode |= e.Perm << 6
+		case ACL_GROUP_OBJ:
+			if a.entry(ACL_MASK) == nil {
+				mode |= e.Perm << 3
+			}
+		case ACL_MASK:
+			mode |= e.Perm << 3
+		case ACL_OTHER:
+			mode |= e.Perm
+		}
+	}
+	return mode
+}
+
+// Chmod returns a copy of the ACL with the permission bits of mode applied, as for a change of
+// mode.  The group bits are applied to the mask entry if there is one.
+func (a ACL) Chmod(mode int) ACL {
+	out := slices.Clone(a)
+	group := ACL_GROUP_OBJ
+	if out.entry(ACL_MASK) != nil {
+		group = ACL_MASK
+	}
+	for i := range out {
+		switch out[i].Tag {
+		case ACL_USER_OBJ:
+			out[i].Perm = mode >> 6 & 7
+		case group:
+			out[i].Perm = mode >> 3 & 7
+		case ACL_OTHER:
+			out[i].Perm = mode & 7
+		}
+	}
+	return out
+}
+
+// Allows checks whether the ACL grants the permissions in want to a caller, using the POSIX
+// access check algorithm.  owner and group are the file's owner and group, and gids holds the
+// caller's groups.  Permissions from named user and group entries, and the file group, are
+// limited by the mask entry.
+//
+// Privileged callers are not treated specially.  See CheckAccess.
+func (a ACL) Allows(uid int, gids []int, owner, group int, want int) bool {
+	mask := 7
+	if m := a.entry(ACL_MASK); m != nil {
+		mask = m.Perm
+	}
+	granted := func(perm int) bool {
+		return perm&want == want
+	}
+
+	if uid == owner {
+		if e := a.entry(ACL_USER_OBJ); e != nil {
+			return granted(e.Perm)
+		}
+		return false
+	}
+	for _, e := range a {
+		if e.Tag == ACL_USER && e.ID == uid {
+			return granted(e.Perm & mask)
+		}
+	}
+
+	// The caller is in the group class if any group entry matches, and is granted access if any
+	// matching entry grants it.
+	matched := false
+	for _, e := range a {
+		if (e.Tag == ACL_GROUP_OBJ && slices.Contains(gids, group)) ||
+			(e.Tag == ACL_GROUP && slices.Contains(gids, e.ID)) {
+			if granted(e.Perm & mask) {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+
+	if e := a.entry(ACL_OTHER); e != nil {
+		return granted(e.Perm)
+	}
+	return false
+}
+
+// InheritACL returns the ACLs for a new file or directory created with mode, in a directory with
+// the default ACL def.  The access ACL is the default ACL limited by mode, and is nil if it is
+// fully represented by the returned mode.  New directories also inherit the default ACL.  If def
+// is nil, there are no ACLs and umask is applied to the mode instead.
+//
+// The umask is only passed to the filesystem when CAP_DONT_MASK is negotiated, as Caller.Umask.
+// Otherwise the kernel has already applied it to mode, and umask should be 0.
+func InheritACL(def ACL, mode, umask int, isDir bool) (access, dflt ACL, newMode int) {
+	if def == nil {
+		return nil, nil, mode &^ (umask & 0o777)
+	}
+
+	access = slices.Clone(def)
+	group := ACL_GROUP_OBJ
+	if access.entry(ACL_MASK) != nil {
+		group = ACL_MASK
+	}
+	for i := range access {
+		switch access[i].Tag {
+		case ACL_USER_OBJ:
+			access[i].Perm &= mode >> 6 & 7
+		case group:
+			access[i].Perm &= mode >> 3 & 7
+		case ACL_OTHER:
+			access[i].Perm &= mode & 7
+		}
+	}
+	newMode = mode&^0o777 | access.Mode()
+
+	if access.IsMinimal() {
+		access = nil
+	}
+	if isDir {
+		dflt = slices.Clone(def)
+	}
+	return access, dflt, newMode
+}
@@ -0,0 +1,171 @@
+package fuse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLEncoding(t *testing.T) {
+	acl := ACL{
+		{Tag: ACL_OTHER, Perm: ACL_READ},
+		{Tag: ACL_USER, Perm: ACL_READ | ACL_WRITE, ID: 1000},
+		{Tag: ACL_USER_OBJ, Perm: 7},
+		{Tag: ACL_GROUP_OBJ, Perm: ACL_READ | ACL_EXECUTE},
+		{Tag: ACL_MASK, Perm: ACL_READ | ACL_WRITE},
+	}
+	data := acl.Encode()
+	require.Equal(t, []byte{
+		2, 0, 0, 0,
+		0x01, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0, 6, 0, 0xe8, 0x03, 0, 0,
+		0x04, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+		0x10, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+		0x20, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+	}, data)
+
+	decoded, err := DecodeACL(data)
+	require.Equal(t, OK, err)
+	require.ElementsMatch(t, acl, decoded)
+	require.Equal(t, 0o764, decoded.Mode())
+
+	_, err = DecodeACL(data[:len(data)-1])
+	require.Equal(t, EINVAL, err)
+	decoded, err = DecodeACL(data[:4])
+	require.Equal(t, OK, err)
+	require.Nil(t, decoded)
+
+	// Named entries require a mask.
+	_, err = DecodeACL(acl[:4].Encode())
+	require.Equal(t, EINVAL, err)
+	require.Equal(t, EINVAL, append(acl, ACLEntry{Tag: ACL_USER, ID: 1000}).Validate())
+	require.Equal(t, OK, ACLFromMode(0o750).Validate())
+}
+
+func TestACLAllows(t *testing.T) {
+	acl := ACL{
+		{Tag: ACL_USER_OBJ, Perm: 7},
+		{Tag: ACL_USER, Perm: 7, ID: 1001},
+		{Tag: ACL_GROUP_OBJ, Perm: ACL_READ},
+		{Tag: ACL_GROUP, Perm: ACL_WRITE, ID: 20},
+		{Tag: ACL_MASK, Perm: ACL_READ | ACL_WRITE},
+		{Tag: ACL_OTHER, Perm: 0},
+	}
+	const owner, group = 1000, 10
+
+	require.True(t, acl.Allows(owner, nil, owner, group, ACL_EXECUTE))
+
+	// Named users are limited by the mask.
+	require.True(t, acl.Allows(1001, nil, owner, group, ACL_READ|ACL_WRITE))
+	require.False(t, acl.Allows(1001, nil, owner, group, ACL_EXECUTE))
+
+	// Any matching group entry may grant access, but a member of a group is not then treated as
+	// other.
+	require.True(t, acl.Allows(1002, []int{10, 20}, owner, group, ACL_WRITE))
+	require.True(t, acl.Allows(1002, []int{10, 20}, owner, group, ACL_READ))
+	require.False(t, acl.Allows(1002, []int{10, 20}, owner, group, ACL_READ|ACL_WRITE))
+	require.False(t, acl.Allows(1002, []int{30}, owner, group, ACL_READ))
+
+	require.True(t, ACLFromMode(0o604).Allows(1002, []int{30}, owner, group, ACL_READ))
+
+	chmod := acl.Chmod(0o710)
+	require.Equal(t, 0o710, chmod.Mode())
+	require.False(t, chmod.Allows(1001, nil, owner, group, ACL_READ))
+	require.Equal(t, ACL_READ, acl.entry(ACL_GROUP_OBJ).Perm)
+}
+
+func TestInheritACL(t *testing.T) {
+	def := ACL{
+		{Tag: ACL_USER_OBJ, Perm: 7},
+		{Tag: ACL_USER, Perm: 7, ID: 1001},
+		{Tag: ACL_GROUP_OBJ, Perm: 5},
+		{Tag: ACL_MASK, Perm: 7},
+		{Tag: ACL_OTHER, Perm: 5},
+	}
+
+	access, dflt, mode := InheritACL(def, S_IFREG|0o640, 0o077, false)
+	require.Equal(t, S_IFREG|0o640, mode)
+	require.Nil(t, dflt)
+	require.Equal(t, ACL_READ, access.entry(ACL_MASK).Perm)
+	require.Equal(t, 5, access.entry(ACL_GROUP_OBJ).Perm)
+
+	access, dflt, mode = InheritACL(def, 0o777, 0o022, true)
+	require.Equal(t, 0o775, mode)
+	require.Equal(t, def, dflt)
+	require.True(t, access.Allows(1001, nil, 1000, 10, 7))
+
+	access, _, mode = InheritACL(ACLFromMode(0o750), 0o666, 0, false)
+	require.Nil(t, access)
+	require.Equal(t, 0o640, mode)
+
+	// Without a default ACL, the umask is applied.
+	access, dflt, mode = InheritACL(nil, 0o666, 0o022, true)
+	require.Nil(t, access)
+	require.Nil(t, dflt)
+	require.Equal(t, 0o644, mode)
+}
+
+func TestMemFSACL(t *testing.T) {
+	fs := NewMemFS()
+
+	dir, err := fs.Mkdir(1, "dir", 0o755)
+	require.Equal(t, OK, err)
+	def := ACL{
+		{Tag: ACL_USER_OBJ, Perm: 7},
+		{Tag: ACL_USER, Perm: 6, ID: 1001},
+		{Tag: ACL_GROUP_OBJ, Perm: 5},
+		{Tag: ACL_MASK, Perm: 7},
+		{Tag: ACL_OTHER, Perm: 0},
+	}
+	require.Equal(t, OK, fs.SetXAttr(dir.Ino, XATTR_POSIX_ACL_DEFAULT, def.Encode(), 0))
+
+	// New files inherit the default ACL.
+	file, err := fs.Mknod(dir.Ino, "file", S_IFREG|0o644, 0)
+	require.Equal(t, OK, err)
+	require.Equal(t, S_IFREG|0o640, file.Attr.Mode)
+	names, err := fs.ListXAttrs(file.Ino)
+	require.Equal(t, OK, err)
+	require.Equal(t, []string{XATTR_POSIX_ACL_ACCESS}, names)
+	data, err := GetSizedXAttr(fs, file.Ino, XATTR_POSIX_ACL_ACCESS)
+	require.Equal(t, OK, err)
+	acl, err := DecodeACL(data)
+	require.Equal(t, OK, err)
+	require.True(t, acl.Allows(1001, nil, 0, 0, ACL_READ))
+	require.False(t, acl.Allows(1001, nil, 0, 0, ACL_WRITE))
+
+	// Changing the mode changes the mask.
+	mode := 0o660
+	_, err = fs.SetAttr(&SetAttrRequest{Ino: file.Ino, Mode: &mode})
+	require.Equal(t, OK, err)
+	data, err = GetSizedXAttr(fs, file.Ino, XATTR_POSIX_ACL_ACCESS)
+	require.Equal(t, OK, err)
+	acl, _ = DecodeACL(data)
+	require.True(t, acl.Allows(1001, nil, 0, 0, ACL_READ|ACL_WRITE))
+
+	// Setting the access ACL changes the mode, and a minimal ACL is stored as the mode.
+	require.Equal(t, OK, fs.SetXAttr(file.Ino, XATTR_POSIX_ACL_ACCESS,
+		ACLFromMode(0o600).Encode(), 0))
+	attr, err := fs.GetAttr(file.Ino, nil)
+	require.Equal(t, OK, err)
+	require.Equal(t, S_IFREG|0o600, attr.Mode)
+	_, err = GetSizedXAttr(fs, file.Ino, XATTR_POSIX_ACL_ACCESS)
+	require.Equal(t, ENODATA, err)
+
+	require.Equal(t, EACCES, fs.SetXAttr(file.Ino, XATTR_POSIX_ACL_DEFAULT, def.Encode(), 0))
+	require.Equal(t, EINVAL, fs.SetXAttr(dir.Ino, XATTR_POSIX_ACL_DEFAULT, []byte{1}, 0))
+	require.Equal(t, OK, fs.RemoveXAttr(dir.Ino, XATTR_POSIX_ACL_DEFAULT))
+	require.Equal(t, ENODATA, fs.RemoveXAttr(dir.Ino, XATTR_POSIX_ACL_DEFAULT))
+
+	// An ACL without entries removes the ACL, and leaves the mode unchanged.
+	require.Equal(t, OK, fs.SetXAttr(dir.Ino, XATTR_POSIX_ACL_DEFAULT, def.Encode(), 0))
+	require.Equal(t, OK, fs.SetXAttr(dir.Ino, XATTR_POSIX_ACL_DEFAULT, ACL(nil).Encode(), 0))
+	_, err = GetSizedXAttr(fs, dir.Ino, XATTR_POSIX_ACL_DEFAULT)
+	require.Equal(t, ENODATA, err)
+	require.Equal(t, OK, fs.SetXAttr(file.Ino, XATTR_POSIX_ACL_ACCESS, acl.Encode(), 0))
+	require.Equal(t, OK, fs.SetXAttr(file.Ino, XATTR_POSIX_ACL_ACCESS, ACL(nil).Encode(), 0))
+	_, err = GetSizedXAttr(fs, file.Ino, XATTR_POSIX_ACL_ACCESS)
+	require.Equal(t, ENODATA, err)
+	attr, err = fs.GetAttr(file.Ino, nil)
+	require.Equal(t, OK, err)
+	require.Equal(t, S_IFREG|0o660, attr.Mode)
+}
@@ -0,0 +1,298 @@
+package fuse
+
+import "context"
+
+// AdaptFileSystem returns a FileSystemV2 which forwards every operation to fs.
+//
+// This allows existing FileSystem implementations to run unchanged wherever a FileSystemV2 is
+// required.  If fs implements ContextFileSystem, each operation is forwarded to the FileSystem
+// returned by WithContext for the request.
+//
+// The adapter implements every operation interface, so every operation is registered with the
+// kernel, including those which fs leaves to DefaultFileSystem.  The kernel's own fallbacks, such
+// as calling Mknod and Open in place of Create, are therefore only used once an operation returns
+// ENOSYS.  Implement the operation interfaces of FileSystemV2 directly to leave operations
+// unregistered.
+func AdaptFileSystem(fs FileSystem) FileSystemV2 {
+	return &fsAdapter{fs: fs}
+}
+
+type fsAdapter struct {
+	fs FileSystem
+}
+
+// with returns the FileSystem which handles a request.
+func (a *fsAdapter) with(ctx context.Context) FileSystem {
+	if c, ok := a.fs.(ContextFileSystem); ok {
+		return c.WithContext(ctx)
+	}
+	return a.fs
+}
+
+var _ FileSystemV2 = &fsAdapter{}
+
+func (a *fsAdapter) Init(ctx context.Context, req *InitRequest, resp *InitResponse) Status {
+	return a.fs.Init(&resp.Conn)
+}
+
+func (a *fsAdapter) Destroy(ctx context.Context) {
+	a.fs.Destroy()
+}
+
+func (a *fsAdapter) StatFS(ctx context.Context, req *StatFSRequest, resp *StatFSResponse) Status {
+	s, err := a.with(ctx).StatFS(req.Ino)
+	if err == OK {
+		resp.Stat = *s
+	}
+	return err
+}
+
+func (a *fsAdapter) Lookup(ctx context.Context, req *LookupRequest, resp *EntryResponse) Status {
+	ent, err := a.with(ctx).Lookup(req.Parent, req.Name)
+	if err == OK {
+		resp.Entry = *ent
+	}
+	return err
+}
+
+func (a *fsAdapter) Forget(ctx context.Context, req *ForgetRequest) {
+	a.with(ctx).Forget(req.Ino, req.N)
+}
+
+// LookupTable implements LookupTracker, if the filesystem does.
+func (a *fsAdapter) LookupTable() LookupCounter {
+	if t, ok := a.fs.(LookupTracker); ok {
+		return t.LookupTable()
+	}
+	return nil
+}
+
+func (a *fsAdapter) GetAttr(ctx context.Context, req *GetAttrRequest, resp *AttrResponse) Status {
+	attr, err := a.with(ctx).GetAttr(req.Ino, req.File)
+	if err == OK {
+		resp.Attr = *attr
+	}
+	return err
+}
+
+func (a *fsAdapter) SetAttr(ctx context.Context, req *SetAttrRequest, resp *AttrResponse) Status {
+	attr, err := a.with(ctx).SetAttr(req)
+	if err == OK {
+		resp.Attr = *attr
+	}
+	return err
+}
+
+func (a *fsAdapter) ReadLink(ctx context.Context, req *ReadLinkRequest,
+	resp *ReadLinkResponse,
+) Status {
+	target, err := a.with(ctx).ReadLink(req.Ino)
+	if err == OK {
+		resp.Target = target
+	}
+	return err
+}
+
+func (a *fsAdapter) Mknod(ctx context.Context, req *MknodRequest, resp *EntryResponse) Status {
+	ent, err := a.with(ctx).Mknod(req.Parent, req.Name, req.Mode, req.Rdev)
+	if err == OK {
+		resp.Entry = *ent
+	}
+	return err
+}
+
+func (a *fsAdapter) Mkdir(ctx context.Context, req *MkdirRequest, resp *EntryResponse) Status {
+	ent, err := a.with(ctx).Mkdir(req.Parent, req.Name, req.Mode)
+	if err == OK {
+		resp.Entry = *ent
+	}
+	return err
+}
+
+func (a *fsAdapter) Unlink(ctx context.Context, req *UnlinkRequest) Status {
+	return a.with(ctx).Unlink(req.Parent, req.Name)
+}
+
+func (a *fsAdapter) Rmdir(ctx context.Context, req *RmdirRequest) Status {
+	return a.with(ctx).Rmdir(req.Parent, req.Name)
+}
+
+func (a *fsAdapter) Symlink(ctx context.Context, req *SymlinkRequest, resp *EntryResponse) Status {
+	ent, err := a.with(ctx).Symlink(req.Link, req.Parent, req.Name)
+	if err == OK {
+		resp.Entry = *ent
+	}
+	return err
+}
+
+func (a *fsAdapter) Rename(ctx context.Context, req *RenameRequest) Status {
+	return a.with(ctx).Rename(req.Parent, req.Name, req.NewParent, req.NewName, req.Flags)
+}
+
+func (a *fsAdapter) Link(ctx context.Context, req *LinkRequest, resp *EntryResponse) Status {
+	ent, err := a.with(ctx).Link(req.Ino, req.NewParent, req.NewName)
+	if err == OK {
+		resp.Entry = *ent
+	}
+	return err
+}
+
+func (a *fsAdapter) Open(ctx context.Context, req *OpenRequest, resp *OpenResponse) Status {
+	fi := &FileInfo{Flags: req.Flags}
+	err := a.with(ctx).Open(req.Ino, fi)
+	if err == OK {
+		*resp = newOpenResponse(fi)
+	}
+	return err
+}
+
+func (a *fsAdapter) Read(ctx context.Context, req *ReadRequest, resp *ReadResponse) Status {
+	data, err := a.with(ctx).Read(req.Ino, req.Size, req.Offset, req.File)
+	if err == OK {
+		resp.Data = data
+	}
+	return err
+}
+
+func (a *fsAdapter) Write(ctx context.Context, req *WriteRequest, resp *WriteResponse) Status {
+	n, err := a.with(ctx).Write(req.Data, req.Ino, req.Offset, req.File)
+	if err == OK {
+		resp.Written = n
+	}
+	return err
+}
+
+func (a *fsAdapter) Flush(ctx context.Context, req *FlushRequest) Status {
+	return a.with(ctx).Flush(req.Ino, req.File)
+}
+
+func (a *fsAdapter) Release(ctx context.Context, req *ReleaseRequest) Status {
+	return a.with(ctx).Release(req.Ino, req.File)
+}
+
+func (a *fsAdapter) FSync(ctx context.Context, req *FSyncRequest) Status {
+	return a.with(ctx).FSync(req.Ino, req.DataOnly, req.File)
+}
+
+func (a *fsAdapter) OpenDir(ctx context.Context, req *OpenRequest, resp *OpenResponse) Status {
+	fi := &FileInfo{Flags: req.Flags}
+	err := a.with(ctx).OpenDir(req.Ino, fi)
+	if err == OK {
+		*resp = newOpenResponse(fi)
+	}
+	return err
+}
+
+func (a *fsAdapter) ReadDir(ctx context.Context, req *ReadDirRequest,
+	resp *ReadDirResponse,
+) Status {
+	return a.with(ctx).ReadDir(req.Ino, req.File, req.Offset, req.Size, resp.DirEntryWriter)
+}
+
+func (a *fsAdapter) ReleaseDir(ctx context.Context, req *ReleaseRequest) Status {
+	return a.with(ctx).ReleaseDir(req.Ino, req.File)
+}
+
+func (a *fsAdapter) FSyncDir(ctx context.Context, req *FSyncRequest) Status {
+	return a.with(ctx).FSyncDir(req.Ino, req.DataOnly, req.File)
+}
+
+func (a *fsAdapter) SetXAttr(ctx context.Context, req *SetXAttrRequest) Status {
+	return a.with(ctx).SetXAttr(req.Ino, req.Name, req.Value, req.Flags)
+}
+
+func (a *fsAdapter) GetXAttr(ctx context.Context, req *GetXAttrRequest,
+	resp *GetXAttrResponse,
+) Status {
+	value, err := GetSizedXAttr(a.with(ctx), req.Ino, req.Name)
+	if err == OK {
+		resp.Value = value
+	}
+	return err
+}
+
+func (a *fsAdapter) ListXAttrs(ctx context.Context, req *ListXAttrsRequest,
+	resp *ListXAttrsResponse,
+) Status {
+	names, err := a.with(ctx).ListXAttrs(req.Ino)
+	if err == OK {
+		resp.Names = names
+	}
+	return err
+}
+
+func (a *fsAdapter) RemoveXAttr(ctx context.Context, req *RemoveXAttrRequest) Status {
+	return a.with(ctx).RemoveXAttr(req.Ino, req.Name)
+}
+
+func (a *fsAdapter) Access(ctx context.Context, req *AccessRequest) Status {
+	return a.with(ctx).Access(req.Ino, req.Mask)
+}
+
+func (a *fsAdapter) Create(ctx context.Context, req *CreateRequest, resp *CreateResponse) Status {
+	fi := &FileInfo{Flags: req.Flags}
+	ent, err := a.with(ctx).Create(req.Parent, req.Name, req.Mode, fi)
+	if err == OK {
+		resp.Entry = *ent
+		resp.OpenResponse = newOpenResponse(fi)
+	}
+	return err
+}
+
+// newOpenResponse returns the handle and settings from a FileInfo set by an open method.
+func newOpenResponse(fi *FileInfo) OpenResponse {
+	return OpenResponse{
+		Handle:       fi.Handle,
+		DirectIO:     fi.DirectIO,
+		KeepCache:    fi.KeepCache,
+		NonSeekable:  fi.NonSeekable,
+		CacheReaddir: fi.CacheReaddir,
+		NoFlush:      fi.NoFlush,
+	}
+}
+
+// SizedXAttrGetter is the extended attribute API of FileSystem, in which the size of a value is
+// queried first, and the value is then copied into a buffer of that size.
+type SizedXAttrGetter interface {
+	// GetXAttrSize returns the size of the attribute value.
+	GetXAttrSize(ino int64, name string) (int, Status)
+
+	// GetXAttr copies the attribute value into out, and returns the number of bytes copied.
+	// Returns ERANGE if out is too small.
+	GetXAttr(ino int64, name string, out []byte) (int, Status)
+}
+
+// maxXAttrRetries is the number of times GetSizedXAttr queries the size again after ERANGE.
+const maxXAttrRetries = 3
+
+// GetSizedXAttr returns the complete value of an extended attribute from a SizedXAttrGetter.  It
+// is used to serve a FileSystem, and can be used by a FileSystemV2 which wraps one.
+//
+// If the value grows between the two calls, the size is queried again, up to maxXAttrRetries
+// times.  EIO is returned if the value keeps growing, or if more bytes are reported as copied
+// than fit in the buffer.
+func GetSizedXAttr(fs SizedXAttrGetter, ino int64, name string) ([]byte, Status) {
+	for i := 0; i <= maxXAttrRetries; i++ {
+		size, err := fs.GetXAttrSize(ino, name)
+		if err != OK {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, EIO
+		}
+
+		buf := make([]byte, size)
+		n, err := fs.GetXAttr(ino, name, buf)
+		if err == ERANGE {
+			continue
+		}
+		if err != OK {
+			return nil, err
+		}
+		if n < 0 || n > len(buf) {
+			return nil, EIO
+		}
+		return buf[:n], OK
+	}
+	return nil, EIO
+}
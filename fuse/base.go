@@ -1,5 +1,7 @@
 package fuse
 
+import "context"
+
 // DefaultFileSystem provides a filesystem that returns a suitable default for all methods.
 // Most methods allow ENOSYS, which signals to FUSE that the operation is not implemented.
 // Other methods simply return success, if the method is optional.
@@ -17,7 +19,9 @@ type DefaultFileSystem struct{}
 var _ FileSystem = &DefaultFileSystem{}
 
 // Init implements FileSystem.
-func (d *DefaultFileSystem) Init(*ConnInfo) {}
+func (d *DefaultFileSystem) Init(*ConnInfo) Status {
+	return OK
+}
 
 // Destroy implements FileSystem.
 func (d *DefaultFileSystem) Destroy() {}
@@ -66,9 +70,7 @@ func (d *DefaultFileSystem) GetAttr(ino int64, fi *FileInfo) (attr *InoAttr, err
 }
 
 // SetAttr implements FileSystem.
-func (d *DefaultFileSystem) SetAttr(ino int64, attr *InoAttr, mask SetAttrMask, fi *FileInfo) (
-	*InoAttr, Status,
-) {
+func (d *DefaultFileSystem) SetAttr(req *SetAttrRequest) (*InoAttr, Status) {
 	return nil, ENOSYS
 }
 
@@ -175,7 +177,9 @@ func (d *DefaultFileSystem) GetXAttr(ino int64, name string, out []byte) (int, S
 }
 
 // SetXAttr implements FileSystem.
-func (d *DefaultFileSystem) SetXAttr(ino int64, name string, value []byte, flags int) Status {
+func (d *DefaultFileSystem) SetXAttr(ino int64, name string, value []byte,
+	flags XAttrFlags,
+) Status {
 	return ENOSYS
 }
 
@@ -183,3 +187,206 @@ func (d *DefaultFileSystem) SetXAttr(ino int64, name string, value []byte, flags
 func (d *DefaultFileSystem) RemoveXAttr(ino int64, name string) Status {
 	return ENOSYS
 }
+
+// DefaultFileSystemV2 provides a FileSystemV2 that returns a suitable default for all methods.
+// The defaults match those of DefaultFileSystem.
+//
+// Since every operation is implemented, every operation is registered with the kernel.  Implement
+// only the required operation interfaces, such as Lookuper, to let the kernel fall back to its own
+// behavior for the others.
+//
+// Usage eXAmple:
+//
+//	type MyFs struct {
+//	  fuse.DefaultFileSystemV2
+//	}
+type DefaultFileSystemV2 struct{}
+
+var _ FileSystemV2 = &DefaultFileSystemV2{}
+
+// Init implements FileSystemV2.
+func (d *DefaultFileSystemV2) Init(ctx context.Context, req *InitRequest,
+	resp *InitResponse,
+) Status {
+	return OK
+}
+
+// Destroy implements FileSystemV2.
+func (d *DefaultFileSystemV2) Destroy(ctx context.Context) {}
+
+// StatFS implements FileSystemV2.
+func (d *DefaultFileSystemV2) StatFS(ctx context.Context, req *StatFSRequest,
+	resp *StatFSResponse,
+) Status {
+	return ENOSYS
+}
+
+// Lookup implements FileSystemV2.
+func (d *DefaultFileSystemV2) Lookup(ctx context.Context, req *LookupRequest,
+	resp *EntryResponse,
+) Status {
+	return ENOSYS
+}
+
+// Forget implements FileSystemV2.
+func (d *DefaultFileSystemV2) Forget(ctx context.Context, req *ForgetRequest) {}
+
+// GetAttr implements FileSystemV2.
+func (d *DefaultFileSystemV2) GetAttr(ctx context.Context, req *GetAttrRequest,
+	resp *AttrResponse,
+) Status {
+	return ENOSYS
+}
+
+// SetAttr implements FileSystemV2.
+func (d *DefaultFileSystemV2) SetAttr(ctx context.Context, req *SetAttrRequest,
+	resp *AttrResponse,
+) Status {
+	return ENOSYS
+}
+
+// ReadLink implements FileSystemV2.
+func (d *DefaultFileSystemV2) ReadLink(ctx context.Context, req *ReadLinkRequest,
+	resp *ReadLinkResponse,
+) Status {
+	return ENOSYS
+}
+
+// Mknod implements FileSystemV2.
+func (d *DefaultFileSystemV2) Mknod(ctx context.Context, req *MknodRequest,
+	resp *EntryResponse,
+) Status {
+	return ENOSYS
+}
+
+// Mkdir implements FileSystemV2.
+func (d *DefaultFileSystemV2) Mkdir(ctx context.Context, req *MkdirRequest,
+	resp *EntryResponse,
+) Status {
+	return ENOSYS
+}
+
+// Unlink implements FileSystemV2.
+func (d *DefaultFileSystemV2) Unlink(ctx context.Context, req *UnlinkRequest) Status {
+	return ENOSYS
+}
+
+// Rmdir implements FileSystemV2.
+func (d *DefaultFileSystemV2) Rmdir(ctx context.Context, req *RmdirRequest) Status {
+	return ENOSYS
+}
+
+// Symlink implements FileSystemV2.
+func (d *DefaultFileSystemV2) Symlink(ctx context.Context, req *SymlinkRequest,
+	resp *EntryResponse,
+) Status {
+	return ENOSYS
+}
+
+// Rename implements FileSystemV2.
+func (d *DefaultFileSystemV2) Rename(ctx context.Context, req *RenameRequest) Status {
+	return ENOSYS
+}
+
+// Link implements FileSystemV2.
+func (d *DefaultFileSystemV2) Link(ctx context.Context, req *LinkRequest,
+	resp *EntryResponse,
+) Status {
+	return ENOSYS
+}
+
+// Open implements FileSystemV2.
+func (d *DefaultFileSystemV2) Open(ctx context.Context, req *OpenRequest,
+	resp *OpenResponse,
+) Status {
+	return ENOSYS
+}
+
+// Read implements FileSystemV2.
+func (d *DefaultFileSystemV2) Read(ctx context.Context, req *ReadRequest,
+	resp *ReadResponse,
+) Status {
+	return ENOSYS
+}
+
+// Write implements FileSystemV2.
+func (d *DefaultFileSystemV2) Write(ctx context.Context, req *WriteRequest,
+	resp *WriteResponse,
+) Status {
+	return ENOSYS
+}
+
+// Flush implements FileSystemV2.
+func (d *DefaultFileSystemV2) Flush(ctx context.Context, req *FlushRequest) Status {
+	return ENOSYS
+}
+
+// Release implements FileSystemV2.
+func (d *DefaultFileSystemV2) Release(ctx context.Context, req *ReleaseRequest) Status {
+	return ENOSYS
+}
+
+// FSync implements FileSystemV2.
+func (d *DefaultFileSystemV2) FSync(ctx context.Context, req *FSyncRequest) Status {
+	return ENOSYS
+}
+
+// OpenDir implements FileSystemV2.
+func (d *DefaultFileSystemV2) OpenDir(ctx context.Context, req *OpenRequest,
+	resp *OpenResponse,
+) Status {
+	return OK
+}
+
+// ReadDir implements FileSystemV2.
+func (d *DefaultFileSystemV2) ReadDir(ctx context.Context, req *ReadDirRequest,
+	resp *ReadDirResponse,
+) Status {
+	return ENOSYS
+}
+
+// ReleaseDir implements FileSystemV2.
+func (d *DefaultFileSystemV2) ReleaseDir(ctx context.Context, req *ReleaseRequest) Status {
+	return OK
+}
+
+// FSyncDir implements FileSystemV2.
+func (d *DefaultFileSystemV2) FSyncDir(ctx context.Context, req *FSyncRequest) Status {
+	return ENOSYS
+}
+
+// SetXAttr implements FileSystemV2.
+func (d *DefaultFileSystemV2) SetXAttr(ctx context.Context, req *SetXAttrRequest) Status {
+	return ENOSYS
+}
+
+// GetXAttr implements FileSystemV2.
+func (d *DefaultFileSystemV2) GetXAttr(ctx context.Context, req *GetXAttrRequest,
+	resp *GetXAttrResponse,
+) Status {
+	return ENOSYS
+}
+
+// ListXAttrs implements FileSystemV2.
+func (d *DefaultFileSystemV2) ListXAttrs(ctx context.Context, req *ListXAttrsRequest,
+	resp *ListXAttrsResponse,
+) Status {
+	return ENOSYS
+}
+
+// RemoveXAttr implements FileSystemV2.
+func (d *DefaultFileSystemV2) RemoveXAttr(ctx context.Context, req *RemoveXAttrRequest) Status {
+	return ENOSYS
+}
+
+// Access implements FileSystemV2.
+func (d *DefaultFileSystemV2) Access(ctx context.Context, req *AccessRequest) Status {
+	return ENOSYS
+}
+
+// Create implements FileSystemV2.
+func (d *DefaultFileSystemV2) Create(ctx context.Context, req *CreateRequest,
+	resp *CreateResponse,
+) Status {
+	return ENOSYS
+}
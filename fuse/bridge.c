@@ -1,3 +1,5 @@
+//go:build cgo && !nocgo
+
 #include "wrapper.h"
 
 #include <assert.h>
@@ -7,19 +9,13 @@
 #include <stdlib.h>       // for free
 #include <sys/stat.h>     // for stat, mode_t, dev_t
 #include <sys/statvfs.h>  // for statvfs
-#include <unistd.h>       // for off_t, getgid, getuid
+#include <unistd.h>       // for off_t, getuid
 
 #include "_cgo_export.h"  // IWYU pragma: keep
 
-// Bridge methods are FUSE C callbacks.  The callbacks pass through to the
-// corresponding Go function and then translate the return value into the
-// appropriate FUSE result call.
-
-// TODO: log error result from all fuse_reply_* methods.
-
-static const struct stat emptyStat;
-static const struct fuse_entry_param emptyEntry;
-static const struct statvfs emptyStatVfs;
+// Bridge methods are FUSE C callbacks.  The callbacks pass the request through to the
+// corresponding Go function, which is responsible for sending the reply.  The reply may be sent
+// after the callback returns when the filesystem is served asynchronously.
 
 // bridge_test_mode is set to TRUE when testing the bridge interface.
 static bool bridge_test_mode = false;
@@ -61,10 +57,10 @@ int get_fsid(fuse_req_t req) {
     return r->userdata;
   }
 
-  return *(int *)fuse_req_userdata(req);
+  return ((struct bridge_userdata *)fuse_req_userdata(req))->id;
 }
 
-static int reply_err(fuse_req_t req, int err) {
+int reply_err(fuse_req_t req, int err) {
   if (bridge_test_mode) {
     return test_Reply_Err(fuse_test_req_id(req), err);
   }
@@ -72,7 +68,7 @@ static int reply_err(fuse_req_t req, int err) {
   return fuse_reply_err(req, err);
 }
 
-static int reply_entry(fuse_req_t req, struct fuse_entry_param *ent) {
+int reply_entry(fuse_req_t req, struct fuse_entry_param *ent) {
   if (bridge_test_mode) {
     return test_Reply_Entry(fuse_test_req_id(req), ent);
   }
@@ -80,7 +76,7 @@ static int reply_entry(fuse_req_t req, struct fuse_entry_param *ent) {
   return fuse_reply_entry(req, ent);
 }
 
-static void reply_none(fuse_req_t req) {
+void reply_none(fuse_req_t req) {
   if (bridge_test_mode) {
     test_Reply_None(fuse_test_req_id(req));
     return;
@@ -90,28 +86,28 @@ static void reply_none(fuse_req_t req) {
   return;
 }
 
-static int reply_create(fuse_req_t req, struct fuse_entry_param *ent, struct fuse_file_info *fi) {
+int reply_create(fuse_req_t req, struct fuse_entry_param *ent, struct fuse_file_info *fi) {
   if (bridge_test_mode) {
     return test_Reply_Create(fuse_test_req_id(req), ent, fi);
   }
   return fuse_reply_create(req, ent, fi);
 }
 
-static int reply_attr(fuse_req_t req, struct stat *attr, double timeout) {
+int reply_attr(fuse_req_t req, struct stat *attr, double timeout) {
   if (bridge_test_mode) {
     return test_Reply_Attr(fuse_test_req_id(req), attr, timeout);
   }
   return fuse_reply_attr(req, attr, timeout);
 }
 
-static int reply_readlink(fuse_req_t req, char *link) {
+int reply_readlink(fuse_req_t req, const char *link) {
   if (bridge_test_mode) {
-    return test_Reply_Readlink(fuse_test_req_id(req), link);
+    return test_Reply_Readlink(fuse_test_req_id(req), (char *)link);
   }
   return fuse_reply_readlink(req, link);
 }
 
-static int reply_open(fuse_req_t req, struct fuse_file_info *fi) {
+int reply_open(fuse_req_t req, struct fuse_file_info *fi) {
   if (bridge_test_mode) {
     return test_Reply_Open(fuse_test_req_id(req), fi);
   }
@@ -119,7 +115,7 @@ static int reply_open(fuse_req_t req, struct fuse_file_info *fi) {
   return fuse_reply_open(req, fi);
 }
 
-static int reply_write(fuse_req_t req, size_t count) {
+int reply_write(fuse_req_t req, size_t count) {
   if (bridge_test_mode) {
     return test_Reply_Write(fuse_test_req_id(req), count);
   }
@@ -135,7 +131,7 @@ int reply_buf(fuse_req_t req, char *buf, size_t size) {
   return fuse_reply_buf(req, buf, size);
 }
 
-static int reply_statfs(fuse_req_t req, struct statvfs *stbuf) {
+int reply_statfs(fuse_req_t req, struct statvfs *stbuf) {
   if (bridge_test_mode) {
     return test_Reply_Statfs(fuse_test_req_id(req), stbuf);
   }
@@ -143,7 +139,7 @@ static int reply_statfs(fuse_req_t req, struct statvfs *stbuf) {
   return fuse_reply_statfs(req, stbuf);
 }
 
-static int reply_xattr(fuse_req_t req, size_t count) {
+int reply_xattr(fuse_req_t req, size_t count) {
   if (bridge_test_mode) {
     return test_Reply_Xattr(fuse_test_req_id(req), count);
   }
@@ -151,129 +147,91 @@ static int reply_xattr(fuse_req_t req, size_t count) {
   return fuse_reply_xattr(req, count);
 }
 
+struct bridge_caller get_caller(fuse_req_t req) {
+  struct bridge_caller caller;
+  if (bridge_test_mode) {
+    caller.uid = getuid();
+    caller.gid = getgid();
+    caller.pid = getpid();
+    caller.umask = 0;
+    return caller;
+  }
+
+  const struct fuse_ctx *ctx = fuse_req_ctx(req);
+  caller.uid = ctx->uid;
+  caller.gid = ctx->gid;
+  caller.pid = ctx->pid;
+  caller.umask = ctx->umask;
+  return caller;
+}
+
+static void bridge_interrupt(fuse_req_t req, void *data) { ll_Interrupt(req); }
+
+void register_interrupt(fuse_req_t req) {
+  if (bridge_test_mode) {
+    return;
+  }
+
+  // If the request has already been interrupted, bridge_interrupt is called before this returns.
+  fuse_req_interrupt_func(req, bridge_interrupt, NULL);
+}
+
 // The Init call first configures all FUSE wrappers to point to the real FUSE methods.
 void bridge_init(void *userdata, struct fuse_conn_info *conn) {
-  int id = *(int *)userdata;
-  ll_Init(id, conn);
+  struct bridge_userdata *ud = userdata;
+  if (ll_Init(ud->id, conn) != 0 && ud->se != NULL) {
+    fuse_session_exit(ud->se);
+  }
 }
 
 void bridge_destroy(void *userdata) {
-  int id = *(int *)userdata;
-  ll_Destroy(id);
+  struct bridge_userdata *ud = userdata;
+  ll_Destroy(ud->id);
 }
 
 void bridge_lookup(fuse_req_t req, fuse_ino_t parent, const char *name) {
-  int id = get_fsid(req);
-  struct fuse_entry_param entry = emptyEntry;
-  entry.attr.st_uid = getuid();
-  entry.attr.st_gid = getgid();
-  int err = ll_Lookup(id, parent, (char *)name, &entry);
-  if (err != 0) {
-    reply_err(req, err);
-  } else if (reply_entry(req, &entry) == -ENOENT) {
-    // Request aborted, tell filesystem that reference was dropped.
-    ll_Forget(id, entry.ino, 1);
-  }
+  ll_Lookup(get_fsid(req), req, parent, (char *)name);
 }
 
 void bridge_forget(fuse_req_t req, fuse_ino_t ino, unsigned long nlookup) {
-  int id = get_fsid(req);
-  ll_Forget(id, ino, (int)nlookup);
-  reply_none(req);
+  ll_Forget(get_fsid(req), req, ino, (int)nlookup);
+}
+
+#if FUSE_USE_VERSION >= 30
+void bridge_forget_multi(fuse_req_t req, size_t count, struct fuse_forget_data *forgets) {
+  ll_ForgetMulti(get_fsid(req), req, count, forgets);
 }
+#endif
 
 void bridge_getattr(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  struct stat attr = emptyStat;
-  attr.st_uid = getuid();
-  attr.st_gid = getgid();
-  double attr_timeout = 1.0;
-  int err = ll_GetAttr(id, ino, fi, &attr, &attr_timeout);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_attr(req, &attr, attr_timeout);
-  }
+  ll_GetAttr(get_fsid(req), req, ino, fi);
 }
 
 void bridge_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr, int to_set,
                     struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  struct stat out = emptyStat;
-  out.st_uid = getuid();
-  out.st_gid = getgid();
-  double attr_timeout = 1.0;
-  int err = ll_SetAttr(id, ino, attr, to_set, fi, &out, &attr_timeout);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_attr(req, &out, attr_timeout);
-  }
+  ll_SetAttr(get_fsid(req), req, ino, attr, to_set, fi);
 }
 
-void bridge_readlink(fuse_req_t req, fuse_ino_t ino) {
-  int id = get_fsid(req);
-  int err = 0;
-  char *link = ll_ReadLink(id, ino, &err);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_readlink(req, link);
-  }
-  if (link != NULL) {
-    free(link);
-  }
-}
+void bridge_readlink(fuse_req_t req, fuse_ino_t ino) { ll_ReadLink(get_fsid(req), req, ino); }
 
 void bridge_mknod(fuse_req_t req, fuse_ino_t parent, const char *name, mode_t mode, dev_t rdev) {
-  int id = get_fsid(req);
-  struct fuse_entry_param entry = emptyEntry;
-  entry.attr.st_uid = getuid();
-  entry.attr.st_gid = getgid();
-  int err = ll_Mknod(id, parent, (char *)name, mode, rdev, &entry);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_entry(req, &entry);
-  }
+  ll_Mknod(get_fsid(req), req, parent, (char *)name, mode, rdev);
 }
 
 void bridge_mkdir(fuse_req_t req, fuse_ino_t parent, const char *name, mode_t mode) {
-  int id = get_fsid(req);
-  struct fuse_entry_param entry = emptyEntry;
-  entry.attr.st_uid = getuid();
-  entry.attr.st_gid = getgid();
-  int err = ll_Mkdir(id, parent, (char *)name, mode, &entry);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_entry(req, &entry);
-  }
+  ll_Mkdir(get_fsid(req), req, parent, (char *)name, mode);
 }
 
 void bridge_unlink(fuse_req_t req, fuse_ino_t parent, const char *name) {
-  int id = get_fsid(req);
-  int err = ll_Unlink(id, parent, (char *)name);
-  reply_err(req, err);
+  ll_Unlink(get_fsid(req), req, parent, (char *)name);
 }
 
 void bridge_rmdir(fuse_req_t req, fuse_ino_t parent, const char *name) {
-  int id = get_fsid(req);
-  int err = ll_Rmdir(id, parent, (char *)name);
-  reply_err(req, err);
+  ll_Rmdir(get_fsid(req), req, parent, (char *)name);
 }
 
 void bridge_symlink(fuse_req_t req, const char *link, fuse_ino_t parent, const char *name) {
-  int id = get_fsid(req);
-  struct fuse_entry_param entry = emptyEntry;
-  entry.attr.st_uid = getuid();
-  entry.attr.st_gid = getgid();
-  int err = ll_Symlink(id, (char *)link, parent, (char *)name, &entry);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_entry(req, &entry);
-  }
+  ll_Symlink(get_fsid(req), req, (char *)link, parent, (char *)name);
 }
 
 #if defined(__APPLE__)
@@ -284,141 +242,71 @@ void bridge_rename(fuse_req_t req, fuse_ino_t parent, const char *name, fuse_ino
 void bridge_rename(fuse_req_t req, fuse_ino_t parent, const char *name, fuse_ino_t newparent,
                    const char *newname, unsigned int flags) {
 #endif
-  int id = get_fsid(req);
-  int err = ll_Rename(id, parent, (char *)name, newparent, (char *)newname, flags);
-  reply_err(req, err);
+  ll_Rename(get_fsid(req), req, parent, (char *)name, newparent, (char *)newname, flags);
 }
 
 void bridge_link(fuse_req_t req, fuse_ino_t ino, fuse_ino_t newparent, const char *newname) {
-  int id = get_fsid(req);
-  struct fuse_entry_param entry = emptyEntry;
-  entry.attr.st_uid = getuid();
-  entry.attr.st_gid = getgid();
-  int err = ll_Link(id, ino, newparent, (char *)newname, &entry);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_entry(req, &entry);
-  }
+  ll_Link(get_fsid(req), req, ino, newparent, (char *)newname);
 }
 
 void bridge_open(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_Open(id, ino, fi);
-  if (err != 0) {
-    reply_err(req, err);
-  } else if (reply_open(req, fi) == -ENOENT) {
-    // Request aborted, let Go wrapper know.
-    ll_Release(id, ino, fi);
-  }
+  ll_Open(get_fsid(req), req, ino, fi);
 }
 
 void bridge_read(fuse_req_t req, fuse_ino_t ino, size_t size, off_t off,
                  struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_Read(id, req, ino, size, off, fi);
-  if (err != 0) {
-    reply_err(req, err);
-  }
+  ll_Read(get_fsid(req), req, ino, size, off, fi);
 }
 
 void bridge_write(fuse_req_t req, fuse_ino_t ino, const char *buf, size_t size, off_t off,
                   struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  size_t written = size;
-  int err = ll_Write(id, ino, (char *)buf, &written, off, fi);
-  if (err == 0) {
-    reply_write(req, written);
-  } else {
-    reply_err(req, err);
-  }
+  ll_Write(get_fsid(req), req, ino, (char *)buf, size, off, fi);
 }
 
 void bridge_flush(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_Flush(id, ino, fi);
-  reply_err(req, err);
+  ll_Flush(get_fsid(req), req, ino, fi);
 }
 
 void bridge_release(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_Release(id, ino, fi);
-  reply_err(req, err);
+  ll_Release(get_fsid(req), req, ino, fi);
 }
 
 void bridge_fsync(fuse_req_t req, fuse_ino_t ino, int datasync, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_FSync(id, ino, datasync, fi);
-  reply_err(req, err);
+  ll_FSync(get_fsid(req), req, ino, datasync, fi);
 }
 
 void bridge_opendir(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_OpenDir(id, ino, fi);
-  if (err != 0) {
-    reply_err(req, err);
-  } else if (reply_open(req, fi) == -ENOENT) {
-    // Request aborted, let Go wrapper know.
-    ll_ReleaseDir(id, ino, fi);
-  }
+  ll_OpenDir(get_fsid(req), req, ino, fi);
 }
 
 void bridge_readdir(fuse_req_t req, fuse_ino_t ino, size_t size, off_t off,
                     struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  struct DirBuf db;
-  db.req = req;
-  db.size = size < 4096 ? 4096 : size;
-  db.buf = malloc(db.size);
-  db.offset = 0;
-
-  int err = ll_ReadDir(id, ino, size, off, fi, &db);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_buf(req, db.buf, db.offset);
-  }
-
-  free(db.buf);
+  ll_ReadDir(get_fsid(req), req, ino, size, off, fi);
 }
 
 void bridge_releasedir(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_ReleaseDir(id, ino, fi);
-  reply_err(req, err);
+  ll_ReleaseDir(get_fsid(req), req, ino, fi);
 }
 
 void bridge_fsyncdir(fuse_req_t req, fuse_ino_t ino, int datasync, struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  int err = ll_FSyncDir(id, ino, datasync, fi);
-  reply_err(req, err);
-}
-
-void bridge_statfs(fuse_req_t req, fuse_ino_t ino) {
-  int id = get_fsid(req);
-  struct statvfs stat = emptyStatVfs;
-  int err = ll_StatFS(id, ino, &stat);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_statfs(req, &stat);
-  }
+  ll_FSyncDir(get_fsid(req), req, ino, datasync, fi);
 }
 
+void bridge_statfs(fuse_req_t req, fuse_ino_t ino) { ll_StatFS(get_fsid(req), req, ino); }
+
 #ifdef __APPLE__
 void bridge_setxattr(fuse_req_t req, fuse_ino_t ino, const char *name, const char *value,
                      size_t size, int flags, uint32_t position) {
   if (position != 0) {
     reply_err(req, EPERM);
+    return;
   }
 #else
 void bridge_setxattr(fuse_req_t req, fuse_ino_t ino, const char *name, const char *value,
                      size_t size, int flags) {
 #endif
 
-  int id = get_fsid(req);
-  int err = ll_SetXAttr(id, ino, (char *)name, (char *)value, size, flags);
-  reply_err(req, err);
+  ll_SetXAttr(get_fsid(req), req, ino, (char *)name, (char *)value, size, flags);
 }
 
 #ifdef __APPLE__
@@ -426,68 +314,30 @@ void bridge_getxattr(fuse_req_t req, fuse_ino_t ino, const char *name, size_t si
                      uint32_t position) {
   if (position != 0) {
     reply_err(req, EPERM);
+    return;
   }
 #else
 void bridge_getxattr(fuse_req_t req, fuse_ino_t ino, const char *name, size_t size) {
 #endif
 
-  int id = get_fsid(req);
-  char *buf = (size > 0) ? malloc(size) : 0;
-  int err = ll_GetXAttr(id, ino, (char *)name, buf, &size);
-  if (err != 0) {
-    reply_err(req, err);
-    return;
-  }
-
-  if (buf != NULL) {
-    reply_buf(req, buf, size);
-    free(buf);
-  } else {
-    reply_xattr(req, size);
-  }
+  ll_GetXAttr(get_fsid(req), req, ino, (char *)name, size);
 }
 
 void bridge_listxattr(fuse_req_t req, fuse_ino_t ino, size_t size) {
-  int id = get_fsid(req);
-  char *buf = (size > 0) ? malloc(size) : 0;
-  int err = ll_ListXAttr(id, ino, buf, &size);
-  if (err != 0) {
-    reply_err(req, err);
-    return;
-  }
-
-  if (buf != NULL) {
-    reply_buf(req, buf, size);
-    free(buf);
-  } else {
-    reply_xattr(req, size);
-  }
+  ll_ListXAttr(get_fsid(req), req, ino, size);
 }
 
 void bridge_removexattr(fuse_req_t req, fuse_ino_t ino, const char *name) {
-  int id = get_fsid(req);
-  int err = ll_RemoveXAttr(id, ino, (char *)name);
-  reply_err(req, err);
+  ll_RemoveXAttr(get_fsid(req), req, ino, (char *)name);
 }
 
 void bridge_access(fuse_req_t req, fuse_ino_t ino, int mask) {
-  int id = get_fsid(req);
-  int err = ll_Access(id, ino, mask);
-  reply_err(req, err);
+  ll_Access(get_fsid(req), req, ino, mask);
 }
 
 void bridge_create(fuse_req_t req, fuse_ino_t parent, const char *name, mode_t mode,
                    struct fuse_file_info *fi) {
-  int id = get_fsid(req);
-  struct fuse_entry_param entry = emptyEntry;
-  entry.attr.st_uid = getuid();
-  entry.attr.st_gid = getgid();
-  int err = ll_Create(id, parent, (char *)name, mode, fi, &entry);
-  if (err != 0) {
-    reply_err(req, err);
-  } else {
-    reply_create(req, &entry, fi);
-  }
+  ll_Create(get_fsid(req), req, parent, (char *)name, mode, fi);
 }
 
 void bridge_getlk(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi, struct flock *lock);
@@ -504,7 +354,6 @@ void bridge_write_buf(fuse_req_t req, fuse_ino_t ino, struct fuse_bufvec *bufv,
                       struct fuse_file_info *fi);
 void bridge_retrieve_reply(fuse_req_t req, void *cookie, fuse_ino_t ino, off_t offset,
                            struct fuse_bufvec *bufv);
-void bridge_forget_multi(fuse_req_t req, size_t count, struct fuse_forget_data *forgets);
 #endif
 
 void bridge_flock(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi, int op);
@@ -1,3 +1,5 @@
+//go:build cgo && !nocgo
+
 package fuse
 
 import (
@@ -10,11 +12,11 @@ import (
 // #include <stdlib.h>  // for free()
 import "C"
 
-// State which tracks instances of FileSystem, with a unique identifier used
+// State which tracks mounted instances of FileSystemV2, with a unique identifier used
 // by C code.  This avoids passing Go pointers into C code.
 var (
 	fsMapLock sync.RWMutex
-	rawFSMap  = make(map[int]FileSystem)
+	rawFSMap  = make(map[int]*mount)
 	nextFSID  = 1
 )
 
@@ -34,29 +36,45 @@ func enableBridgeTestMode() {
 //
 // When the filesystem is no longer active, DeregisterFS can be called to release resources.
 func RegisterFS(fs FileSystem) int {
+	return RegisterFSV2(AdaptFileSystem(fs), nil)
+}
+
+// RegisterFSV2 registers a FileSystemV2 with the bridge layer.
+// If opts is nil, the default options are used.  See RegisterFS for details.
+//
+// The filesystem may implement any subset of the operation interfaces, such as Lookuper, instead
+// of the complete FileSystemV2.  Only the implemented operations are registered with libfuse.  A
+// FileSystem is accepted as well, and is served through AdaptFileSystem.
+func RegisterFSV2(fs any, opts *Options) int {
+	m := newMount(fs, opts)
+
 	fsMapLock.Lock()
 	defer fsMapLock.Unlock()
 
 	id := nextFSID
 	nextFSID++
-	rawFSMap[id] = fs
+	rawFSMap[id] = m
 	return id
 }
 
 // DeregisterFS releases a previously allocated filesystem id from RegisterRawFs.
 func DeregisterFS(id int) {
 	fsMapLock.Lock()
-	defer fsMapLock.Unlock()
-
+	m := rawFSMap[id]
 	delete(rawFSMap, id)
+	fsMapLock.Unlock()
+
+	if m != nil {
+		m.cancel()
+	}
 }
 
-// getFS returns the filesystem for the given id.
-func getFS(id int) FileSystem {
+// getMount returns the mounted filesystem for the given id.
+func getMount(id int) *mount {
 	fsMapLock.RLock()
-	fs := rawFSMap[id]
+	m := rawFSMap[id]
 	fsMapLock.RUnlock()
-	return fs
+	return m
 }
 
 // Version returns the version number from the linked libfuse client implementation.
@@ -70,356 +88,395 @@ func zeroCopyBuf(buf unsafe.Pointer, size int) []byte {
 	return unsafe.Slice((*byte)(buf), size)
 }
 
+// requestCBuf returns a byte slice holding the contents of a C buffer owned by the request.
+func (m *mount) requestCBuf(buf unsafe.Pointer, size int) []byte {
+	return m.requestBuf(zeroCopyBuf(buf, size))
+}
+
+// opFlags maps operation names to the bridge flags which register them with libfuse.
+var opFlags = map[string]C.uint64_t{
+	"StatFS":      C.BRIDGE_OP_STATFS,
+	"Lookup":      C.BRIDGE_OP_LOOKUP,
+	"Forget":      C.BRIDGE_OP_FORGET,
+	"GetAttr":     C.BRIDGE_OP_GETATTR,
+	"SetAttr":     C.BRIDGE_OP_SETATTR,
+	"ReadLink":    C.BRIDGE_OP_READLINK,
+	"Mknod":       C.BRIDGE_OP_MKNOD,
+	"Mkdir":       C.BRIDGE_OP_MKDIR,
+	"Unlink":      C.BRIDGE_OP_UNLINK,
+	"Rmdir":       C.BRIDGE_OP_RMDIR,
+	"Symlink":     C.BRIDGE_OP_SYMLINK,
+	"Rename":      C.BRIDGE_OP_RENAME,
+	"Link":        C.BRIDGE_OP_LINK,
+	"Open":        C.BRIDGE_OP_OPEN,
+	"Read":        C.BRIDGE_OP_READ,
+	"Write":       C.BRIDGE_OP_WRITE,
+	"Flush":       C.BRIDGE_OP_FLUSH,
+	"Release":     C.BRIDGE_OP_RELEASE,
+	"FSync":       C.BRIDGE_OP_FSYNC,
+	"OpenDir":     C.BRIDGE_OP_OPENDIR,
+	"ReadDir":     C.BRIDGE_OP_READDIR,
+	"ReleaseDir":  C.BRIDGE_OP_RELEASEDIR,
+	"FSyncDir":    C.BRIDGE_OP_FSYNCDIR,
+	"SetXAttr":    C.BRIDGE_OP_SETXATTR,
+	"GetXAttr":    C.BRIDGE_OP_GETXATTR,
+	"ListXAttr":   C.BRIDGE_OP_LISTXATTR,
+	"RemoveXAttr": C.BRIDGE_OP_REMOVEXATTR,
+	"Access":      C.BRIDGE_OP_ACCESS,
+	"Create":      C.BRIDGE_OP_CREATE,
+}
+
+// toCOps converts a set of operation names to bridge flags.
+func toCOps(ops map[string]bool) C.uint64_t {
+	var flags C.uint64_t
+	for name := range ops {
+		flags |= opFlags[name]
+	}
+	return flags
+}
+
+// capFlags maps capabilities to libfuse flags.  Flags which are not supported by the linked
+// libfuse version are zero.
+var capFlags = []struct {
+	cap  Capability
+	flag C.uint
+}{
+	{CAP_ASYNC_READ, C.FUSE_CAP_ASYNC_READ},
+	{CAP_ATOMIC_O_TRUNC, C.FUSE_CAP_ATOMIC_O_TRUNC},
+	{CAP_EXPORT_SUPPORT, C.FUSE_CAP_EXPORT_SUPPORT},
+	{CAP_SPLICE_WRITE, C.FUSE_CAP_SPLICE_WRITE},
+	{CAP_SPLICE_MOVE, C.FUSE_CAP_SPLICE_MOVE},
+	{CAP_SPLICE_READ, C.FUSE_CAP_SPLICE_READ},
+	{CAP_WRITEBACK_CACHE, C.FUSE_CAP_WRITEBACK_CACHE},
+	{CAP_PARALLEL_DIROPS, C.FUSE_CAP_PARALLEL_DIROPS},
+	{CAP_POSIX_ACL, C.FUSE_CAP_POSIX_ACL},
+	{CAP_HANDLE_KILLPRIV, C.FUSE_CAP_HANDLE_KILLPRIV},
+	{CAP_CACHE_SYMLINKS, C.FUSE_CAP_CACHE_SYMLINKS},
+	{CAP_NO_OPENDIR_SUPPORT, C.FUSE_CAP_NO_OPENDIR_SUPPORT},
+	{CAP_EXPLICIT_INVAL_DATA, C.FUSE_CAP_EXPLICIT_INVAL_DATA},
+	{CAP_DONT_MASK, C.FUSE_CAP_DONT_MASK},
+}
+
+// fromCCaps converts libfuse capability flags, ignoring flags without a Capability.
+func fromCCaps(flags C.uint) Capability {
+	var caps Capability
+	for _, f := range capFlags {
+		if f.flag != 0 && flags&f.flag != 0 {
+			caps |= f.cap
+		}
+	}
+	return caps
+}
+
+// toCCaps updates libfuse capability flags, leaving flags without a Capability unchanged.
+func toCCaps(flags C.uint, caps Capability) C.uint {
+	for _, f := range capFlags {
+		if caps&f.cap != 0 {
+			flags |= f.flag
+		} else {
+			flags &^= f.flag
+		}
+	}
+	return flags
+}
+
+// ll_Init initializes the filesystem, and returns a non-zero value if the session should end.
+//
 //export ll_Init
-func ll_Init(id C.int, cinfo *C.struct_fuse_conn_info) {
-	fs := getFS(int(id))
-	info := &ConnInfo{
-		ProtoMajor:   int(cinfo.proto_major),
-		ProtoMinor:   int(cinfo.proto_minor),
-		MaxWrite:     int(cinfo.max_write),
-		MaxReadahead: int(cinfo.max_readahead),
+func ll_Init(id C.int, cinfo *C.struct_fuse_conn_info) C.int {
+	req := &InitRequest{
+		Conn: ConnInfo{
+			ProtoMajor:          int(cinfo.proto_major),
+			ProtoMinor:          int(cinfo.proto_minor),
+			MaxWrite:            int(cinfo.max_write),
+			MaxReadahead:        int(cinfo.max_readahead),
+			Capable:             fromCCaps(cinfo.capable),
+			Want:                fromCCaps(cinfo.want),
+			MaxBackground:       int(cinfo.max_background),
+			CongestionThreshold: int(cinfo.congestion_threshold),
+			TimeGran:            int(C.get_time_gran(cinfo)),
+		},
+	}
+	resp := &InitResponse{Conn: req.Conn}
+	if err := getMount(int(id)).init(req, resp); err != OK {
+		return C.int(err)
 	}
-	fs.Init(info)
 
 	// Copy writable options back to cinfo
-	cinfo.max_write = C.uint(info.MaxWrite)
-	cinfo.max_readahead = C.uint(info.MaxReadahead)
+	cinfo.max_write = C.uint(resp.Conn.MaxWrite)
+	cinfo.max_readahead = C.uint(resp.Conn.MaxReadahead)
+	cinfo.want = toCCaps(cinfo.want, resp.Conn.Want&req.Conn.Capable)
+	cinfo.max_background = C.uint(resp.Conn.MaxBackground)
+	cinfo.congestion_threshold = C.uint(resp.Conn.CongestionThreshold)
+	C.set_time_gran(cinfo, C.uint(resp.Conn.TimeGran))
 
-	// TODO: async_read
 	// TODO: APPLE specific flag support.
+	return 0
 }
 
 //export ll_Destroy
 func ll_Destroy(id C.int) {
-	fs := getFS(int(id))
-	fs.Destroy()
+	getMount(int(id)).destroy()
 }
 
 //export ll_StatFS
-func ll_StatFS(id C.int, ino C.fuse_ino_t, stat *C.struct_statvfs) C.int {
-	fs := getFS(int(id))
-	s, err := fs.StatFS(int64(ino))
-	if err == OK {
-		s.toCStat(stat)
-	}
-	return C.int(err)
+func ll_StatFS(id C.int, req C.fuse_req_t, ino C.fuse_ino_t) {
+	in := &StatFSRequest{Ino: int64(ino)}
+	serve(id, req, "StatFS", ino, func(r *request) { handleStatFS(r, in) })
 }
 
 //export ll_SetXAttr
-func ll_SetXAttr(id C.int, ino C.fuse_ino_t, name *C.char, value unsafe.Pointer,
+func ll_SetXAttr(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, name *C.char, value unsafe.Pointer,
 	size C.size_t, flags C.int,
-) C.int {
-	fs := getFS(int(id))
-	data := zeroCopyBuf(value, int(size))
-	err := fs.SetXAttr(int64(ino), C.GoString(name), data, int(flags))
-	return C.int(err)
+) {
+	in := &SetXAttrRequest{
+		Ino:   int64(ino),
+		Name:  C.GoString(name),
+		Value: getMount(int(id)).requestCBuf(value, int(size)),
+		Flags: XAttrFlags(flags),
+	}
+	serve(id, req, "SetXAttr", ino, func(r *request) { handleSetXAttr(r, in) })
 }
 
+// ll_GetXAttr replies with an attribute value.
+//
+// A size of zero is a query for the size of the value.
+//
 //export ll_GetXAttr
-func ll_GetXAttr(id C.int, ino C.fuse_ino_t, name *C.char, buf unsafe.Pointer,
-	size *C.size_t,
-) C.int {
-	fs := getFS(int(id))
-	var err Status
-	var outSize int
-	if *size == 0 {
-		outSize, err = fs.GetXAttrSize(int64(ino), C.GoString(name))
-	} else {
-		out := zeroCopyBuf(buf, int(*size))
-		outSize, err = fs.GetXAttr(int64(ino), C.GoString(name), out)
-	}
-	if err == OK {
-		*size = C.size_t(outSize)
-	}
-	return C.int(err)
+func ll_GetXAttr(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, name *C.char, size C.size_t) {
+	in := &GetXAttrRequest{Ino: int64(ino), Name: C.GoString(name)}
+	serve(id, req, "GetXAttr", ino, func(r *request) { handleGetXAttr(r, in, int(size)) })
+}
+
+// ll_ListXAttr replies with the NUL terminated attribute names.
+//
+// Size is handled in the same way as ll_GetXAttr.
+//
+//export ll_ListXAttr
+func ll_ListXAttr(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, size C.size_t) {
+	in := &ListXAttrsRequest{Ino: int64(ino)}
+	serve(id, req, "ListXAttr", ino, func(r *request) { handleListXAttr(r, in, int(size)) })
 }
 
 //export ll_Lookup
-func ll_Lookup(id C.int, dir C.fuse_ino_t, name *C.char,
-	cent *C.struct_fuse_entry_param,
-) C.int {
-	fs := getFS(int(id))
-	ent, err := fs.Lookup(int64(dir), C.GoString(name))
-	if err == OK {
-		ent.toCEntry(cent)
-	}
-	return C.int(err)
+func ll_Lookup(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char) {
+	in := &LookupRequest{Parent: int64(dir), Name: C.GoString(name)}
+	serve(id, req, "Lookup", dir, func(r *request) { handleLookup(r, in) })
 }
 
 //export ll_Forget
-func ll_Forget(id C.int, ino C.fuse_ino_t, n C.int) {
-	fs := getFS(int(id))
-	fs.Forget(int64(ino), int(n))
+func ll_Forget(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, n C.int) {
+	in := &ForgetRequest{Ino: int64(ino), N: int(n)}
+	serve(id, req, "Forget", ino, func(r *request) { handleForget(r, in) })
 }
 
 //export ll_GetAttr
-func ll_GetAttr(id C.int, ino C.fuse_ino_t, fi *C.struct_fuse_file_info,
-	cattr *C.struct_stat, ctimeout *C.double,
-) C.int {
-	fs := getFS(int(id))
-	attr, err := fs.GetAttr(int64(ino), newFileInfo(fi))
-	if err == OK {
-		attr.toCStat(cattr, ctimeout)
-	}
-	return C.int(err)
+func ll_GetAttr(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) {
+	in := &GetAttrRequest{Ino: int64(ino), File: newFileInfo(fi)}
+	serve(id, req, "GetAttr", ino, func(r *request) { handleGetAttr(r, in) })
 }
 
 //export ll_SetAttr
-func ll_SetAttr(id C.int, ino C.fuse_ino_t, attr *C.struct_stat, toSet C.int,
-	fi *C.struct_fuse_file_info, cattr *C.struct_stat, ctimeout *C.double,
-) C.int {
-	fs := getFS(int(id))
-	var ia InoAttr
-	ia.fromCStat(attr)
-	oattr, err := fs.SetAttr(int64(ino), &ia, SetAttrMask(toSet), newFileInfo(fi))
-	if err == OK {
-		oattr.toCStat(cattr, ctimeout)
-	}
-	return C.int(err)
+func ll_SetAttr(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, attr *C.struct_stat, toSet C.int,
+	fi *C.struct_fuse_file_info,
+) {
+	var a InoAttr
+	a.fromCStat(attr)
+	in := newSetAttrRequest(int64(ino), SetAttrMask(toSet), &a, newFileInfo(fi))
+	serve(id, req, "SetAttr", ino, func(r *request) { handleSetAttr(r, in) })
 }
 
 //export ll_ReadDir
-func ll_ReadDir(id C.int, ino C.fuse_ino_t, size C.size_t, off C.off_t,
-	fi *C.struct_fuse_file_info, db *C.struct_DirBuf,
-) C.int {
-	fs := getFS(int(id))
-	writer := &dirBuf{db}
-	err := fs.ReadDir(int64(ino), newFileInfo(fi), int64(off), int(size), writer)
-	return C.int(err)
+func ll_ReadDir(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, size C.size_t, off C.off_t,
+	fi *C.struct_fuse_file_info,
+) {
+	in := &ReadDirRequest{
+		Ino:    int64(ino),
+		Offset: int64(off),
+		Size:   int(size),
+		File:   newFileInfo(fi),
+	}
+	serve(id, req, "ReadDir", ino, func(r *request) { handleReadDir(r, in) })
 }
 
 //export ll_Open
-func ll_Open(id C.int, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	info := newFileInfo(fi)
-	err := fs.Open(int64(ino), info)
-	if err == OK {
-		fi.fh = C.uint64_t(info.Handle)
-	}
-	return C.int(err)
+func ll_Open(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) {
+	in := &OpenRequest{Ino: int64(ino), Flags: int(fi.flags)}
+	serve(id, req, "Open", ino, func(r *request) { handleOpen(r, in) })
 }
 
 //export ll_OpenDir
-func ll_OpenDir(id C.int, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	info := newFileInfo(fi)
-	err := fs.OpenDir(int64(ino), info)
-	if err == OK {
-		fi.fh = C.uint64_t(info.Handle)
-	}
-	return C.int(err)
+func ll_OpenDir(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) {
+	in := &OpenRequest{Ino: int64(ino), Flags: int(fi.flags)}
+	serve(id, req, "OpenDir", ino, func(r *request) { handleOpenDir(r, in) })
 }
 
 //export ll_Release
-func ll_Release(id C.int, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	err := fs.Release(int64(ino), newFileInfo(fi))
-	return C.int(err)
+func ll_Release(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) {
+	in := &ReleaseRequest{Ino: int64(ino), File: newFileInfo(fi)}
+	serve(id, req, "Release", ino, func(r *request) { handleRelease(r, in) })
 }
 
 //export ll_ReleaseDir
-func ll_ReleaseDir(id C.int, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	err := fs.ReleaseDir(int64(ino), newFileInfo(fi))
-	return C.int(err)
+func ll_ReleaseDir(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) {
+	in := &ReleaseRequest{Ino: int64(ino), File: newFileInfo(fi)}
+	serve(id, req, "ReleaseDir", ino, func(r *request) { handleReleaseDir(r, in) })
 }
 
 //export ll_FSync
-func ll_FSync(id C.int, ino C.fuse_ino_t, datasync C.int, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	var dataOnly bool = datasync != 0
-	err := fs.FSync(int64(ino), dataOnly, newFileInfo(fi))
-	return C.int(err)
+func ll_FSync(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, datasync C.int,
+	fi *C.struct_fuse_file_info,
+) {
+	in := &FSyncRequest{
+		Ino:      int64(ino),
+		DataOnly: datasync != 0,
+		File:     newFileInfo(fi),
+	}
+	serve(id, req, "FSync", ino, func(r *request) { handleFSync(r, in) })
 }
 
 //export ll_FSyncDir
-func ll_FSyncDir(id C.int, ino C.fuse_ino_t, datasync C.int, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	var dataOnly bool = datasync != 0
-	err := fs.FSyncDir(int64(ino), dataOnly, newFileInfo(fi))
-	return C.int(err)
+func ll_FSyncDir(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, datasync C.int,
+	fi *C.struct_fuse_file_info,
+) {
+	in := &FSyncRequest{
+		Ino:      int64(ino),
+		DataOnly: datasync != 0,
+		File:     newFileInfo(fi),
+	}
+	serve(id, req, "FSyncDir", ino, func(r *request) { handleFSyncDir(r, in) })
 }
 
 //export ll_Flush
-func ll_Flush(id C.int, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) C.int {
-	fs := getFS(int(id))
-	err := fs.Flush(int64(ino), newFileInfo(fi))
-	return C.int(err)
+func ll_Flush(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, fi *C.struct_fuse_file_info) {
+	in := &FlushRequest{Ino: int64(ino), File: newFileInfo(fi)}
+	serve(id, req, "Flush", ino, func(r *request) { handleFlush(r, in) })
 }
 
 //export ll_Read
 func ll_Read(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, size C.size_t, off C.off_t,
 	fi *C.struct_fuse_file_info,
-) C.int {
-	fs := getFS(int(id))
-
-	// Create slice backed by C buffer.
-	buf, err := fs.Read(int64(ino), int64(size), int64(off), newFileInfo(fi))
-	if err != OK {
-		return C.int(err)
+) {
+	in := &ReadRequest{
+		Ino:    int64(ino),
+		Size:   int64(size),
+		Offset: int64(off),
+		File:   newFileInfo(fi),
 	}
-
-	ptr := unsafe.Pointer(&buf[0])
-	return C.reply_buf(req, (*C.char)(ptr), C.size_t(len(buf)))
+	serve(id, req, "Read", ino, func(r *request) { handleRead(r, in) })
 }
 
 //export ll_Write
-func ll_Write(id C.int, ino C.fuse_ino_t, buf unsafe.Pointer, n *C.size_t, off C.off_t,
-	fi *C.struct_fuse_file_info,
-) C.int {
-	fs := getFS(int(id))
-	in := zeroCopyBuf(buf, int(*n))
-	written, err := fs.Write(in, int64(ino), int64(off), newFileInfo(fi))
-	if err == OK {
-		*n = C.size_t(written)
+func ll_Write(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, buf unsafe.Pointer, size C.size_t,
+	off C.off_t, fi *C.struct_fuse_file_info,
+) {
+	in := &WriteRequest{
+		Ino:    int64(ino),
+		Data:   getMount(int(id)).requestCBuf(buf, int(size)),
+		Offset: int64(off),
+		File:   newFileInfo(fi),
 	}
-	return C.int(err)
+	serve(id, req, "Write", ino, func(r *request) { handleWrite(r, in) })
 }
 
 //export ll_Mknod
-func ll_Mknod(id C.int, dir C.fuse_ino_t, name *C.char, mode C.mode_t,
-	rdev C.dev_t, cent *C.struct_fuse_entry_param,
-) C.int {
-	fs := getFS(int(id))
-	ent, err := fs.Mknod(int64(dir), C.GoString(name), int(mode), int(rdev))
-	if err == OK {
-		ent.toCEntry(cent)
+func ll_Mknod(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char, mode C.mode_t,
+	rdev C.dev_t,
+) {
+	in := &MknodRequest{
+		Parent: int64(dir),
+		Name:   C.GoString(name),
+		Mode:   int(mode),
+		Rdev:   int(rdev),
 	}
-	return C.int(err)
-}
-
-//export ll_ListXAttr
-func ll_ListXAttr(id C.int, ino C.fuse_ino_t, buf unsafe.Pointer, size *C.size_t) C.int {
-	out := zeroCopyBuf(buf, int(*size))
-	fs := getFS(int(id))
-	keys, err := fs.ListXAttrs(int64(ino))
-	if err != OK {
-		return C.int(err)
-	}
-
-	var pos int
-	for _, k := range keys {
-		totalLen := pos + len(k) + 1
-		if totalLen < int(*size) {
-			copy(out[pos:totalLen], k)
-			out[totalLen] = 0
-			pos = totalLen
-		} else {
-			*size = C.size_t(pos)
-			return C.int(ERANGE)
-		}
-	}
-
-	*size = C.size_t(pos)
-	return C.int(OK)
+	serve(id, req, "Mknod", dir, func(r *request) { handleMknod(r, in) })
 }
 
 //export ll_RemoveXAttr
-func ll_RemoveXAttr(id C.int, ino C.fuse_ino_t, name *C.char) C.int {
-	fs := getFS(int(id))
-	err := fs.RemoveXAttr(int64(ino), C.GoString(name))
-	return C.int(err)
+func ll_RemoveXAttr(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, name *C.char) {
+	in := &RemoveXAttrRequest{Ino: int64(ino), Name: C.GoString(name)}
+	serve(id, req, "RemoveXAttr", ino, func(r *request) { handleRemoveXAttr(r, in) })
 }
 
 //export ll_Access
-func ll_Access(id C.int, ino C.fuse_ino_t, mask C.int) C.int {
-	fs := getFS(int(id))
-	return C.int(fs.Access(int64(ino), int(mask)))
+func ll_Access(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, mask C.int) {
+	in := &AccessRequest{Ino: int64(ino), Mask: int(mask)}
+	serve(id, req, "Access", ino, func(r *request) { handleAccess(r, in) })
 }
 
 //export ll_Create
-func ll_Create(id C.int, dir C.fuse_ino_t, name *C.char, mode C.mode_t,
-	fi *C.struct_fuse_file_info, cent *C.struct_fuse_entry_param,
-) C.int {
-	fs := getFS(int(id))
-	info := newFileInfo(fi)
-	ent, err := fs.Create(int64(dir), C.GoString(name), int(mode), info)
-	if err == OK {
-		ent.toCEntry(cent)
-		fi.fh = C.uint64_t(info.Handle)
+func ll_Create(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char, mode C.mode_t,
+	fi *C.struct_fuse_file_info,
+) {
+	in := &CreateRequest{
+		Parent: int64(dir),
+		Name:   C.GoString(name),
+		Mode:   int(mode),
+		Flags:  int(fi.flags),
 	}
-	return C.int(err)
+	serve(id, req, "Create", dir, func(r *request) { handleCreate(r, in) })
 }
 
 //export ll_Mkdir
-func ll_Mkdir(id C.int, dir C.fuse_ino_t, name *C.char, mode C.mode_t,
-	cent *C.struct_fuse_entry_param,
-) C.int {
-	fs := getFS(int(id))
-	ent, err := fs.Mkdir(int64(dir), C.GoString(name), int(mode))
-	if err == OK {
-		ent.toCEntry(cent)
+func ll_Mkdir(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char, mode C.mode_t) {
+	in := &MkdirRequest{
+		Parent: int64(dir),
+		Name:   C.GoString(name),
+		Mode:   int(mode),
 	}
-	return C.int(err)
+	serve(id, req, "Mkdir", dir, func(r *request) { handleMkdir(r, in) })
 }
 
 //export ll_Rmdir
-func ll_Rmdir(id C.int, dir C.fuse_ino_t, name *C.char) C.int {
-	fs := getFS(int(id))
-	err := fs.Rmdir(int64(dir), C.GoString(name))
-	return C.int(err)
+func ll_Rmdir(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char) {
+	in := &RmdirRequest{Parent: int64(dir), Name: C.GoString(name)}
+	serve(id, req, "Rmdir", dir, func(r *request) { handleRmdir(r, in) })
 }
 
 //export ll_Symlink
-func ll_Symlink(id C.int, link *C.char, parent C.fuse_ino_t, name *C.char,
-	cent *C.struct_fuse_entry_param,
-) C.int {
-	fs := getFS(int(id))
-	ent, err := fs.Symlink(C.GoString(link), int64(parent), C.GoString(name))
-	if err == OK {
-		ent.toCEntry(cent)
+func ll_Symlink(id C.int, req C.fuse_req_t, link *C.char, parent C.fuse_ino_t, name *C.char) {
+	in := &SymlinkRequest{
+		Link:   C.GoString(link),
+		Parent: int64(parent),
+		Name:   C.GoString(name),
 	}
-	return C.int(err)
+	serve(id, req, "Symlink", parent, func(r *request) { handleSymlink(r, in) })
 }
 
 //export ll_Link
-func ll_Link(id C.int, ino C.fuse_ino_t, newparent C.fuse_ino_t, name *C.char,
-	cent *C.struct_fuse_entry_param,
-) C.int {
-	fs := getFS(int(id))
-	ent, err := fs.Link(int64(ino), int64(newparent), C.GoString(name))
-	if err == OK {
-		ent.toCEntry(cent)
+func ll_Link(id C.int, req C.fuse_req_t, ino C.fuse_ino_t, newparent C.fuse_ino_t, name *C.char) {
+	in := &LinkRequest{
+		Ino:       int64(ino),
+		NewParent: int64(newparent),
+		NewName:   C.GoString(name),
 	}
-	return C.int(err)
+	serve(id, req, "Link", ino, func(r *request) { handleLink(r, in) })
 }
 
 //export ll_ReadLink
-func ll_ReadLink(id C.int, ino C.fuse_ino_t, err *C.int) *C.char {
-	fs := getFS(int(id))
-	s, e := fs.ReadLink(int64(ino))
-	*err = C.int(e)
-	if e == OK {
-		return C.CString(s)
-	}
-	return nil
+func ll_ReadLink(id C.int, req C.fuse_req_t, ino C.fuse_ino_t) {
+	in := &ReadLinkRequest{Ino: int64(ino)}
+	serve(id, req, "ReadLink", ino, func(r *request) { handleReadLink(r, in) })
 }
 
 //export ll_Unlink
-func ll_Unlink(id C.int, dir C.fuse_ino_t, name *C.char) C.int {
-	fs := getFS(int(id))
-	err := fs.Unlink(int64(dir), C.GoString(name))
-	return C.int(err)
+func ll_Unlink(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char) {
+	in := &UnlinkRequest{Parent: int64(dir), Name: C.GoString(name)}
+	serve(id, req, "Unlink", dir, func(r *request) { handleUnlink(r, in) })
 }
 
 //export ll_Rename
-func ll_Rename(id C.int, dir C.fuse_ino_t, name *C.char,
+func ll_Rename(id C.int, req C.fuse_req_t, dir C.fuse_ino_t, name *C.char,
 	newdir C.fuse_ino_t, newname *C.char, flags C.int,
-) C.int {
-	fs := getFS(int(id))
-	err := fs.Rename(int64(dir), C.GoString(name), int64(newdir), C.GoString(newname), int(flags))
-	return C.int(err)
-}
-
-type dirBuf struct {
-	db *C.struct_DirBuf
-}
-
-func (d *dirBuf) Add(name string, ino int64, mode int, next int64) bool {
-	cstr := C.CString(name)
-	res := C.DirBufAdd(d.db, cstr, C.fuse_ino_t(ino), C.int(mode), C.off_t(next))
-	C.free(unsafe.Pointer(cstr))
-	return res == 0
+) {
+	in := &RenameRequest{
+		Parent:    int64(dir),
+		Name:      C.GoString(name),
+		NewParent: int64(newdir),
+		NewName:   C.GoString(newname),
+		Flags:     int(flags),
+	}
+	serve(id, req, "Rename", dir, func(r *request) { handleRename(r, in) })
 }
 
 func newFileInfo(fi *C.struct_fuse_file_info) *FileInfo {
@@ -428,22 +485,53 @@ func newFileInfo(fi *C.struct_fuse_file_info) *FileInfo {
 	}
 
 	return &FileInfo{
-		Flags:     int(fi.flags),
-		Writepage: C.get_writepage(fi) != 0,
-		Handle:    uint64(fi.fh),
-		LockOwner: uint64(fi.lock_owner),
+		Flags:        int(fi.flags),
+		Writepage:    C.get_writepage(fi) != 0,
+		DirectIO:     C.get_direct_io(fi) != 0,
+		KeepCache:    C.get_keep_cache(fi) != 0,
+		Flush:        C.get_flush(fi) != 0,
+		NonSeekable:  C.get_nonseekable(fi) != 0,
+		FlockRelease: C.get_flock_release(fi) != 0,
+		CacheReaddir: C.get_cache_readdir(fi) != 0,
+		NoFlush:      C.get_noflush(fi) != 0,
+		Handle:       uint64(fi.fh),
+		LockOwner:    uint64(fi.lock_owner),
 	}
 }
 
+// toCFileInfo copies the handle and settings of an open file to fi.
+func (o *OpenResponse) toCFileInfo(fi *C.struct_fuse_file_info) {
+	fi.fh = C.uint64_t(o.Handle)
+	C.set_direct_io(fi, cBool(o.DirectIO))
+	C.set_keep_cache(fi, cBool(o.KeepCache))
+	C.set_nonseekable(fi, cBool(o.NonSeekable))
+	C.set_cache_readdir(fi, cBool(o.CacheReaddir))
+	C.set_noflush(fi, cBool(o.NoFlush))
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func (e *Entry) toCEntry(o *C.struct_fuse_entry_param) {
+	o.entry_timeout = C.double(e.entryTimeout())
+	if e.IsNegative() {
+		// Only the entry timeout is used for a negative entry.
+		return
+	}
+
 	o.ino = C.fuse_ino_t(e.Ino)
 	o.generation = C.ulong(e.Generation)
 	if o.generation == 0 {
 		o.generation = 1 // FUSE doesn't like a 0 generation value.
 	}
-	e.Attr.toCStat(&o.attr, nil)
-	o.attr_timeout = C.double(e.AttrTimeout)
-	o.entry_timeout = C.double(e.EntryTimeout)
+	if e.Attr != nil {
+		e.Attr.toCStat(&o.attr, nil)
+	}
+	o.attr_timeout = C.double(e.attrTimeout())
 }
 
 // Use C wrapper function to avoid issues with different typedef names on different systems.
@@ -1,3 +1,5 @@
+#ifndef _BRIDGE_H_
+#define _BRIDGE_H_
 
 #include "wrapper.h"
 
@@ -8,12 +10,22 @@ fuse_req_t new_fuse_test_req(int id, int userdata);
 void free_fuse_test_req(fuse_req_t req);
 int fuse_test_req_id(fuse_req_t req);
 
+// Userdata for a FUSE session.  The session is set once it has been created, so that the
+// session can be ended if the filesystem fails to initialize.
+struct bridge_userdata {
+  int id;
+  struct fuse_session *se;
+};
+
 // Bridge functions.  These are called by the FUSE lowlevel library.
 // The signatures are provided so that they can be called by unit tests, bypassing FUSE.
 void bridge_init(void *userdata, struct fuse_conn_info *conn);
 void bridge_destroy(void *userdata);
 void bridge_lookup(fuse_req_t req, fuse_ino_t parent, const char *name);
 void bridge_forget(fuse_req_t req, fuse_ino_t ino, unsigned long nlookup);
+#if FUSE_USE_VERSION >= 30
+void bridge_forget_multi(fuse_req_t req, size_t count, struct fuse_forget_data *forgets);
+#endif
 void bridge_getattr(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi);
 void bridge_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr, int to_set,
                     struct fuse_file_info *fi);
@@ -71,3 +83,5 @@ void bridge_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg, struct fus
 void bridge_flock(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi, int op);
 void bridge_fallocate(fuse_req_t req, fuse_ino_t ino, int mode, off_t offset, off_t length,
                       struct fuse_file_info *fi);
+
+#endif  // _BRIDGE_H_
@@ -1,3 +1,5 @@
+//go:build cgo && !nocgo
+
 package fuse
 
 // #cgo pkg-config: fuse-t
@@ -7,15 +9,21 @@ package fuse
 // #include <stdlib.h>  // for free()
 import "C"
 
-import "time"
+import (
+	"os"
+	"time"
+)
 
 func (s *StatVFS) toCStat(o *C.struct_statvfs) {
 	o.f_bsize = C.ulong(s.BlockSize)
+	o.f_frsize = C.ulong(s.fragmentSize())
 	o.f_blocks = C.fsblkcnt_t(s.Blocks)
 	o.f_bfree = C.fsblkcnt_t(s.BlocksFree)
+	o.f_bavail = C.fsblkcnt_t(s.BlocksAvail)
 
 	o.f_files = C.fsfilcnt_t(s.Files)
 	o.f_ffree = C.fsfilcnt_t(s.FilesFree)
+	o.f_favail = C.fsfilcnt_t(s.FilesAvail)
 
 	o.f_fsid = C.ulong(s.Fsid)
 	o.f_flag = C.ulong(s.Flags)
@@ -27,6 +35,9 @@ func (a *InoAttr) fromCStat(i *C.struct_stat) {
 	a.Mode = int(i.st_mode)
 	a.NLink = int(i.st_nlink)
 	a.Size = int64(i.st_size)
+	a.Rdev = int(i.st_rdev)
+	a.Blocks = int64(i.st_blocks)
+	a.BlkSize = int(i.st_blksize)
 	var uid int = int(i.st_uid)
 	var gid int = int(i.st_gid)
 	a.UID = &uid
@@ -34,6 +45,7 @@ func (a *InoAttr) fromCStat(i *C.struct_stat) {
 	a.ATime = time.Unix(int64(i.st_atimespec.tv_sec), int64(i.st_atimespec.tv_nsec))
 	a.CTime = time.Unix(int64(i.st_ctimespec.tv_sec), int64(i.st_ctimespec.tv_nsec))
 	a.MTime = time.Unix(int64(i.st_mtimespec.tv_sec), int64(i.st_mtimespec.tv_nsec))
+	a.BTime = time.Unix(int64(i.st_birthtimespec.tv_sec), int64(i.st_birthtimespec.tv_nsec))
 }
 
 func (a *InoAttr) toCStat(o *C.struct_stat, timeout *C.double) {
@@ -41,16 +53,26 @@ func (a *InoAttr) toCStat(o *C.struct_stat, timeout *C.double) {
 	o.st_mode = C.mode_t(a.Mode)
 	o.st_nlink = C.nlink_t(a.NLink)
 	o.st_size = C.off_t(a.Size)
+	o.st_rdev = C.dev_t(a.Rdev)
+	o.st_blocks = C.blkcnt_t(a.Blocks)
+	o.st_blksize = C.blksize_t(a.BlkSize)
 	if a.UID != nil {
 		o.st_uid = C.uid_t(*a.UID)
+	} else {
+		o.st_uid = C.uid_t(os.Getuid())
 	}
 	if a.GID != nil {
 		o.st_gid = C.gid_t(*a.GID)
+	} else {
+		o.st_gid = C.gid_t(os.Getgid())
 	}
 	toCTime(&o.st_ctimespec, a.CTime)
 	toCTime(&o.st_mtimespec, a.MTime)
 	toCTime(&o.st_atimespec, a.ATime)
+	if !a.BTime.IsZero() {
+		toCTime(&o.st_birthtimespec, a.BTime)
+	}
 	if timeout != nil {
-		(*timeout) = C.double(a.Timeout)
+		(*timeout) = C.double(a.timeout())
 	}
 }
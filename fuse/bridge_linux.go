@@ -1,3 +1,5 @@
+//go:build cgo && !nocgo
+
 package fuse
 
 // #cgo pkg-config: fuse3
@@ -6,15 +8,33 @@ package fuse
 // #include <stdlib.h>  // for free()
 import "C"
 
-import "time"
+import (
+	"os"
+	"time"
+	"unsafe"
+)
+
+//export ll_ForgetMulti
+func ll_ForgetMulti(id C.int, req C.fuse_req_t, count C.size_t,
+	forgets *C.struct_fuse_forget_data,
+) {
+	in := make([]*ForgetRequest, 0, count)
+	for _, f := range unsafe.Slice(forgets, count) {
+		in = append(in, &ForgetRequest{Ino: int64(f.ino), N: int(f.nlookup)})
+	}
+	serve(id, req, "Forget", 0, func(r *request) { handleForgetMulti(r, in) })
+}
 
 func (s *StatVFS) toCStat(o *C.struct_statvfs) {
 	o.f_bsize = C.ulong(s.BlockSize)
+	o.f_frsize = C.ulong(s.fragmentSize())
 	o.f_blocks = C.__fsblkcnt64_t(s.Blocks)
 	o.f_bfree = C.__fsblkcnt64_t(s.BlocksFree)
+	o.f_bavail = C.__fsblkcnt64_t(s.BlocksAvail)
 
 	o.f_files = C.__fsfilcnt64_t(s.Files)
 	o.f_ffree = C.__fsfilcnt64_t(s.FilesFree)
+	o.f_favail = C.__fsfilcnt64_t(s.FilesAvail)
 
 	o.f_fsid = C.ulong(s.Fsid)
 	o.f_flag = C.ulong(s.Flags)
@@ -26,6 +46,9 @@ func (a *InoAttr) fromCStat(i *C.struct_stat) {
 	a.Mode = int(i.st_mode)
 	a.NLink = int(i.st_nlink)
 	a.Size = int64(i.st_size)
+	a.Rdev = int(i.st_rdev)
+	a.Blocks = int64(i.st_blocks)
+	a.BlkSize = int(i.st_blksize)
 	var uid int = int(i.st_uid)
 	var gid int = int(i.st_gid)
 	a.UID = &uid
@@ -40,17 +63,24 @@ func (a *InoAttr) toCStat(o *C.struct_stat, timeout *C.double) {
 	o.st_mode = C.__mode_t(a.Mode)
 	o.st_nlink = C.__nlink_t(a.NLink)
 	o.st_size = C.__off_t(a.Size)
+	o.st_rdev = C.__dev_t(a.Rdev)
+	o.st_blocks = C.__blkcnt64_t(a.Blocks)
+	o.st_blksize = C.__blksize_t(a.BlkSize)
 	if a.UID != nil {
 		o.st_uid = C.__uid_t(*a.UID)
+	} else {
+		o.st_uid = C.__uid_t(os.Getuid())
 	}
 	if a.GID != nil {
 		o.st_gid = C.__gid_t(*a.GID)
+	} else {
+		o.st_gid = C.__gid_t(os.Getgid())
 	}
 
 	toCTime(&o.st_ctim, a.CTime)
 	toCTime(&o.st_mtim, a.MTime)
 	toCTime(&o.st_atim, a.ATime)
 	if timeout != nil {
-		(*timeout) = C.double(a.Timeout)
+		(*timeout) = C.double(a.timeout())
 	}
 }
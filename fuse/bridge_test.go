@@ -1,8 +1,13 @@
+//go:build cgo && !nocgo
+
 package fuse
 
 import (
+	"context"
 	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -122,3 +127,406 @@ func TestStatFs(t *testing.T) {
 		})
 	})
 }
+
+// slowFS blocks reads until the request is interrupted.
+type slowFS struct {
+	DefaultFileSystem
+	started chan struct{}
+	ctx     context.Context
+}
+
+func (s *slowFS) WithContext(ctx context.Context) FileSystem {
+	return &slowFS{started: s.started, ctx: ctx}
+}
+
+func (s *slowFS) Read(ino int64, size int64, off int64, fi *FileInfo) ([]byte, Status) {
+	close(s.started)
+	<-s.ctx.Done()
+	return nil, EINTR
+}
+
+func TestInterrupt(t *testing.T) {
+	slow := &slowFS{started: make(chan struct{})}
+	slowID := RegisterFS(slow)
+	defer DeregisterFS(slowID)
+
+	go func() {
+		<-slow.started
+		interruptActive()
+	}()
+
+	bridgeRead(slowID, 2, 10, 0, func(id int, r interface{}) int {
+		switch r := r.(type) {
+		case *replyErr:
+			require.Equal(t, EINTR, r.err)
+
+		default:
+			t.Errorf("Unexpected reply: %#v", r)
+		}
+		return int(OK)
+	})
+}
+
+// blockingFS blocks reads until release is closed.
+type blockingFS struct {
+	DefaultFileSystemV2
+	release chan struct{}
+}
+
+func (b *blockingFS) Read(ctx context.Context, req *ReadRequest, resp *ReadResponse) Status {
+	<-b.release
+	resp.Data = []byte("data")
+	return OK
+}
+
+func TestAsync(t *testing.T) {
+	b := &blockingFS{release: make(chan struct{})}
+	asyncID := RegisterFSV2(b, &Options{Async: true})
+	defer DeregisterFS(asyncID)
+
+	// Replies are sent from other goroutines, so collect them for checking here.
+	const n = 4
+	replies := make(chan interface{}, n)
+	var waits []func()
+	for i := 0; i < n; i++ {
+		// Each read would block forever if it was handled synchronously.
+		waits = append(waits, bridgeStartRead(asyncID, 2, 10, 0, func(id int, r interface{}) int {
+			if rb, ok := r.(*replyBuf); ok {
+				r = string(rb.buf)
+			}
+			replies <- r
+			return int(OK)
+		}))
+	}
+
+	close(b.release)
+	for _, wait := range waits {
+		wait()
+	}
+	close(replies)
+	for r := range replies {
+		require.Equal(t, "data", r)
+	}
+}
+
+// xattrFS is a FileSystemV2 with a fixed set of extended attributes.
+type xattrFS struct {
+	DefaultFileSystemV2
+	attrs map[string]string
+}
+
+func (x *xattrFS) GetXAttr(ctx context.Context, req *GetXAttrRequest,
+	resp *GetXAttrResponse,
+) Status {
+	v, ok := x.attrs[req.Name]
+	if !ok {
+		return ENODATA
+	}
+	resp.Value = []byte(v)
+	return OK
+}
+
+func (x *xattrFS) ListXAttrs(ctx context.Context, req *ListXAttrsRequest,
+	resp *ListXAttrsResponse,
+) Status {
+	resp.Names = []string{"a", "bc"}
+	return OK
+}
+
+func TestXAttrV2(t *testing.T) {
+	xid := RegisterFSV2(&xattrFS{attrs: map[string]string{"a": "value"}}, nil)
+	defer DeregisterFS(xid)
+
+	expectErr := func(expected Status) replyHandler {
+		return func(id int, r interface{}) int {
+			require.IsType(t, &replyErr{}, r)
+			require.Equal(t, expected, r.(*replyErr).err)
+			return int(OK)
+		}
+	}
+
+	t.Run("GetXAttr size query", func(t *testing.T) {
+		bridgeGetXAttr(xid, 1, "a", 0, func(id int, r interface{}) int {
+			require.IsType(t, &replyXattr{}, r)
+			require.EqualValues(t, 5, r.(*replyXattr).count)
+			return int(OK)
+		})
+	})
+
+	t.Run("GetXAttr value", func(t *testing.T) {
+		bridgeGetXAttr(xid, 1, "a", 5, func(id int, r interface{}) int {
+			require.IsType(t, &replyBuf{}, r)
+			require.Equal(t, "value", string(r.(*replyBuf).buf))
+			return int(OK)
+		})
+	})
+
+	t.Run("GetXAttr small buffer", func(t *testing.T) {
+		bridgeGetXAttr(xid, 1, "a", 4, expectErr(ERANGE))
+	})
+
+	t.Run("GetXAttr missing", func(t *testing.T) {
+		bridgeGetXAttr(xid, 1, "b", 0, expectErr(ENODATA))
+	})
+
+	t.Run("ListXAttr size query", func(t *testing.T) {
+		bridgeListXAttr(xid, 1, 0, func(id int, r interface{}) int {
+			require.IsType(t, &replyXattr{}, r)
+			require.EqualValues(t, 5, r.(*replyXattr).count)
+			return int(OK)
+		})
+	})
+
+	t.Run("ListXAttr exact fit", func(t *testing.T) {
+		bridgeListXAttr(xid, 1, 5, func(id int, r interface{}) int {
+			require.IsType(t, &replyBuf{}, r)
+			require.Equal(t, "a\x00bc\x00", string(r.(*replyBuf).buf))
+			return int(OK)
+		})
+	})
+
+	t.Run("ListXAttr small buffer", func(t *testing.T) {
+		bridgeListXAttr(xid, 1, 4, expectErr(ERANGE))
+	})
+}
+
+// sizedXAttrFS returns extended attributes through a buffer sized with GetXAttrSize.  The value
+// grows by a byte after each of the next grows size queries.
+type sizedXAttrFS struct {
+	DefaultFileSystem
+	value string
+	grows int
+}
+
+func (x *sizedXAttrFS) GetXAttrSize(ino int64, name string) (int, Status) {
+	size := len(x.value)
+	if x.grows > 0 {
+		x.grows--
+		x.value += "e"
+	}
+	return size, OK
+}
+
+func (x *sizedXAttrFS) GetXAttr(ino int64, name string, out []byte) (int, Status) {
+	if len(out) < len(x.value) {
+		return 0, ERANGE
+	}
+	return copy(out, x.value), OK
+}
+
+func TestSizedXAttr(t *testing.T) {
+	xfs := &sizedXAttrFS{value: "valu", grows: 1}
+	xid := RegisterFS(xfs)
+	defer DeregisterFS(xid)
+
+	bridgeGetXAttr(xid, 1, "a", 5, func(id int, r interface{}) int {
+		require.IsType(t, &replyBuf{}, r)
+		require.Equal(t, "value", string(r.(*replyBuf).buf))
+		return int(OK)
+	})
+	bridgeGetXAttr(xid, 1, "a", 4, func(id int, r interface{}) int {
+		require.Equal(t, &replyErr{ERANGE}, r)
+		return int(OK)
+	})
+
+	// A value which keeps growing is not retried forever.
+	xfs.grows = maxXAttrRetries + 1
+	bridgeGetXAttr(xid, 1, "a", 0, func(id int, r interface{}) int {
+		require.Equal(t, &replyErr{EIO}, r)
+		return int(OK)
+	})
+}
+
+// nilEntryFS returns a nil entry without an error, which is a filesystem bug.
+type nilEntryFS struct {
+	DefaultFileSystem
+}
+
+func (n *nilEntryFS) Lookup(dir int64, name string) (*Entry, Status) {
+	return nil, OK
+}
+
+func TestPanicRecovery(t *testing.T) {
+	type panicInfo struct {
+		op  string
+		ino int64
+	}
+	panics := make(chan panicInfo, 1)
+	opts := &Options{PanicHandler: func(op string, ino int64, v any) {
+		panics <- panicInfo{op, ino}
+	}}
+	pid := RegisterFSV2(AdaptFileSystem(&nilEntryFS{}), opts)
+	defer DeregisterFS(pid)
+
+	bridgeLookup(pid, 1, "file", func(id int, r interface{}) int {
+		require.Equal(t, &replyErr{EIO}, r)
+		return int(OK)
+	})
+	require.Equal(t, panicInfo{"Lookup", 1}, <-panics)
+}
+
+// refFS records the references which are dropped by the bridge.
+type refFS struct {
+	DefaultFileSystemV2
+	forgets  []int64
+	released []uint64
+}
+
+func (f *refFS) Create(ctx context.Context, req *CreateRequest, resp *CreateResponse) Status {
+	resp.Entry = Entry{Ino: 5, Generation: 1, Attr: &InoAttr{Ino: 5, Mode: S_IFREG | 0644}}
+	resp.Handle = 7
+	return OK
+}
+
+func (f *refFS) Forget(ctx context.Context, req *ForgetRequest) {
+	f.forgets = append(f.forgets, req.Ino)
+}
+
+func (f *refFS) Release(ctx context.Context, req *ReleaseRequest) Status {
+	f.released = append(f.released, req.File.Handle)
+	return OK
+}
+
+func TestReplyFailure(t *testing.T) {
+	var failures []Status
+	opts := &Options{ReplyErrorHandler: func(op string, ino int64, err Status) {
+		require.Equal(t, "Create", op)
+		require.EqualValues(t, 1, ino)
+		failures = append(failures, err)
+	}}
+	fs := &refFS{}
+	rid := RegisterFSV2(fs, opts)
+	defer DeregisterFS(rid)
+
+	// The reply is discarded, as if the request had been interrupted.
+	bridgeCreate(rid, 1, "file", 0644, func(id int, r interface{}) int {
+		require.IsType(t, &replyCreate{}, r)
+		return -int(ENOENT)
+	})
+	require.Equal(t, []Status{ENOENT}, failures)
+	require.Equal(t, []int64{5}, fs.forgets)
+	require.Equal(t, []uint64{7}, fs.released)
+}
+
+// negativeFS caches lookups of missing names.
+type negativeFS struct {
+	DefaultFileSystem
+}
+
+func (n *negativeFS) Lookup(dir int64, name string) (*Entry, Status) {
+	return NegativeEntry(5), OK
+}
+
+func TestNegativeEntry(t *testing.T) {
+	nid := RegisterFS(&negativeFS{})
+	defer DeregisterFS(nid)
+
+	bridgeLookup(nid, 1, "missing", func(id int, r interface{}) int {
+		require.IsType(t, &replyEntry{}, r)
+		e := r.(*replyEntry).e
+		require.Zero(t, e.ino)
+		require.Zero(t, e.generation)
+		require.EqualValues(t, 5, e.entry_timeout)
+		return int(OK)
+	})
+}
+
+// statFS reports every field of the attributes and filesystem statistics.
+type statFS struct {
+	DefaultFileSystem
+}
+
+func (s *statFS) GetAttr(ino int64, fi *FileInfo) (*InoAttr, Status) {
+	return &InoAttr{
+		Ino:     ino,
+		Mode:    syscall.S_IFCHR | 0600,
+		NLink:   1,
+		Rdev:    0x0103,
+		Blocks:  8,
+		BlkSize: 4096,
+		Timeout: 1,
+		TTL:     1500 * time.Millisecond,
+	}, OK
+}
+
+func (s *statFS) StatFS(ino int64) (*StatVFS, Status) {
+	return &StatVFS{
+		BlockSize:   4096,
+		Blocks:      100,
+		BlocksFree:  50,
+		BlocksAvail: 40,
+		Files:       10,
+		FilesFree:   5,
+		FilesAvail:  4,
+		NameMax:     255,
+	}, OK
+}
+
+func TestStatFields(t *testing.T) {
+	sid := RegisterFS(&statFS{})
+	defer DeregisterFS(sid)
+
+	bridgeGetAttr(sid, 2, func(id int, r interface{}) int {
+		require.IsType(t, &replyAttr{}, r)
+		a := r.(*replyAttr)
+		require.EqualValues(t, 1.5, a.timeout)
+		require.EqualValues(t, 0x0103, a.attr.st_rdev)
+		require.EqualValues(t, 8, a.attr.st_blocks)
+		require.EqualValues(t, 4096, a.attr.st_blksize)
+		return int(OK)
+	})
+
+	bridgeStatFs(sid, 1, func(id int, r interface{}) int {
+		require.IsType(t, &replyStatFs{}, r)
+		s := r.(*replyStatFs).stbuf
+		require.EqualValues(t, 50, s.f_bfree)
+		require.EqualValues(t, 40, s.f_bavail)
+		require.EqualValues(t, 4, s.f_favail)
+		require.EqualValues(t, 4096, s.f_frsize)
+		return int(OK)
+	})
+}
+
+// lookupFS only implements Lookup.
+type lookupFS struct{}
+
+func (l *lookupFS) Lookup(ctx context.Context, req *LookupRequest, resp *EntryResponse) Status {
+	return ENOENT
+}
+
+func TestPartialFileSystem(t *testing.T) {
+	lid := RegisterFSV2(&lookupFS{}, nil)
+	defer DeregisterFS(lid)
+
+	ops := bridgeOps(lid)
+	require.NotNil(t, ops.init)
+	require.NotNil(t, ops.destroy)
+	require.NotNil(t, ops.lookup)
+	require.Nil(t, ops.getattr)
+	require.Nil(t, ops.open)
+	require.Nil(t, ops.create)
+
+	full := bridgeOps(fsID)
+	require.NotNil(t, full.getattr)
+	require.NotNil(t, full.create)
+
+	// Operations which are not implemented are answered in the same way as libfuse.
+	bridgeGetAttr(lid, 1, func(id int, r interface{}) int {
+		require.Equal(t, &replyErr{ENOSYS}, r)
+		return int(OK)
+	})
+	bridgeOpen(lid, 1, 0, func(id int, r interface{}) int {
+		require.IsType(t, &replyOpen{}, r)
+		require.Zero(t, r.(*replyOpen).fi.fh)
+		return int(OK)
+	})
+	bridgeStatFs(lid, 1, func(id int, r interface{}) int {
+		require.IsType(t, &replyStatFs{}, r)
+		require.EqualValues(t, 512, r.(*replyStatFs).stbuf.f_bsize)
+		return int(OK)
+	})
+	bridgeForget(lid, 1, 1, func(id int, r interface{}) int {
+		require.IsType(t, &replyNone{}, r)
+		return int(OK)
+	})
+}
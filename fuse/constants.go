@@ -15,27 +15,105 @@ const (
 )
 
 // Status is the errno number that a FUSE call returns to the kernel.
+//
+// Status implements error, and unwraps to the corresponding syscall.Errno, so errors.Is can be
+// used to compare it with syscall errors and with the errors defined by io/fs.
 type Status int32
 
+// OK is returned on success.
+const OK = Status(0)
+
+// Errors which are available on all supported systems.  Numbers are the Linux values.
 const (
-	OK        = Status(0)                 // OK is returned on success.
-	EACCES    = Status(syscall.EACCES)    // 13 - permission denied
-	EBUSY     = Status(syscall.EBUSY)     // 16 - resource busy
-	EEXIST    = Status(syscall.EEXIST)    // 17 - node exists
-	EINVAL    = Status(syscall.EINVAL)    // 22 - invalid argument
-	EIO       = Status(syscall.EIO)       // 5 - input / output error
-	ENOENT    = Status(syscall.ENOENT)    // 2 - no such entry
-	ENOSYS    = Status(syscall.ENOSYS)    // 78 - operation not implemented
-	ENODATA   = Status(syscall.ENODATA)   // 96 - no data available
-	ENOTDIR   = Status(syscall.ENOTDIR)   // 20 - not a directory
-	ENOTEMPTY = Status(syscall.ENOTEMPTY) // 39 - directory not empty
-	EPERM     = Status(syscall.EPERM)     // 1 - operation not permitted
-	ERANGE    = Status(syscall.ERANGE)    // 34 - result not representable
-	EXDEV     = Status(syscall.EXDEV)     // 18 - cross-device link
-	EBADF     = Status(syscall.EBADF)     // 9 - bad file number
-	ENODEV    = Status(syscall.ENODEV)    // 19 - no such device
-	EROFS     = Status(syscall.EROFS)     // 30 - read-only file system
-	EISDIR    = Status(syscall.EISDIR)    // 21 - is a directory
+	E2BIG           = Status(syscall.E2BIG)           // 7 - argument list too long
+	EACCES          = Status(syscall.EACCES)          // 13 - permission denied
+	EADDRINUSE      = Status(syscall.EADDRINUSE)      // 98 - address already in use
+	EADDRNOTAVAIL   = Status(syscall.EADDRNOTAVAIL)   // 99 - cannot assign requested address
+	EAFNOSUPPORT    = Status(syscall.EAFNOSUPPORT)    // 97 - address family not supported by protocol
+	EAGAIN          = Status(syscall.EAGAIN)          // 11 - resource temporarily unavailable
+	EALREADY        = Status(syscall.EALREADY)        // 114 - operation already in progress
+	EBADF           = Status(syscall.EBADF)           // 9 - bad file descriptor
+	EBADMSG         = Status(syscall.EBADMSG)         // 74 - bad message
+	EBUSY           = Status(syscall.EBUSY)           // 16 - device or resource busy
+	ECANCELED       = Status(syscall.ECANCELED)       // 125 - operation canceled
+	ECHILD          = Status(syscall.ECHILD)          // 10 - no child processes
+	ECONNABORTED    = Status(syscall.ECONNABORTED)    // 103 - software caused connection abort
+	ECONNREFUSED    = Status(syscall.ECONNREFUSED)    // 111 - connection refused
+	ECONNRESET      = Status(syscall.ECONNRESET)      // 104 - connection reset by peer
+	EDEADLK         = Status(syscall.EDEADLK)         // 35 - resource deadlock avoided
+	EDESTADDRREQ    = Status(syscall.EDESTADDRREQ)    // 89 - destination address required
+	EDOM            = Status(syscall.EDOM)            // 33 - numerical argument out of domain
+	EDQUOT          = Status(syscall.EDQUOT)          // 122 - disk quota exceeded
+	EEXIST          = Status(syscall.EEXIST)          // 17 - file exists
+	EFAULT          = Status(syscall.EFAULT)          // 14 - bad address
+	EFBIG           = Status(syscall.EFBIG)           // 27 - file too large
+	EHOSTDOWN       = Status(syscall.EHOSTDOWN)       // 112 - host is down
+	EHOSTUNREACH    = Status(syscall.EHOSTUNREACH)    // 113 - no route to host
+	EIDRM           = Status(syscall.EIDRM)           // 43 - identifier removed
+	EILSEQ          = Status(syscall.EILSEQ)          // 84 - illegal byte sequence
+	EINPROGRESS     = Status(syscall.EINPROGRESS)     // 115 - operation now in progress
+	EINTR           = Status(syscall.EINTR)           // 4 - interrupted system call
+	EINVAL          = Status(syscall.EINVAL)          // 22 - invalid argument
+	EIO             = Status(syscall.EIO)             // 5 - input/output error
+	EISCONN         = Status(syscall.EISCONN)         // 106 - transport endpoint is already connected
+	EISDIR          = Status(syscall.EISDIR)          // 21 - is a directory
+	ELOOP           = Status(syscall.ELOOP)           // 40 - too many levels of symbolic links
+	EMFILE          = Status(syscall.EMFILE)          // 24 - too many open files
+	EMLINK          = Status(syscall.EMLINK)          // 31 - too many links
+	EMSGSIZE        = Status(syscall.EMSGSIZE)        // 90 - message too long
+	EMULTIHOP       = Status(syscall.EMULTIHOP)       // 72 - multihop attempted
+	ENAMETOOLONG    = Status(syscall.ENAMETOOLONG)    // 36 - file name too long
+	ENETDOWN        = Status(syscall.ENETDOWN)        // 100 - network is down
+	ENETRESET       = Status(syscall.ENETRESET)       // 102 - network dropped connection on reset
+	ENETUNREACH     = Status(syscall.ENETUNREACH)     // 101 - network is unreachable
+	ENFILE          = Status(syscall.ENFILE)          // 23 - too many open files in system
+	ENOBUFS         = Status(syscall.ENOBUFS)         // 105 - no buffer space available
+	ENODATA         = Status(syscall.ENODATA)         // 61 - no data available
+	ENODEV          = Status(syscall.ENODEV)          // 19 - no such device
+	ENOENT          = Status(syscall.ENOENT)          // 2 - no such file or directory
+	ENOEXEC         = Status(syscall.ENOEXEC)         // 8 - exec format error
+	ENOLCK          = Status(syscall.ENOLCK)          // 37 - no locks available
+	ENOLINK         = Status(syscall.ENOLINK)         // 67 - link has been severed
+	ENOMEM          = Status(syscall.ENOMEM)          // 12 - cannot allocate memory
+	ENOMSG          = Status(syscall.ENOMSG)          // 42 - no message of desired type
+	ENOPROTOOPT     = Status(syscall.ENOPROTOOPT)     // 92 - protocol not available
+	ENOSPC          = Status(syscall.ENOSPC)          // 28 - no space left on device
+	ENOSR           = Status(syscall.ENOSR)           // 63 - out of streams resources
+	ENOSTR          = Status(syscall.ENOSTR)          // 60 - device not a stream
+	ENOSYS          = Status(syscall.ENOSYS)          // 38 - function not implemented
+	ENOTBLK         = Status(syscall.ENOTBLK)         // 15 - block device required
+	ENOTCONN        = Status(syscall.ENOTCONN)        // 107 - transport endpoint is not connected
+	ENOTDIR         = Status(syscall.ENOTDIR)         // 20 - not a directory
+	ENOTEMPTY       = Status(syscall.ENOTEMPTY)       // 39 - directory not empty
+	ENOTRECOVERABLE = Status(syscall.ENOTRECOVERABLE) // 131 - state not recoverable
+	ENOTSOCK        = Status(syscall.ENOTSOCK)        // 88 - socket operation on non-socket
+	ENOTSUP         = Status(syscall.ENOTSUP)         // 95 - operation not supported
+	ENOTTY          = Status(syscall.ENOTTY)          // 25 - inappropriate ioctl for device
+	ENXIO           = Status(syscall.ENXIO)           // 6 - no such device or address
+	EOPNOTSUPP      = Status(syscall.EOPNOTSUPP)      // 95 - operation not supported
+	EOVERFLOW       = Status(syscall.EOVERFLOW)       // 75 - value too large for defined data type
+	EOWNERDEAD      = Status(syscall.EOWNERDEAD)      // 130 - owner died
+	EPERM           = Status(syscall.EPERM)           // 1 - operation not permitted
+	EPFNOSUPPORT    = Status(syscall.EPFNOSUPPORT)    // 96 - protocol family not supported
+	EPIPE           = Status(syscall.EPIPE)           // 32 - broken pipe
+	EPROTO          = Status(syscall.EPROTO)          // 71 - protocol error
+	EPROTONOSUPPORT = Status(syscall.EPROTONOSUPPORT) // 93 - protocol not supported
+	EPROTOTYPE      = Status(syscall.EPROTOTYPE)      // 91 - protocol wrong type for socket
+	ERANGE          = Status(syscall.ERANGE)          // 34 - numerical result out of range
+	EREMOTE         = Status(syscall.EREMOTE)         // 66 - object is remote
+	EROFS           = Status(syscall.EROFS)           // 30 - read-only file system
+	ESHUTDOWN       = Status(syscall.ESHUTDOWN)       // 108 - cannot send after shutdown
+	ESOCKTNOSUPPORT = Status(syscall.ESOCKTNOSUPPORT) // 94 - socket type not supported
+	ESPIPE          = Status(syscall.ESPIPE)          // 29 - illegal seek
+	ESRCH           = Status(syscall.ESRCH)           // 3 - no such process
+	ESTALE          = Status(syscall.ESTALE)          // 116 - stale file handle
+	ETIME           = Status(syscall.ETIME)           // 62 - timer expired
+	ETIMEDOUT       = Status(syscall.ETIMEDOUT)       // 110 - connection timed out
+	ETOOMANYREFS    = Status(syscall.ETOOMANYREFS)    // 109 - too many references: cannot splice
+	ETXTBSY         = Status(syscall.ETXTBSY)         // 26 - text file busy
+	EUSERS          = Status(syscall.EUSERS)          // 87 - too many users
+	EWOULDBLOCK     = Status(syscall.EWOULDBLOCK)     // 11 - resource temporarily unavailable
+	EXDEV           = Status(syscall.EXDEV)           // 18 - invalid cross-device link
 )
 
 // AccessMode holds flags indicating read or write requirements for Open calls.
@@ -55,17 +133,55 @@ const (
 	ST_NOSUID = FsFlags(2) // Ignore suid and sgid bits
 )
 
-// SetAttrMask holds flags indicating which metadata to set in a SetAttr call.
+// XAttrFlags holds the flags passed to SetXAttr.
+type XAttrFlags int32
+
+const (
+	XATTR_CREATE  = XAttrFlags(1) // Fail with EEXIST if the attribute exists.
+	XATTR_REPLACE = XAttrFlags(2) // Fail with ENODATA if the attribute does not exist.
+)
+
+// Limits on extended attributes, which match Linux.
+const (
+	XATTR_NAME_MAX = 255       // Maximum length of a name.
+	XATTR_SIZE_MAX = 64 * 1024 // Maximum size of a value.
+	XATTR_LIST_MAX = 64 * 1024 // Maximum size of the list of names.
+)
+
+// SetAttrMask holds the libfuse flags indicating which metadata to set in a SetAttr call.  The
+// bridge decodes the flags into the optional fields of a SetAttrRequest.
 type SetAttrMask int32
 
 const (
-	SET_ATTR_MODE = SetAttrMask(1 << iota)
-	SET_ATTR_UID
-	SET_ATTR_GID
-	SET_ATTR_SIZE
-	SET_ATTR_ATIME
-	SET_ATTR_MTIME
-	SET_ATTR_UNUSED_ // placeholder for 1 << 6
-	SET_ATTR_ATIME_NOW
-	SET_ATTR_MTIME_NOW
+	SET_ATTR_MODE      = SetAttrMask(1 << 0)
+	SET_ATTR_UID       = SetAttrMask(1 << 1)
+	SET_ATTR_GID       = SetAttrMask(1 << 2)
+	SET_ATTR_SIZE      = SetAttrMask(1 << 3)
+	SET_ATTR_ATIME     = SetAttrMask(1 << 4)
+	SET_ATTR_MTIME     = SetAttrMask(1 << 5)
+	SET_ATTR_ATIME_NOW = SetAttrMask(1 << 7)
+	SET_ATTR_MTIME_NOW = SetAttrMask(1 << 8)
+	SET_ATTR_CTIME     = SetAttrMask(1 << 10)
+	SET_ATTR_KILL_SUID = SetAttrMask(1 << 11)
+	SET_ATTR_KILL_SGID = SetAttrMask(1 << 12)
+)
+
+// Capability holds flags for optional features of the FUSE connection.
+type Capability uint32
+
+const (
+	CAP_ASYNC_READ          = Capability(1 << iota) // Reads may be sent in parallel.
+	CAP_ATOMIC_O_TRUNC                              // O_TRUNC is handled by Open.
+	CAP_EXPORT_SUPPORT                              // Lookups of "." and ".." are supported.
+	CAP_SPLICE_WRITE                                // Replies may be spliced to the kernel.
+	CAP_SPLICE_MOVE                                 // Spliced pages may be moved.
+	CAP_SPLICE_READ                                 // Write requests may be spliced.
+	CAP_WRITEBACK_CACHE                             // Writes are cached by the kernel.
+	CAP_PARALLEL_DIROPS                             // Lookups and readdirs may run in parallel.
+	CAP_POSIX_ACL                                   // POSIX ACLs are enforced by the kernel.
+	CAP_HANDLE_KILLPRIV                             // The filesystem clears setuid and setgid bits.
+	CAP_CACHE_SYMLINKS                              // Symlink targets are cached by the kernel.
+	CAP_NO_OPENDIR_SUPPORT                          // ENOSYS from OpenDir is not an error.
+	CAP_EXPLICIT_INVAL_DATA                         // The page cache is only invalidated on request.
+	CAP_DONT_MASK                                   // The umask is applied by the filesystem.
 )
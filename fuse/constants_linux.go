@@ -0,0 +1,51 @@
+package fuse
+
+import "syscall"
+
+// Linux specific errors.
+const (
+	EADV         = Status(syscall.EADV)         // 68 - advertise error
+	EBADE        = Status(syscall.EBADE)        // 52 - invalid exchange
+	EBADFD       = Status(syscall.EBADFD)       // 77 - file descriptor in bad state
+	EBADR        = Status(syscall.EBADR)        // 53 - invalid request descriptor
+	EBADRQC      = Status(syscall.EBADRQC)      // 56 - invalid request code
+	EBADSLT      = Status(syscall.EBADSLT)      // 57 - invalid slot
+	EBFONT       = Status(syscall.EBFONT)       // 59 - bad font file format
+	ECHRNG       = Status(syscall.ECHRNG)       // 44 - channel number out of range
+	ECOMM        = Status(syscall.ECOMM)        // 70 - communication error on send
+	EDEADLOCK    = Status(syscall.EDEADLOCK)    // 35 - resource deadlock avoided
+	EDOTDOT      = Status(syscall.EDOTDOT)      // 73 - RFS specific error
+	EISNAM       = Status(syscall.EISNAM)       // 120 - is a named type file
+	EKEYEXPIRED  = Status(syscall.EKEYEXPIRED)  // 127 - key has expired
+	EKEYREJECTED = Status(syscall.EKEYREJECTED) // 129 - key was rejected by service
+	EKEYREVOKED  = Status(syscall.EKEYREVOKED)  // 128 - key has been revoked
+	EL2HLT       = Status(syscall.EL2HLT)       // 51 - level 2 halted
+	EL2NSYNC     = Status(syscall.EL2NSYNC)     // 45 - level 2 not synchronized
+	EL3HLT       = Status(syscall.EL3HLT)       // 46 - level 3 halted
+	EL3RST       = Status(syscall.EL3RST)       // 47 - level 3 reset
+	ELIBACC      = Status(syscall.ELIBACC)      // 79 - can not access a needed shared library
+	ELIBBAD      = Status(syscall.ELIBBAD)      // 80 - accessing a corrupted shared library
+	ELIBEXEC     = Status(syscall.ELIBEXEC)     // 83 - cannot exec a shared library directly
+	ELIBMAX      = Status(syscall.ELIBMAX)      // 82 - attempting to link in too many shared libraries
+	ELIBSCN      = Status(syscall.ELIBSCN)      // 81 - .lib section in a.out corrupted
+	ELNRNG       = Status(syscall.ELNRNG)       // 48 - link number out of range
+	EMEDIUMTYPE  = Status(syscall.EMEDIUMTYPE)  // 124 - wrong medium type
+	ENAVAIL      = Status(syscall.ENAVAIL)      // 119 - no XENIX semaphores available
+	ENOANO       = Status(syscall.ENOANO)       // 55 - no anode
+	ENOCSI       = Status(syscall.ENOCSI)       // 50 - no CSI structure available
+	ENOKEY       = Status(syscall.ENOKEY)       // 126 - required key not available
+	ENOMEDIUM    = Status(syscall.ENOMEDIUM)    // 123 - no medium found
+	ENONET       = Status(syscall.ENONET)       // 64 - machine is not on the network
+	ENOPKG       = Status(syscall.ENOPKG)       // 65 - package not installed
+	ENOTNAM      = Status(syscall.ENOTNAM)      // 118 - not a XENIX named type file
+	ENOTUNIQ     = Status(syscall.ENOTUNIQ)     // 76 - name not unique on network
+	EREMCHG      = Status(syscall.EREMCHG)      // 78 - remote address changed
+	EREMOTEIO    = Status(syscall.EREMOTEIO)    // 121 - remote I/O error
+	ERESTART     = Status(syscall.ERESTART)     // 85 - interrupted system call should be restarted
+	ERFKILL      = Status(syscall.ERFKILL)      // 132 - operation not possible due to RF-kill
+	ESRMNT       = Status(syscall.ESRMNT)       // 69 - srmount error
+	ESTRPIPE     = Status(syscall.ESTRPIPE)     // 86 - streams pipe error
+	EUCLEAN      = Status(syscall.EUCLEAN)      // 117 - structure needs cleaning
+	EUNATCH      = Status(syscall.EUNATCH)      // 49 - protocol driver not attached
+	EXFULL       = Status(syscall.EXFULL)       // 54 - exchange full
+)
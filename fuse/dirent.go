@@ -0,0 +1,48 @@
+package fuse
+
+import "iter"
+
+// DirEntry is an entry in a directory listing.  See WriteDir.
+type DirEntry struct {
+	Name string
+	Ino  int64
+	Mode int // Only the file type bits are used.
+
+	// Offset is a cookie which identifies the position following this entry.  The kernel passes
+	// it back to resume the listing after this entry.  If zero, the offset following the previous
+	// entry is used, so entries must be listed in the same order each time.
+	//
+	// Offsets must increase through the listing, and be greater than 2, which are used for "."
+	// and "..".  Stable offsets, such as inode numbers, allow a listing to resume correctly after
+	// entries are added or removed.
+	Offset int64
+}
+
+// WriteDir writes a directory listing to w, as a ReadDir implementation.  The listing starts with
+// "." and "..", followed by entries.  Entries up to off are skipped, and the listing stops once w
+// is full, so that the kernel resumes it with the next ReadDir call.
+//
+// ino is the directory being listed, and parent is its parent directory.  Use ino as the parent
+// of the root directory.
+func WriteDir(w DirEntryWriter, off int64, ino, parent int64, entries iter.Seq[DirEntry]) {
+	if off < 1 && !w.Add(".", ino, S_IFDIR, 1) {
+		return
+	}
+	if off < 2 && !w.Add("..", parent, S_IFDIR, 2) {
+		return
+	}
+
+	next := int64(2)
+	for e := range entries {
+		next++
+		if e.Offset != 0 {
+			next = e.Offset
+		}
+		if next <= off {
+			continue
+		}
+		if !w.Add(e.Name, e.Ino, e.Mode, next) {
+			return
+		}
+	}
+}
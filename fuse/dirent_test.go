@@ -0,0 +1,61 @@
+package fuse
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// listWriter records directory entries, up to a fixed number.
+type listWriter struct {
+	space   int
+	names   []string
+	offsets []int64
+}
+
+func (w *listWriter) Add(name string, ino int64, mode int, next int64) bool {
+	if len(w.names) == w.space {
+		return false
+	}
+	w.names = append(w.names, name)
+	w.offsets = append(w.offsets, next)
+	return true
+}
+
+func TestWriteDir(t *testing.T) {
+	entries := []DirEntry{
+		{Name: "a", Ino: 10},
+		{Name: "b", Ino: 11},
+		{Name: "c", Ino: 12, Offset: 20},
+		{Name: "d", Ino: 13},
+	}
+
+	// Read the listing two entries at a time, resuming from the last offset.
+	var names []string
+	var off int64
+	for {
+		w := &listWriter{space: 2}
+		WriteDir(w, off, 1, 1, slices.Values(entries))
+		if len(w.names) == 0 {
+			break
+		}
+		names = append(names, w.names...)
+		off = w.offsets[len(w.offsets)-1]
+	}
+	require.Equal(t, []string{".", "..", "a", "b", "c", "d"}, names)
+
+	// Offsets follow the previous entry when not given.
+	w := &listWriter{space: 10}
+	WriteDir(w, 0, 1, 1, slices.Values(entries))
+	require.Equal(t, []int64{1, 2, 3, 4, 20, 21}, w.offsets)
+
+	// Stable offsets resume after a removed entry.
+	stable := []DirEntry{
+		{Name: "a", Ino: 10, Offset: 12},
+		{Name: "d", Ino: 13, Offset: 15},
+	}
+	w = &listWriter{space: 10}
+	WriteDir(w, 14, 1, 1, slices.Values(stable))
+	require.Equal(t, []string{"d"}, w.names)
+}
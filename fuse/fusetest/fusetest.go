@@ -0,0 +1,177 @@
+// Package fusetest mounts filesystems for tests which use the os package against a real mount.
+package fusetest
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vgough/go-fuse-c/fuse"
+)
+
+const (
+	// mountTimeout is how long Mount waits for the filesystem to appear.
+	mountTimeout = 10 * time.Second
+	// unmountTimeout is how long cleanup waits for the session to end after unmounting.
+	unmountTimeout = 10 * time.Second
+)
+
+// Mount mounts fs on a new directory from t.TempDir and returns the directory once the mount is
+// ready.  The filesystem is served until the test finishes, when it is unmounted.  If the
+// filesystem is busy, or the test failed, a lazy unmount is used instead.  If opts is nil, the
+// default options are used.  fs is any filesystem accepted by fuse.MountAndRunV2.
+//
+// Options.PollWorkaround is always set, as the filesystem is used by the process which serves it,
+// so the filesystem must not use the name and inode reserved by it.
+//
+// The test is skipped if FUSE is not available, which is when /dev/fuse cannot be opened or the
+// fusermount3 helper is not installed.
+func Mount(t testing.TB, fs any, opts *fuse.Options) string {
+	t.Helper()
+	helper := requireFUSE(t)
+
+	var o fuse.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.PollWorkaround = true
+
+	dir := t.TempDir()
+	done := make(chan error, 1)
+	go func() {
+		// -f keeps libfuse from daemonizing, which the pure Go transport never does.
+		done <- fuse.MountAndServe([]string{"fusetest", "-f", dir}, fs, &o)
+	}()
+
+	deadline := time.Now().Add(mountTimeout)
+	for !mounted(dir) {
+		select {
+		case err := <-done:
+			t.Fatalf("mount %s exited: %v", dir, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			unmount(helper, dir, true)
+			t.Fatalf("mount %s not ready after %v", dir, mountTimeout)
+		}
+	}
+
+	t.Cleanup(func() {
+		if err := unmount(helper, dir, t.Failed()); err != nil {
+			t.Errorf("unmount %s: %v", dir, err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("mount %s: %v", dir, err)
+			}
+		case <-time.After(unmountTimeout):
+			t.Errorf("mount %s still running %v after unmount", dir, unmountTimeout)
+		}
+	})
+	return dir
+}
+
+// requireFUSE skips the test if FUSE is not available, and otherwise returns the path of the
+// fusermount3 helper.
+func requireFUSE(t testing.TB) string {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skipf("fusetest is not supported on %s", runtime.GOOS)
+	}
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	f.Close()
+	helper, err := exec.LookPath("fusermount3")
+	if err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	return helper
+}
+
+// unmount unmounts dir with fusermount3.  If lazy is set, or the filesystem is busy, the mount is
+// detached and is removed once it is no longer in use.
+func unmount(helper, dir string, lazy bool) error {
+	if !lazy {
+		if err := exec.Command(helper, "-u", "-q", "--", dir).Run(); err == nil {
+			return nil
+		}
+	}
+	if !mounted(dir) {
+		return nil
+	}
+	out, err := exec.Command(helper, "-u", "-z", "--", dir).CombinedOutput()
+	if err != nil {
+		return &unmountError{err: err, output: strings.TrimSpace(string(out))}
+	}
+	return nil
+}
+
+// unmountError reports a failed fusermount3 call along with its output.
+type unmountError struct {
+	err    error
+	output string
+}
+
+func (e *unmountError) Error() string {
+	if e.output == "" {
+		return e.err.Error()
+	}
+	return e.err.Error() + ": " + e.output
+}
+
+func (e *unmountError) Unwrap() error {
+	return e.err
+}
+
+// mounted reports whether dir is a FUSE mount point, according to /proc/self/mountinfo.
+func mounted(dir string) bool {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// Each line is "id parent major:minor root mountpoint options ... - fstype source super".
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != dir {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				return strings.HasPrefix(fields[i+1], "fuse")
+			}
+		}
+	}
+	return false
+}
+
+// unescapeMountinfo decodes the octal escapes used for spaces and other special characters in
+// /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
@@ -0,0 +1,40 @@
+package fusetest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vgough/go-fuse-c/fuse"
+)
+
+func TestMountMemFS(t *testing.T) {
+	dir := Mount(t, fuse.AdaptFileSystem(fuse.NewMemFS()), nil)
+
+	path := filepath.Join(dir, "hello.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello, world\n"), 0644))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "hello, world\n", string(data))
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"hello.txt", "sub"}, names)
+
+	require.NoError(t, os.Remove(path))
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	require.Equal(t, "/tmp/a b", unescapeMountinfo(`/tmp/a\040b`))
+	require.Equal(t, `/tmp/a\b`, unescapeMountinfo(`/tmp/a\134b`))
+	require.Equal(t, "/tmp/plain", unescapeMountinfo("/tmp/plain"))
+	require.Equal(t, `/tmp/x\04`, unescapeMountinfo(`/tmp/x\04`))
+}
@@ -0,0 +1,133 @@
+package fuse
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"sync"
+)
+
+// HandleTable maps file handles to Go values, for use as FileInfo.Handle and
+// OpenResponse.Handle.  The zero value is an empty table, and is safe for concurrent use.
+//
+// Handles start at one and are never reused, so a stale handle cannot refer to a newer file.
+// When built with the fusedebug tag, using a handle after it was released panics, rather than
+// returning false.
+//
+// Release is not called for files which are still open when the filesystem is unmounted.  All can
+// be used from Destroy to clean up their values.
+type HandleTable[T any] struct {
+	mu      sync.Mutex
+	entries map[uint64]T
+	next    uint64
+	stats   HandleStats
+}
+
+// HandleStats counts handles in a HandleTable.
+type HandleStats struct {
+	Open      int    // Handles currently allocated.
+	MaxOpen   int    // Largest number of handles allocated at once.
+	Allocated uint64 // Handles allocated in total.
+	Released  uint64 // Handles released in total.
+}
+
+// Allocate returns a new handle for v.
+func (t *HandleTable[T]) Allocate(v T) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.entries == nil {
+		t.entries = make(map[uint64]T)
+	}
+	t.next++
+	t.entries[t.next] = v
+
+	t.stats.Allocated++
+	t.stats.Open = len(t.entries)
+	t.stats.MaxOpen = max(t.stats.MaxOpen, t.stats.Open)
+	return t.next
+}
+
+// Get returns the value for a handle.  Returns false if the handle is not allocated.
+func (t *HandleTable[T]) Get(h uint64) (T, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, ok := t.entries[h]
+	if !ok {
+		t.checkReleased(h)
+	}
+	return v, ok
+}
+
+// Release frees a handle and returns its value.  Returns false if the handle is not allocated.
+func (t *HandleTable[T]) Release(h uint64) (T, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, ok := t.entries[h]
+	if !ok {
+		t.checkReleased(h)
+		return v, false
+	}
+	delete(t.entries, h)
+
+	t.stats.Released++
+	t.stats.Open = len(t.entries)
+	return v, true
+}
+
+// checkReleased panics in debug builds if h was allocated and has since been released.
+func (t *HandleTable[T]) checkReleased(h uint64) {
+	if debugHandles && h != 0 && h <= t.next {
+		panic(fmt.Sprintf("fuse: handle %d used after release", h))
+	}
+}
+
+// All returns the allocated handles and their values.  The table is copied, so it may be modified
+// during iteration.
+func (t *HandleTable[T]) All() iter.Seq2[uint64, T] {
+	t.mu.Lock()
+	entries := maps.Clone(t.entries)
+	t.mu.Unlock()
+	return maps.All(entries)
+}
+
+// Stats returns the handle counts.
+func (t *HandleTable[T]) Stats() HandleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// Open allocates a handle for v, and sets it in the response to Open, OpenDir or Create.
+func (t *HandleTable[T]) Open(resp *OpenResponse, v T) {
+	resp.Handle = t.Allocate(v)
+}
+
+// File returns the value for an open file.  Returns EBADF if the handle is not allocated.
+func (t *HandleTable[T]) File(fi *FileInfo) (T, Status) {
+	if fi == nil {
+		var zero T
+		return zero, EBADF
+	}
+	v, ok := t.Get(fi.Handle)
+	if !ok {
+		return v, EBADF
+	}
+	return v, OK
+}
+
+// Close releases the handle for a file, from Release or ReleaseDir, and returns its value.
+// Returns EBADF if the handle is not allocated.
+func (t *HandleTable[T]) Close(fi *FileInfo) (T, Status) {
+	if fi == nil {
+		var zero T
+		return zero, EBADF
+	}
+	v, ok := t.Release(fi.Handle)
+	if !ok {
+		return v, EBADF
+	}
+	return v, OK
+}
@@ -0,0 +1,6 @@
+//go:build !fusedebug
+
+package fuse
+
+// debugHandles enables use after release checks in HandleTable.
+const debugHandles = false
@@ -0,0 +1,67 @@
+package fuse
+
+import (
+	"maps"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleTable(t *testing.T) {
+	var table HandleTable[string]
+
+	var resp OpenResponse
+	table.Open(&resp, "a")
+	require.NotZero(t, resp.Handle)
+	b := table.Allocate("b")
+	require.NotEqual(t, resp.Handle, b)
+
+	fi := &FileInfo{Handle: resp.Handle}
+	v, err := table.File(fi)
+	require.Equal(t, OK, err)
+	require.Equal(t, "a", v)
+	require.Equal(t, map[uint64]string{resp.Handle: "a", b: "b"}, maps.Collect(table.All()))
+
+	v, err = table.Close(fi)
+	require.Equal(t, OK, err)
+	require.Equal(t, "a", v)
+	require.Equal(t, HandleStats{Open: 1, MaxOpen: 2, Allocated: 2, Released: 1}, table.Stats())
+
+	// Handles are not reused.
+	require.NotEqual(t, resp.Handle, table.Allocate("c"))
+
+	_, err = table.File(&FileInfo{Handle: 100})
+	require.Equal(t, EBADF, err)
+	_, err = table.File(nil)
+	require.Equal(t, EBADF, err)
+
+	if debugHandles {
+		require.Panics(t, func() { table.Get(resp.Handle) })
+	} else {
+		_, err = table.Close(fi)
+		require.Equal(t, EBADF, err)
+	}
+}
+
+func TestHandleTableConcurrent(t *testing.T) {
+	var table HandleTable[int]
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				h := table.Allocate(i*100 + j)
+				v, ok := table.Get(h)
+				require.True(t, ok)
+				require.Equal(t, i*100+j, v)
+				_, ok = table.Release(h)
+				require.True(t, ok)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, HandleStats{MaxOpen: table.Stats().MaxOpen, Allocated: 800, Released: 800},
+		table.Stats())
+}
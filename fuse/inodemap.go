@@ -0,0 +1,285 @@
+package fuse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inodeMapHeader starts an inode map file, and is followed by the generation number.
+const inodeMapHeader = "fuse-inodes 1"
+
+// InodeMap assigns stable inode numbers to filesystem objects, which are identified by a key
+// such as a backend object ID.  The map is stored in a file, so the same object has the same
+// inode number and generation after the filesystem is mounted again.  This allows tools which
+// cache inode numbers, such as rsync and git, to recognize unchanged files.
+//
+// Inode numbers start at 2, as 1 is the root directory, and are never reused.  A single
+// generation number is used for every inode, and is kept in the file.  InodeMap is safe for
+// concurrent use.
+//
+// New numbers are appended to the file and written to disk before they are returned, so that a
+// number is not given to a different key, under the same generation, after a crash.  Removals are
+// written to disk by Sync and Close, or along with the next new number.  The file is compacted
+// when it is opened.  If writing to the file fails, it is closed, and every later method which
+// writes to it returns the error, as it is unknown which records reached the disk.
+type InodeMap struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	err  error // set once the file is closed
+	inos map[string]int64
+	keys map[int64]string
+	next int64
+	gen  uint64
+}
+
+// OpenInodeMap opens the inode map stored at path, creating it if it does not exist.
+func OpenInodeMap(path string) (*InodeMap, error) {
+	m := &InodeMap{
+		inos: make(map[string]int64),
+		keys: make(map[int64]string),
+		next: 2,
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		err = m.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		m.gen = uint64(time.Now().UnixMicro())
+	default:
+		return nil, err
+	}
+
+	if err := m.compact(path); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load reads the map from a file.  An incomplete record at the end, from a write which was
+// interrupted, is ignored.
+func (m *InodeMap) load(f io.Reader) error {
+	r := bufio.NewReader(f)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, inodeMapHeader+" ") {
+		return errors.New("not an inode map")
+	}
+	m.gen, err = strconv.ParseUint(strings.TrimSpace(line[len(inodeMapHeader)+1:]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid generation: %w", err)
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.parse(strings.TrimSuffix(line, "\n")); err != nil {
+			return err
+		}
+	}
+}
+
+// parse applies a record, which either assigns a number to a key ("+ ino key"), or removes a
+// number ("- ino").  Keys are quoted.
+func (m *InodeMap) parse(line string) error {
+	op, rest, _ := strings.Cut(line, " ")
+	num, key, _ := strings.Cut(rest, " ")
+	ino, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || ino < 2 {
+		return fmt.Errorf("invalid record %q", line)
+	}
+	m.next = max(m.next, ino+1)
+
+	switch op {
+	case "+":
+		if key, err = strconv.Unquote(key); err != nil {
+			return fmt.Errorf("invalid record %q", line)
+		}
+		m.inos[key] = ino
+		m.keys[ino] = key
+	case "-":
+		if key, ok := m.keys[ino]; ok {
+			delete(m.inos, key)
+			delete(m.keys, ino)
+		}
+	default:
+		return fmt.Errorf("invalid record %q", line)
+	}
+	return nil
+}
+
+// compact replaces the file at path with the current map, and opens it for appending.  Removed
+// numbers are dropped, apart from the highest, so that it is not reused.
+func (m *InodeMap) compact(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "%s %d\n", inodeMapHeader, m.gen)
+	for key, ino := range m.inos {
+		fmt.Fprintf(w, "+ %d %s\n", ino, strconv.Quote(key))
+	}
+	if _, used := m.keys[m.next-1]; !used && m.next > 2 {
+		fmt.Fprintf(w, "- %d\n", m.next-1)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	m.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	m.w = bufio.NewWriter(m.file)
+	return nil
+}
+
+// syncDir writes a directory to disk, so that a rename within it is not lost after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// fail closes the file after a write to it failed, and returns err.  Must be called with the lock
+// held.
+func (m *InodeMap) fail(err error) error {
+	m.file.Close()
+	m.file, m.w, m.err = nil, nil, err
+	return err
+}
+
+// Ino returns the inode number for a key, assigning a new number if the key is not in the map.
+// A new number is written to disk before it is returned.
+func (m *InodeMap) Ino(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ino, ok := m.inos[key]; ok {
+		return ino, nil
+	}
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	// The number is used up once the record may have reached the file, even if writing fails.
+	ino := m.next
+	m.next++
+	if _, err := fmt.Fprintf(m.w, "+ %d %s\n", ino, strconv.Quote(key)); err != nil {
+		return 0, m.fail(err)
+	}
+	if err := m.w.Flush(); err != nil {
+		return 0, m.fail(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return 0, m.fail(err)
+	}
+	m.inos[key] = ino
+	m.keys[ino] = key
+	return ino, nil
+}
+
+// Key returns the key which an inode number was assigned to.
+func (m *InodeMap) Key(ino int64) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[ino]
+	return key, ok
+}
+
+// Remove removes a key from the map, such as when the object is deleted.  Its number is not
+// reused.
+func (m *InodeMap) Remove(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ino, ok := m.inos[key]
+	if !ok {
+		return nil
+	}
+	if m.err != nil {
+		return m.err
+	}
+	if _, err := fmt.Fprintf(m.w, "- %d\n", ino); err != nil {
+		return m.fail(err)
+	}
+	delete(m.inos, key)
+	delete(m.keys, ino)
+	return nil
+}
+
+// Generation returns the generation number for every inode in the map.
+func (m *InodeMap) Generation() uint64 {
+	return m.gen
+}
+
+// Sync writes removed numbers to disk.
+func (m *InodeMap) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	if err := m.w.Flush(); err != nil {
+		return m.fail(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return m.fail(err)
+	}
+	return nil
+}
+
+// Close writes removed numbers to disk, and closes the file.
+func (m *InodeMap) Close() error {
+	err := m.Sync()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return err
+	}
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	m.file, m.w, m.err = nil, nil, os.ErrClosed
+	return err
+}
@@ -0,0 +1,123 @@
+package fuse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInodeMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+
+	m, err := OpenInodeMap(path)
+	require.NoError(t, err)
+	a, err := m.Ino("object/a")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, a)
+	b, err := m.Ino("object\nb")
+	require.NoError(t, err)
+	c, err := m.Ino("object/c")
+	require.NoError(t, err)
+	again, err := m.Ino("object/a")
+	require.NoError(t, err)
+	require.Equal(t, a, again)
+	require.NoError(t, m.Remove("object/c"))
+	gen := m.Generation()
+	require.NotZero(t, gen)
+	require.NoError(t, m.Close())
+
+	// Numbers and the generation are kept after reopening, and removed numbers are not reused.
+	m, err = OpenInodeMap(path)
+	require.NoError(t, err)
+	require.Equal(t, gen, m.Generation())
+	key, ok := m.Key(b)
+	require.True(t, ok)
+	require.Equal(t, "object\nb", key)
+	_, ok = m.Key(c)
+	require.False(t, ok)
+	again, err = m.Ino("object/a")
+	require.NoError(t, err)
+	require.Equal(t, a, again)
+	d, err := m.Ino("object/d")
+	require.NoError(t, err)
+	require.Greater(t, d, c)
+	require.NoError(t, m.Close())
+
+	_, err = m.Ino("object/e")
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	// An incomplete record is ignored.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("+ 99 \"obj")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	m, err = OpenInodeMap(path)
+	require.NoError(t, err)
+	again, err = m.Ino("object/d")
+	require.NoError(t, err)
+	require.Equal(t, d, again)
+	require.NoError(t, m.Close())
+
+	require.NoError(t, os.WriteFile(path, []byte("something else\n"), 0o600))
+	_, err = OpenInodeMap(path)
+	require.Error(t, err)
+}
+
+func TestInodeMapCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+
+	m, err := OpenInodeMap(path)
+	require.NoError(t, err)
+	defer m.Close()
+	a, err := m.Ino("object/a")
+	require.NoError(t, err)
+
+	// The map is opened again without Sync or Close, as if the process had crashed.
+	reopened, err := OpenInodeMap(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, m.Generation(), reopened.Generation())
+	key, ok := reopened.Key(a)
+	require.True(t, ok)
+	require.Equal(t, "object/a", key)
+	b, err := reopened.Ino("object/b")
+	require.NoError(t, err)
+	require.Greater(t, b, a)
+}
+
+func TestInodeMapWriteError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inodes")
+
+	m, err := OpenInodeMap(path)
+	require.NoError(t, err)
+	a, err := m.Ino("object/a")
+	require.NoError(t, err)
+
+	// Writes fail once the file is closed underneath the map.
+	require.NoError(t, m.file.Close())
+	_, err = m.Ino("object/b")
+	require.ErrorIs(t, err, os.ErrClosed)
+	require.Equal(t, a+2, m.next)
+
+	// The map stays failed, rather than writing later records after a lost one.
+	_, err = m.Ino("object/c")
+	require.ErrorIs(t, err, os.ErrClosed)
+	require.Error(t, m.Remove("object/a"))
+	require.Error(t, m.Sync())
+	require.Error(t, m.Close())
+	ino, err := m.Ino("object/a")
+	require.NoError(t, err)
+	require.Equal(t, a, ino)
+
+	reopened, err := OpenInodeMap(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	_, ok := reopened.Key(a + 1)
+	require.False(t, ok)
+	b, err := reopened.Ino("object/b")
+	require.NoError(t, err)
+	require.Greater(t, b, a)
+}
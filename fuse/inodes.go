@@ -0,0 +1,206 @@
+package fuse
+
+import (
+	"iter"
+	"sync"
+	"time"
+)
+
+// LookupCounter counts the references which the kernel holds to each inode.  Each entry reply
+// from Lookup, Create, Mknod, Mkdir, Symlink or Link adds a reference, and Forget drops them.
+type LookupCounter interface {
+	// AddLookup adds a reference to an inode.
+	AddLookup(ino int64)
+
+	// ForgetLookups drops n references to an inode.
+	ForgetLookups(ino int64, n int)
+}
+
+// LookupTracker is implemented by filesystems whose lookup counts are kept by the library, such
+// as with an InodeTable.  Entry replies and Forget requests update the counter, before the
+// filesystem's Forget method is called if it has one.
+type LookupTracker interface {
+	// LookupTable returns the counter, or nil if lookups are counted by the filesystem.
+	LookupTable() LookupCounter
+}
+
+// InodeTable holds the inodes of a filesystem, and counts the references which the kernel holds
+// to them.  It is safe for concurrent use, and implements LookupCounter, so a filesystem which
+// implements LookupTracker with it has its lookup counts kept automatically.
+//
+// Inode numbers start after the root inode, and are never reused, so a single generation value is
+// used for every inode.  An inode which is removed from the filesystem, such as by Unlink, is
+// released, and stays in the table until the kernel forgets it.
+type InodeTable[T any] struct {
+	mu     sync.Mutex
+	nodes  map[int64]*inodeEntry[T]
+	next   int64
+	gen    uint64
+	forget func(ino int64, v T)
+}
+
+type inodeEntry[T any] struct {
+	value    T
+	lookups  int64
+	released bool
+
+	// forgets counts the times lookups dropped to zero, so that only the last of them is passed
+	// to the forget callback.
+	forgets uint64
+
+	// mu is held while the forget callback runs, and by AddLookup, so that the kernel cannot
+	// gain a reference to the inode during the callback.
+	mu sync.Mutex
+}
+
+// NewInodeTable returns a table holding root as inode 1.
+//
+// forget is called when the kernel drops its last reference to an inode, without the table lock
+// held.  If the inode was released, it has been removed from the table.  AddLookup for the inode
+// waits until forget returns, so it must not be called by forget.  Optional.
+func NewInodeTable[T any](root T, forget func(ino int64, v T)) *InodeTable[T] {
+	return &InodeTable[T]{
+		nodes:  map[int64]*inodeEntry[T]{1: {value: root}},
+		next:   2,
+		gen:    uint64(time.Now().UnixMicro()),
+		forget: forget,
+	}
+}
+
+// Add adds an inode, and returns its number.  The kernel has no references to it until it is
+// returned in an entry reply.
+func (t *InodeTable[T]) Add(v T) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ino := t.next
+	t.next++
+	t.nodes[ino] = &inodeEntry[T]{value: v}
+	return ino
+}
+
+// Get returns an inode.  Released inodes are returned until they are forgotten.
+func (t *InodeTable[T]) Get(ino int64) (T, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.nodes[ino]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Release marks an inode as removed from the filesystem.  It is removed from the table once the
+// kernel has no references to it, which may be immediately.  The root inode is never removed.
+func (t *InodeTable[T]) Release(ino int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.nodes[ino]
+	if !ok || ino == 1 {
+		return
+	}
+	e.released = true
+	if e.lookups == 0 {
+		delete(t.nodes, ino)
+	}
+}
+
+// Lookups returns the number of references the kernel holds to an inode.
+func (t *InodeTable[T]) Lookups(ino int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.nodes[ino]; ok {
+		return e.lookups
+	}
+	return 0
+}
+
+// Generation returns the generation number for entries from the table.
+func (t *InodeTable[T]) Generation() uint64 {
+	return t.gen
+}
+
+// Len returns the number of inodes in the table, including released inodes which the kernel has
+// not forgotten.
+func (t *InodeTable[T]) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.nodes)
+}
+
+// All returns the inodes in the table.  The table is copied, so it may be modified during
+// iteration.
+func (t *InodeTable[T]) All() iter.Seq2[int64, T] {
+	t.mu.Lock()
+	values := make(map[int64]T, len(t.nodes))
+	for ino, e := range t.nodes {
+		values[ino] = e.value
+	}
+	t.mu.Unlock()
+
+	return func(yield func(int64, T) bool) {
+		for ino, v := range values {
+			if !yield(ino, v) {
+				return
+			}
+		}
+	}
+}
+
+// AddLookup implements LookupCounter.
+func (t *InodeTable[T]) AddLookup(ino int64) {
+	t.mu.Lock()
+	e, ok := t.nodes[ino]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// Wait for a forget callback for the inode to return.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nodes[ino] == e {
+		e.lookups++
+	}
+}
+
+// ForgetLookups implements LookupCounter.
+func (t *InodeTable[T]) ForgetLookups(ino int64, n int) {
+	t.mu.Lock()
+	e, ok := t.nodes[ino]
+	if !ok || e.lookups == 0 {
+		t.mu.Unlock()
+		return
+	}
+	e.lookups = max(e.lookups-int64(n), 0)
+	if e.lookups > 0 {
+		t.mu.Unlock()
+		return
+	}
+	if e.released {
+		delete(t.nodes, ino)
+	}
+	e.forgets++
+	forgets := e.forgets
+	t.mu.Unlock()
+	if t.forget == nil {
+		return
+	}
+
+	// A lookup may have been added, and dropped again by another call, since the lock was
+	// released, in which case the callback is left to the latest call or skipped.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t.mu.Lock()
+	current := e.lookups == 0 && e.forgets == forgets
+	t.mu.Unlock()
+	if current {
+		t.forget(ino, e.value)
+	}
+}
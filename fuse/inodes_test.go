@@ -0,0 +1,118 @@
+package fuse
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInodeTable(t *testing.T) {
+	var forgotten []int64
+	table := NewInodeTable("root", func(ino int64, v string) {
+		forgotten = append(forgotten, ino)
+	})
+	require.NotZero(t, table.Generation())
+
+	a := table.Add("a")
+	b := table.Add("b")
+	require.Equal(t, map[int64]string{1: "root", a: "a", b: "b"}, maps.Collect(table.All()))
+
+	table.AddLookup(a)
+	table.AddLookup(a)
+	require.EqualValues(t, 2, table.Lookups(a))
+
+	// Released inodes remain until the kernel forgets them.
+	table.Release(a)
+	v, ok := table.Get(a)
+	require.True(t, ok)
+	require.Equal(t, "a", v)
+
+	table.ForgetLookups(a, 1)
+	require.Empty(t, forgotten)
+	table.ForgetLookups(a, 1)
+	require.Equal(t, []int64{a}, forgotten)
+	_, ok = table.Get(a)
+	require.False(t, ok)
+
+	// Inodes which are still linked stay in the table when forgotten.
+	table.AddLookup(b)
+	table.ForgetLookups(b, 5)
+	require.Equal(t, []int64{a, b}, forgotten)
+	require.Zero(t, table.Lookups(b))
+	_, ok = table.Get(b)
+	require.True(t, ok)
+
+	// An inode which the kernel has never seen is removed immediately.
+	table.Release(b)
+	_, ok = table.Get(b)
+	require.False(t, ok)
+
+	// The root inode is never removed, and numbers are not reused.
+	table.Release(1)
+	require.Equal(t, 1, table.Len())
+	require.Greater(t, table.Add("c"), b)
+}
+
+func TestInodeTableConcurrentForget(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var (
+		table   *InodeTable[string]
+		calls   atomic.Int64
+		revived atomic.Int64
+	)
+	table = NewInodeTable("root", func(ino int64, v string) {
+		if calls.Add(1) == 1 {
+			close(entered)
+			<-release
+		}
+		if table.Lookups(ino) != 0 {
+			revived.Add(1)
+		}
+	})
+	a := table.Add("a")
+	table.AddLookup(a)
+
+	forgotten := make(chan struct{})
+	go func() {
+		table.ForgetLookups(a, 1)
+		close(forgotten)
+	}()
+	<-entered
+
+	// A lookup waits for the callback, rather than reviving the inode while it runs.
+	added := make(chan struct{})
+	go func() {
+		table.AddLookup(a)
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("lookup added during forget callback")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-forgotten
+	<-added
+	require.EqualValues(t, 1, table.Lookups(a))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				table.AddLookup(a)
+				table.ForgetLookups(a, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	table.ForgetLookups(a, 1)
+	require.Zero(t, table.Lookups(a))
+	require.Zero(t, revived.Load())
+}
@@ -0,0 +1,59 @@
+//go:build cgo && !nocgo
+
+package fuse
+
+import (
+	"context"
+	"sync"
+)
+
+// #include "wrapper.h"
+import "C"
+
+// Requests which are currently being handled by a filesystem, along with the function that
+// cancels the request context.  Keyed by the FUSE request pointer, which is owned by libfuse.
+var (
+	activeReqLock sync.Mutex
+	activeReqs    = make(map[C.fuse_req_t]context.CancelFunc)
+)
+
+// newRequestContext returns the context passed to filesystem methods while handling req.  The
+// context is derived from parent.
+//
+// The context is cancelled if the kernel interrupts the request, for example because the calling
+// process received a signal.  The returned function must be called once the filesystem method
+// has returned, and before the reply is sent.
+//
+// A nil request results in a context which is only cancelled along with parent.
+func newRequestContext(parent context.Context, req C.fuse_req_t) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	if req == nil {
+		return ctx, cancel
+	}
+
+	activeReqLock.Lock()
+	activeReqs[req] = cancel
+	activeReqLock.Unlock()
+
+	// Must be called without holding activeReqLock, as FUSE calls ll_Interrupt immediately if the
+	// request was interrupted before the callback was registered.
+	C.register_interrupt(req)
+
+	return ctx, func() {
+		activeReqLock.Lock()
+		delete(activeReqs, req)
+		activeReqLock.Unlock()
+		cancel()
+	}
+}
+
+//export ll_Interrupt
+func ll_Interrupt(req C.fuse_req_t) {
+	activeReqLock.Lock()
+	cancel := activeReqs[req]
+	activeReqLock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -1,7 +1,11 @@
 package fuse
 
 import (
+	"context"
 	"log/slog"
+	"maps"
+	"os"
+	"slices"
 	"time"
 )
 
@@ -29,9 +33,20 @@ type iNode struct {
 
 	// Unix permission bits.
 	mode int
+
+	uid int
+	gid int
+
+	// POSIX ACLs.  The access ACL is nil if it is represented by the mode.
+	acl        ACL
+	defaultACL ACL
+
+	// Other extended attributes.
+	xattrs XAttrStore
 }
 
 func (i *iNode) stat() *InoAttr {
+	uid, gid := i.uid, i.gid
 	stat := &InoAttr{
 		Ino:     i.id,
 		Timeout: attrTimeout,
@@ -40,6 +55,8 @@ func (i *iNode) stat() *InoAttr {
 		CTime:   i.ctime,
 		MTime:   i.mtime,
 		ATime:   i.mtime,
+		UID:     &uid,
+		GID:     &gid,
 	}
 
 	if i.dir != nil {
@@ -58,34 +75,55 @@ func (i *iNode) stat() *InoAttr {
 type MemFS struct {
 	DefaultFileSystem
 
-	gen    uint64
-	inodes map[int64]*iNode
-	nextID int64
+	inodes *InodeTable[*iNode]
+
+	// ctx is the context of the request handled by this copy of the filesystem.  See WithContext.
+	ctx context.Context
 }
 
 // NewMemFS creates a new in-memory filesystem.
 func NewMemFS() *MemFS {
-	root := &memDir{nodes: make(map[string]int64)}
-	m := &MemFS{
-		inodes: make(map[int64]*iNode),
-		nextID: 2, // inode 1 is reserved for the root directory.
-		gen:    uint64(time.Now().UnixMicro()),
-	}
 	now := time.Now()
-	m.inodes[1] = &iNode{
+	root := &iNode{
 		id:    1,
-		dir:   root,
+		dir:   &memDir{nodes: make(map[string]int64)},
 		ctime: now,
 		mtime: now,
 		mode:  0o777,
+		uid:   os.Getuid(),
+		gid:   os.Getgid(),
 	}
-	return m
+	return &MemFS{inodes: NewInodeTable(root, nil), ctx: context.Background()}
+}
+
+// WithContext implements ContextFileSystem.  The returned copy shares the inodes of m, and checks
+// permissions for the caller of the request.
+func (m *MemFS) WithContext(ctx context.Context) FileSystem {
+	return &MemFS{inodes: m.inodes, ctx: ctx}
+}
+
+// LookupTable implements LookupTracker.  Removed nodes are kept until the kernel forgets them.
+func (m *MemFS) LookupTable() LookupCounter {
+	return m.inodes
+}
+
+// Init requests POSIX ACL support, so that the kernel enforces the ACLs stored by MemFS.  The
+// umask is then applied by MemFS, as it does not apply to files which inherit a default ACL.
+func (m *MemFS) Init(conn *ConnInfo) Status {
+	conn.Want |= CAP_POSIX_ACL | CAP_DONT_MASK
+	return OK
+}
+
+// node returns an inode, or nil if it does not exist.
+func (m *MemFS) node(ino int64) *iNode {
+	n, _ := m.inodes.Get(ino)
+	return n
 }
 
 func (m *MemFS) entry(node *iNode) *Entry {
 	return &Entry{
 		Ino:          node.id,
-		Generation:   m.gen,
+		Generation:   m.inodes.Generation(),
 		Attr:         node.stat(),
 		AttrTimeout:  attrTimeout,
 		EntryTimeout: attrTimeout,
@@ -93,7 +131,7 @@ func (m *MemFS) entry(node *iNode) *Entry {
 }
 
 func (m *MemFS) dirNode(parent int64) (*iNode, Status) {
-	n := m.inodes[parent]
+	n := m.node(parent)
 	if n == nil {
 		return nil, ENOENT
 	}
@@ -104,7 +142,7 @@ func (m *MemFS) dirNode(parent int64) (*iNode, Status) {
 }
 
 func (m *MemFS) fileNode(ino int64) (*iNode, Status) {
-	n := m.inodes[ino]
+	n := m.node(ino)
 	if n == nil {
 		return nil, ENOENT
 	}
@@ -128,21 +166,19 @@ func (m *MemFS) Mknod(dir int64, name string, mode int, rdev int) (*Entry, Statu
 		return nil, EEXIST
 	}
 
-	i := m.nextID
-	m.nextID++
-	d.nodes[name] = i
-
 	now := time.Now()
 	node := &iNode{
-		id: i,
 		file: &memFile{
 			data: make([]byte, 0),
 		},
 		ctime: now,
 		mtime: now,
-		mode:  mode,
 	}
-	m.inodes[i] = node
+	caller := m.caller()
+	node.uid, node.gid, mode = InheritOwner(n.stat(), caller, mode)
+	node.acl, _, node.mode = InheritACL(n.defaultACL, mode, caller.Umask, false)
+	node.id = m.inodes.Add(node)
+	d.nodes[name] = node.id
 	return m.entry(node), OK
 }
 
@@ -164,22 +200,21 @@ func (m *MemFS) Mkdir(dir int64, name string, mode int) (*Entry, Status) {
 		return nil, EEXIST
 	}
 
-	i := m.nextID
-	m.nextID++
-	d.nodes[name] = i
-
 	now := time.Now()
 	node := &iNode{
-		id: i,
 		dir: &memDir{
 			parent: n,
 			nodes:  make(map[string]int64),
 		},
 		ctime: now,
 		mtime: now,
-		mode:  mode,
 	}
-	m.inodes[i] = node
+	caller := m.caller()
+	node.uid, node.gid, mode = InheritOwner(n.stat(), caller, S_IFDIR|mode)
+	node.acl, node.defaultACL, node.mode = InheritACL(n.defaultACL, mode&^S_IFDIR, caller.Umask,
+		true)
+	node.id = m.inodes.Add(node)
+	d.nodes[name] = node.id
 	return m.entry(node), OK
 }
 
@@ -187,7 +222,7 @@ func (m *MemFS) Mkdir(dir int64, name string, mode int) (*Entry, Status) {
 func (m *MemFS) GetAttr(ino int64, info *FileInfo) (attr *InoAttr, err Status) {
 	slog.Debug("GetAttr", "ino", ino)
 
-	i := m.inodes[ino]
+	i := m.node(ino)
 	if i == nil {
 		return nil, ENOENT
 	}
@@ -195,33 +230,35 @@ func (m *MemFS) GetAttr(ino int64, info *FileInfo) (attr *InoAttr, err Status) {
 }
 
 // SetAttr changes node attributes.
-func (m *MemFS) SetAttr(ino int64, attr *InoAttr, mask SetAttrMask, fi *FileInfo) (
-	*InoAttr, Status,
-) {
-	slog.Debug("SetAttr", "ino", ino, "attr", attr, "mask", mask, "fi", fi)
+func (m *MemFS) SetAttr(req *SetAttrRequest) (*InoAttr, Status) {
+	slog.Debug("SetAttr", "req", req)
 
-	i := m.inodes[ino]
+	i := m.node(req.Ino)
 	if i == nil {
 		return nil, ENOENT
 	}
-
-	if mask&SET_ATTR_MODE != 0 {
-		i.mode = attr.Mode
-	}
-	if mask&SET_ATTR_MTIME != 0 {
-		i.mtime = attr.MTime
+	if req.Size != nil && i.file == nil {
+		return nil, EISDIR
 	}
-	if mask&SET_ATTR_MTIME_NOW != 0 {
-		i.mtime = time.Now()
+
+	attr := i.stat()
+	if err := CheckSetAttr(attr, m.caller(), req); err != OK {
+		return nil, err
 	}
-	if mask&SET_ATTR_SIZE != 0 {
-		if i.file == nil {
-			return nil, EISDIR
-		}
-		if int(attr.Size) <= len(i.file.data) {
-			i.file.data = i.file.data[:attr.Size]
+	req.ApplyTo(attr)
+	if i.acl != nil && attr.Mode != i.mode {
+		i.acl = i.acl.Chmod(attr.Mode)
+	}
+	i.mode = attr.Mode
+	i.uid, i.gid = *attr.UID, *attr.GID
+	i.mtime = attr.MTime
+	i.ctime = attr.CTime
+	if req.Size != nil {
+		size := int(*req.Size)
+		if size <= len(i.file.data) {
+			i.file.data = i.file.data[:size]
 		} else {
-			data := make([]byte, attr.Size)
+			data := make([]byte, size)
 			copy(data, i.file.data)
 			i.file.data = data
 		}
@@ -230,6 +267,26 @@ func (m *MemFS) SetAttr(ino int64, attr *InoAttr, mask SetAttrMask, fi *FileInfo
 	return i.stat(), OK
 }
 
+// Access checks the caller's permissions, including ACLs.  It is not called when mounted, as
+// Init requests CAP_POSIX_ACL, and the kernel checks permissions instead.
+func (m *MemFS) Access(ino int64, mask int) Status {
+	slog.Debug("Access", "ino", ino, "mask", mask)
+
+	n := m.node(ino)
+	if n == nil {
+		return ENOENT
+	}
+	return CheckAccessACL(n.stat(), n.acl, m.caller(), mask)
+}
+
+// caller returns the caller of the request, or the current process outside of a request.
+func (m *MemFS) caller() *Caller {
+	if c, ok := CallerFromContext(m.ctx); ok {
+		return c
+	}
+	return newCaller(os.Getuid(), os.Getgid(), os.Getpid())
+}
+
 // Lookup finds node by name.
 func (m *MemFS) Lookup(parent int64, name string) (entry *Entry, err Status) {
 	slog.Debug("Lookup", "parent", parent, "name", name)
@@ -243,7 +300,7 @@ func (m *MemFS) Lookup(parent int64, name string) (entry *Entry, err Status) {
 	if !exist {
 		return nil, ENOENT
 	}
-	node := m.inodes[i]
+	node := m.node(i)
 	return m.entry(node), OK
 }
 
@@ -252,7 +309,7 @@ func (m *MemFS) StatFS(ino int64) (stat *StatVFS, status Status) {
 	slog.Debug("StatFS", "ino", ino)
 
 	stat = &StatVFS{
-		Files: int64(len(m.inodes)),
+		Files: int64(m.inodes.Len()),
 	}
 	status = OK
 	return
@@ -271,33 +328,26 @@ func (m *MemFS) ReadDir(ino int64, fi *FileInfo, off int64, size int, w DirEntry
 	if err != OK {
 		return err
 	}
-	d := n.dir
-
-	idx := int64(1)
-	if idx > off {
-		if !w.Add(".", ino, n.mode, idx) {
-			return OK
-		}
-	}
-	idx++
-	if d.parent != nil {
-		if idx > off {
-			if !w.Add("..", d.parent.id, d.parent.mode, idx) {
-				return OK
-			}
-		}
-		idx++
+	parent := ino
+	if n.dir.parent != nil {
+		parent = n.dir.parent.id
 	}
 
-	for name, i := range d.nodes {
-		if idx > off {
-			node := m.inodes[i]
-			if !w.Add(name, i, node.mode, idx) {
-				return OK
+	// Entries are listed in inode order, with the inode number as the offset, so that a listing
+	// resumes in the right place when entries are added or removed between calls.
+	ids := slices.Sorted(maps.Values(n.dir.nodes))
+	names := make(map[int64]string, len(ids))
+	for name, i := range n.dir.nodes {
+		names[i] = name
+	}
+	WriteDir(w, off, ino, parent, func(yield func(DirEntry) bool) {
+		for _, i := range ids {
+			e := DirEntry{Name: names[i], Ino: i, Mode: m.node(i).stat().Mode, Offset: i + 2}
+			if !yield(e) {
+				return
 			}
 		}
-		idx++
-	}
+	})
 	return OK
 }
 
@@ -322,7 +372,7 @@ func (m *MemFS) Rmdir(dir int64, name string) Status {
 		return EEXIST
 	}
 
-	c := m.inodes[cid]
+	c := m.node(cid)
 	if c.dir == nil {
 		return ENOTDIR
 	}
@@ -331,7 +381,7 @@ func (m *MemFS) Rmdir(dir int64, name string) Status {
 		return ENOTEMPTY
 	}
 
-	delete(m.inodes, c.id)
+	m.inodes.Release(c.id)
 	delete(n.dir.nodes, name)
 	return OK
 }
@@ -354,12 +404,12 @@ func (m *MemFS) Rename(dir int64, name string, newdir int64, newname string, fla
 	}
 	newOID, present := nd.dir.nodes[newname]
 	if present {
-		c := m.inodes[newOID]
+		c := m.node(newOID)
 		if c.file == nil {
 			return EISDIR
 		}
 
-		delete(m.inodes, c.id)
+		m.inodes.Release(c.id)
 	}
 
 	nd.dir.nodes[newname] = oid
@@ -380,12 +430,12 @@ func (m *MemFS) Unlink(dir int64, name string) Status {
 		return EEXIST
 	}
 
-	c := m.inodes[cid]
+	c := m.node(cid)
 	if c.file == nil {
 		return EISDIR
 	}
 
-	delete(m.inodes, c.id)
+	m.inodes.Release(c.id)
 	delete(n.dir.nodes, name)
 	return OK
 }
@@ -429,3 +479,135 @@ func (m *MemFS) Write(p []byte, ino int64, off int64, fi *FileInfo) (int, Status
 	copy(slice, p)
 	return len(p), OK
 }
+
+// ListXAttrs lists extended attributes, including ACLs.
+func (m *MemFS) ListXAttrs(ino int64) ([]string, Status) {
+	n := m.node(ino)
+	if n == nil {
+		return nil, ENOENT
+	}
+
+	var names []string
+	if n.acl != nil {
+		names = append(names, XATTR_POSIX_ACL_ACCESS)
+	}
+	if n.defaultACL != nil {
+		names = append(names, XATTR_POSIX_ACL_DEFAULT)
+	}
+	return append(names, n.xattrs.List()...), OK
+}
+
+// GetXAttrSize returns the size of an extended attribute.
+func (m *MemFS) GetXAttrSize(ino int64, name string) (int, Status) {
+	value, err := m.xattr(ino, name)
+	return len(value), err
+}
+
+// GetXAttr copies an extended attribute into out.
+func (m *MemFS) GetXAttr(ino int64, name string, out []byte) (int, Status) {
+	value, err := m.xattr(ino, name)
+	if err != OK {
+		return 0, err
+	}
+	if len(out) < len(value) {
+		return 0, ERANGE
+	}
+	return copy(out, value), OK
+}
+
+// xattr returns an extended attribute, including the ACLs.
+func (m *MemFS) xattr(ino int64, name string) ([]byte, Status) {
+	n := m.node(ino)
+	if n == nil {
+		return nil, ENOENT
+	}
+
+	acl := n.aclAttr(name)
+	if acl == nil {
+		return n.xattrs.Get(name)
+	}
+	if *acl == nil {
+		return nil, ENODATA
+	}
+	return acl.Encode(), OK
+}
+
+// SetXAttr sets an extended attribute.  Setting the access ACL also sets the permission bits of
+// the mode.  An ACL without entries removes the ACL, leaving the mode unchanged.
+func (m *MemFS) SetXAttr(ino int64, name string, value []byte,
+	flags XAttrFlags,
+) Status {
+	n := m.node(ino)
+	if n == nil {
+		return ENOENT
+	}
+
+	acl := n.aclAttr(name)
+	if acl == nil {
+		err := n.xattrs.Set(name, value, flags)
+		if err == OK {
+			n.ctime = time.Now()
+		}
+		return err
+	}
+
+	if name == XATTR_POSIX_ACL_DEFAULT && n.dir == nil {
+		// Only directories have default ACLs.
+		return EACCES
+	}
+	v, err := DecodeACL(value)
+	if err != OK {
+		return err
+	}
+	switch {
+	case *acl != nil && flags&XATTR_CREATE != 0:
+		return EEXIST
+	case *acl == nil && flags&XATTR_REPLACE != 0:
+		return ENODATA
+	}
+
+	if name == XATTR_POSIX_ACL_ACCESS && v != nil {
+		n.mode = n.mode&^0o777 | v.Mode()
+		if v.IsMinimal() {
+			v = nil
+		}
+	}
+	*acl = v
+	n.ctime = time.Now()
+	return OK
+}
+
+// RemoveXAttr removes an extended attribute.
+func (m *MemFS) RemoveXAttr(ino int64, name string) Status {
+	n := m.node(ino)
+	if n == nil {
+		return ENOENT
+	}
+
+	acl := n.aclAttr(name)
+	if acl == nil {
+		err := n.xattrs.Remove(name)
+		if err == OK {
+			n.ctime = time.Now()
+		}
+		return err
+	}
+	if *acl == nil {
+		return ENODATA
+	}
+	*acl = nil
+	n.ctime = time.Now()
+	return OK
+}
+
+// aclAttr returns the ACL stored in the named attribute, or nil if it is not an ACL attribute.
+func (i *iNode) aclAttr(name string) *ACL {
+	switch name {
+	case XATTR_POSIX_ACL_ACCESS:
+		return &i.acl
+	case XATTR_POSIX_ACL_DEFAULT:
+		return &i.defaultACL
+	default:
+		return nil
+	}
+}
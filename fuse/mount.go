@@ -1,20 +1,52 @@
+//go:build cgo && !nocgo
+
 package fuse
 
 // #include "wrapper.h"
 // #include <stdlib.h>
 import "C"
 
-// MountAndRun mounts the filesystem and enters the Fuse event loop.
-// The argumenst are passed to libfuse to mount the filesystem.  Any flags supported by libfuse are
-// allowed. The call returns immediately on error, or else blocks until the filesystem is
-// unmounted.
+import (
+	"fmt"
+	"os"
+)
+
+// MountAndRunV2 mounts a FileSystemV2 and enters the Fuse event loop.
+// If opts is nil, the default options are used.  See MountAndRun for details.
 //
-// Example:
+// If Init fails, the filesystem is unmounted and the error is printed.  Use MountAndServe to
+// handle the error instead.
 //
-//   fs := &MyFs{}
-//   err := fuse.MountAndRun(os.Args, fs)
-func MountAndRun(args []string, fs FileSystem) int {
-	id := RegisterFS(fs)
+// The filesystem may implement any subset of the operation interfaces, such as Lookuper, instead
+// of the complete FileSystemV2.  A FileSystem is served through AdaptFileSystem.  See
+// RegisterFSV2.
+func MountAndRunV2(args []string, fs any, opts *Options) int {
+	res, err := mountAndRun(args, fs, opts)
+	if err != OK {
+		fmt.Fprintf(os.Stderr, "init failed: %v\n", err)
+		return 1
+	}
+	return res
+}
+
+// MountAndServe is like MountAndRunV2, but returns an error instead of an exit status.  If Init
+// fails, the returned error wraps the Status which it returned.  Errors reported by libfuse, such
+// as a failed mount, are printed by libfuse.
+func MountAndServe(args []string, fs any, opts *Options) error {
+	res, err := mountAndRun(args, fs, opts)
+	if err != OK {
+		return fmt.Errorf("init failed: %w", err)
+	}
+	if res != 0 {
+		return fmt.Errorf("fuse session failed with status %d", res)
+	}
+	return nil
+}
+
+// mountAndRun runs the libfuse event loop, and returns its result along with the error returned
+// by Init.
+func mountAndRun(args []string, fs any, opts *Options) (int, Status) {
+	id := RegisterFSV2(fs, opts)
 	defer DeregisterFS(id)
 
 	// Make args available to C code.
@@ -27,5 +59,11 @@ func MountAndRun(args []string, fs FileSystem) int {
 		argv = append(argv, C.CString("-h"))
 	}
 	argc := C.int(len(argv))
-	return int(C.MountAndRun(C.int(id), argc, &argv[0]))
+	var workers int
+	if opts != nil {
+		workers = opts.Workers
+	}
+	ops := toCOps(getMount(id).ops)
+	res := int(C.MountAndRun(C.int(id), argc, &argv[0], C.int(workers), ops))
+	return res, getMount(id).initErr
 }
@@ -0,0 +1,841 @@
+//go:build !cgo || nocgo
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// maxWrite is the largest write request accepted by the pure Go transport.
+const maxWrite = 128 * 1024
+
+// conn serves a filesystem over a connection to the kernel, such as an open /dev/fuse.
+type conn struct {
+	m  *mount
+	fd int
+
+	// Requests which are currently being handled, along with the function that cancels the
+	// request context.  Keyed by the unique request id assigned by the kernel.
+	activeLock sync.Mutex
+	active     map[uint64]context.CancelFunc
+
+	initOnce    sync.Once
+	destroyOnce sync.Once
+	initialized atomic.Bool
+
+	// stop ends the session if the filesystem fails to initialize, which unblocks any workers
+	// waiting for requests.  Optional.
+	stop func()
+
+	// pollReady is closed once the kernel has been told that poll is not supported.  Nil unless
+	// Options.PollWorkaround is set.  See startPollHack.
+	pollReady chan struct{}
+}
+
+func newConn(m *mount, fd int) *conn {
+	return &conn{
+		m:      m,
+		fd:     fd,
+		active: make(map[uint64]context.CancelFunc),
+	}
+}
+
+// serve reads and dispatches requests using the given number of worker goroutines, until the
+// filesystem is unmounted or the connection is closed.  The filesystem is destroyed before serve
+// returns.
+func (c *conn) serve(workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.worker()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if c.initialized.Load() {
+		c.destroy()
+	}
+	if err := c.m.initErr; err != OK {
+		return fmt.Errorf("init failed: %w", err)
+	}
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// worker processes requests until the connection ends.
+func (c *conn) worker() error {
+	buf := make([]byte, maxWrite+os.Getpagesize())
+	for {
+		n, err := syscall.Read(c.fd, buf)
+		switch {
+		case errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN):
+			continue
+		case errors.Is(err, syscall.ENOENT):
+			// The request was interrupted before it could be read.
+			continue
+		case errors.Is(err, syscall.ENODEV):
+			// The filesystem was unmounted.
+			return nil
+		case err != nil:
+			return err
+		case n == 0:
+			return nil
+		}
+
+		if !c.dispatch(buf[:n]) {
+			if c.m.initErr != OK && c.stop != nil {
+				c.stop()
+			}
+			return nil
+		}
+	}
+}
+
+func (c *conn) destroy() {
+	c.destroyOnce.Do(c.m.destroy)
+}
+
+// reply sends a reply to the kernel.  Data is not sent with an error reply.
+func (c *conn) reply(unique uint64, err Status, data ...[]byte) Status {
+	hdr := outHeader{Unique: unique, Error: -int32(err)}
+	msg := make([]byte, unsafe.Sizeof(hdr), 256)
+	if err == OK {
+		for _, d := range data {
+			msg = append(msg, d...)
+		}
+	}
+	hdr.Len = uint32(len(msg))
+	copy(msg, structBytes(&hdr))
+
+	if _, werr := syscall.Write(c.fd, msg); werr != nil {
+		return ToStatus(werr)
+	}
+	return OK
+}
+
+// newRequestContext returns the context passed to filesystem methods while handling a request.
+// The context holds the caller, and is cancelled if the kernel interrupts the request.  The
+// returned function must be called before the reply is sent.
+func (c *conn) newRequestContext(unique uint64, caller *Caller) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(withCaller(c.m.ctx, caller))
+
+	c.activeLock.Lock()
+	c.active[unique] = cancel
+	c.activeLock.Unlock()
+
+	return ctx, func() {
+		c.activeLock.Lock()
+		delete(c.active, unique)
+		c.activeLock.Unlock()
+		cancel()
+	}
+}
+
+// serveRequest handles a request with the shared operation handlers.  The operation name and inode
+// are used to report panics.
+func (c *conn) serveRequest(unique uint64, op string, ino int64, caller *Caller,
+	handle func(r *request),
+) {
+	ctx, done := c.newRequestContext(unique, caller)
+	c.m.serve(&request{
+		m:    c.m,
+		ctx:  ctx,
+		out:  goReplier{c, unique},
+		done: done,
+		op:   op,
+		ino:  ino,
+	}, handle)
+}
+
+// parse returns a pointer to the structure at the start of b, along with the remaining bytes.
+// The structure is not copied, and is only valid until the request buffer is reused.
+func parse[T any](b []byte) (*T, []byte, bool) {
+	var v T
+	n := int(unsafe.Sizeof(v))
+	if len(b) < n {
+		return nil, nil, false
+	}
+	return (*T)(unsafe.Pointer(&b[0])), b[n:], true
+}
+
+// parseName returns the NUL terminated string at the start of b, along with the remaining bytes.
+func parseName(b []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
+
+// dispatch decodes a request and serves it.  Returns false once the session has ended.
+func (c *conn) dispatch(b []byte) bool {
+	h, body, ok := parse[inHeader](b)
+	if !ok || int(h.Len) != len(b) {
+		return true
+	}
+	unique := h.Unique
+	ino := int64(h.NodeID)
+
+	switch h.Opcode {
+	case opInit:
+		return c.init(unique, body)
+
+	case opDestroy:
+		c.destroy()
+		c.reply(unique, OK)
+		return false
+
+	case opInterrupt:
+		if in, _, ok := parse[interruptIn](body); ok {
+			c.interrupt(unique, in.Unique)
+		}
+		return true
+	}
+
+	if !c.initialized.Load() {
+		c.reply(unique, EIO)
+		return true
+	}
+	if c.servePollHack(h.Opcode, unique, ino, body) {
+		return true
+	}
+	caller := newCaller(int(h.UID), int(h.GID), int(h.PID))
+	if c.deferOpen(h.Opcode, unique, ino, caller, body) {
+		return true
+	}
+	if !c.decode(h.Opcode, unique, ino, caller, body) {
+		c.reply(unique, EINVAL)
+	}
+	return true
+}
+
+// decode decodes a request for a filesystem operation and serves it.  Returns false if the
+// request is malformed.
+func (c *conn) decode(op opcode, unique uint64, ino int64, caller *Caller, body []byte) bool {
+	serve := func(name string, handle func(r *request)) bool {
+		c.serveRequest(unique, name, ino, caller, handle)
+		return true
+	}
+
+	switch op {
+	case opLookup:
+		name, _, ok := parseName(body)
+		if !ok {
+			return false
+		}
+		in := &LookupRequest{Parent: ino, Name: name}
+		return serve("Lookup", func(r *request) { handleLookup(r, in) })
+
+	case opForget:
+		f, _, ok := parse[forgetIn](body)
+		if !ok {
+			return false
+		}
+		in := &ForgetRequest{Ino: ino, N: int(f.Nlookup)}
+		return serve("Forget", func(r *request) { handleForget(r, in) })
+
+	case opBatchForget:
+		bf, rest, ok := parse[batchForgetIn](body)
+		if !ok {
+			return false
+		}
+		forgets := make([]*ForgetRequest, 0, bf.Count)
+		for range bf.Count {
+			var f *forgetOne
+			if f, rest, ok = parse[forgetOne](rest); !ok {
+				return false
+			}
+			if c.pollReady != nil && f.NodeID == pollHackIno {
+				continue
+			}
+			forgets = append(forgets, &ForgetRequest{Ino: int64(f.NodeID), N: int(f.Nlookup)})
+		}
+		return serve("Forget", func(r *request) { handleForgetMulti(r, forgets) })
+
+	case opGetattr:
+		g, _, ok := parse[getattrIn](body)
+		if !ok {
+			return false
+		}
+		in := &GetAttrRequest{Ino: ino}
+		if g.GetattrFlags&getattrFh != 0 {
+			in.File = &FileInfo{Handle: g.Fh}
+		}
+		return serve("GetAttr", func(r *request) { handleGetAttr(r, in) })
+
+	case opSetattr:
+		s, _, ok := parse[setattrIn](body)
+		if !ok {
+			return false
+		}
+		in := decodeSetAttr(ino, s)
+		return serve("SetAttr", func(r *request) { handleSetAttr(r, in) })
+
+	case opReadlink:
+		in := &ReadLinkRequest{Ino: ino}
+		return serve("ReadLink", func(r *request) { handleReadLink(r, in) })
+
+	case opSymlink:
+		name, rest, ok := parseName(body)
+		if !ok {
+			return false
+		}
+		link, _, ok := parseName(rest)
+		if !ok {
+			return false
+		}
+		in := &SymlinkRequest{Link: link, Parent: ino, Name: name}
+		return serve("Symlink", func(r *request) { handleSymlink(r, in) })
+
+	case opMknod:
+		m, rest, ok := parse[mknodIn](body)
+		if !ok {
+			return false
+		}
+		name, _, ok := parseName(rest)
+		if !ok {
+			return false
+		}
+		caller.Umask = int(m.Umask)
+		in := &MknodRequest{Parent: ino, Name: name, Mode: int(m.Mode), Rdev: int(m.Rdev)}
+		return serve("Mknod", func(r *request) { handleMknod(r, in) })
+
+	case opMkdir:
+		m, rest, ok := parse[mkdirIn](body)
+		if !ok {
+			return false
+		}
+		name, _, ok := parseName(rest)
+		if !ok {
+			return false
+		}
+		caller.Umask = int(m.Umask)
+		in := &MkdirRequest{Parent: ino, Name: name, Mode: int(m.Mode)}
+		return serve("Mkdir", func(r *request) { handleMkdir(r, in) })
+
+	case opUnlink:
+		name, _, ok := parseName(body)
+		if !ok {
+			return false
+		}
+		in := &UnlinkRequest{Parent: ino, Name: name}
+		return serve("Unlink", func(r *request) { handleUnlink(r, in) })
+
+	case opRmdir:
+		name, _, ok := parseName(body)
+		if !ok {
+			return false
+		}
+		in := &RmdirRequest{Parent: ino, Name: name}
+		return serve("Rmdir", func(r *request) { handleRmdir(r, in) })
+
+	case opRename, opRename2:
+		in := &RenameRequest{Parent: ino}
+		var rest []byte
+		var ok bool
+		if op == opRename {
+			var rn *renameIn
+			if rn, rest, ok = parse[renameIn](body); !ok {
+				return false
+			}
+			in.NewParent = int64(rn.Newdir)
+		} else {
+			var rn *rename2In
+			if rn, rest, ok = parse[rename2In](body); !ok {
+				return false
+			}
+			in.NewParent = int64(rn.Newdir)
+			in.Flags = int(rn.Flags)
+		}
+		if in.Name, rest, ok = parseName(rest); !ok {
+			return false
+		}
+		if in.NewName, _, ok = parseName(rest); !ok {
+			return false
+		}
+		return serve("Rename", func(r *request) { handleRename(r, in) })
+
+	case opLink:
+		l, rest, ok := parse[linkIn](body)
+		if !ok {
+			return false
+		}
+		name, _, ok := parseName(rest)
+		if !ok {
+			return false
+		}
+		in := &LinkRequest{Ino: int64(l.Oldnodeid), NewParent: ino, NewName: name}
+		return serve("Link", func(r *request) { handleLink(r, in) })
+
+	case opOpen, opOpendir:
+		o, _, ok := parse[openIn](body)
+		if !ok {
+			return false
+		}
+		in := &OpenRequest{Ino: ino, Flags: int(o.Flags)}
+		if op == opOpen {
+			return serve("Open", func(r *request) { handleOpen(r, in) })
+		}
+		return serve("OpenDir", func(r *request) { handleOpenDir(r, in) })
+
+	case opRead, opReaddir:
+		rd, _, ok := parse[readIn](body)
+		if !ok {
+			return false
+		}
+		fi := &FileInfo{Flags: int(rd.Flags), Handle: rd.Fh, LockOwner: rd.LockOwner}
+		if op == opReaddir {
+			in := &ReadDirRequest{Ino: ino, Offset: int64(rd.Offset), Size: int(rd.Size), File: fi}
+			return serve("ReadDir", func(r *request) { handleReadDir(r, in) })
+		}
+		in := &ReadRequest{Ino: ino, Size: int64(rd.Size), Offset: int64(rd.Offset), File: fi}
+		return serve("Read", func(r *request) { handleRead(r, in) })
+
+	case opWrite:
+		w, rest, ok := parse[writeIn](body)
+		if !ok || len(rest) < int(w.Size) {
+			return false
+		}
+		in := &WriteRequest{
+			Ino:    ino,
+			Data:   c.m.requestBuf(rest[:w.Size]),
+			Offset: int64(w.Offset),
+			File: &FileInfo{
+				Flags:     int(w.Flags),
+				Writepage: w.WriteFlags&1 != 0,
+				Handle:    w.Fh,
+				LockOwner: w.LockOwner,
+			},
+		}
+		return serve("Write", func(r *request) { handleWrite(r, in) })
+
+	case opStatfs:
+		in := &StatFSRequest{Ino: ino}
+		return serve("StatFS", func(r *request) { handleStatFS(r, in) })
+
+	case opRelease, opReleasedir:
+		rl, _, ok := parse[releaseIn](body)
+		if !ok {
+			return false
+		}
+		in := &ReleaseRequest{
+			Ino: ino,
+			File: &FileInfo{
+				Flags:        int(rl.Flags),
+				Flush:        rl.ReleaseFlags&releaseFlush != 0,
+				FlockRelease: rl.ReleaseFlags&releaseFlockUnlock != 0,
+				Handle:       rl.Fh,
+				LockOwner:    rl.LockOwner,
+			},
+		}
+		if op == opRelease {
+			return serve("Release", func(r *request) { handleRelease(r, in) })
+		}
+		return serve("ReleaseDir", func(r *request) { handleReleaseDir(r, in) })
+
+	case opFsync, opFsyncdir:
+		f, _, ok := parse[fsyncIn](body)
+		if !ok {
+			return false
+		}
+		in := &FSyncRequest{Ino: ino, DataOnly: f.FsyncFlags&1 != 0, File: &FileInfo{Handle: f.Fh}}
+		if op == opFsync {
+			return serve("FSync", func(r *request) { handleFSync(r, in) })
+		}
+		return serve("FSyncDir", func(r *request) { handleFSyncDir(r, in) })
+
+	case opFlush:
+		f, _, ok := parse[flushIn](body)
+		if !ok {
+			return false
+		}
+		in := &FlushRequest{Ino: ino, File: &FileInfo{Handle: f.Fh, LockOwner: f.LockOwner}}
+		return serve("Flush", func(r *request) { handleFlush(r, in) })
+
+	case opSetxattr:
+		s, rest, ok := parse[setxattrIn](body)
+		if !ok {
+			return false
+		}
+		name, rest, ok := parseName(rest)
+		if !ok || len(rest) < int(s.Size) {
+			return false
+		}
+		in := &SetXAttrRequest{
+			Ino:   ino,
+			Name:  name,
+			Value: c.m.requestBuf(rest[:s.Size]),
+			Flags: XAttrFlags(s.Flags),
+		}
+		return serve("SetXAttr", func(r *request) { handleSetXAttr(r, in) })
+
+	case opGetxattr:
+		g, rest, ok := parse[getxattrIn](body)
+		if !ok {
+			return false
+		}
+		name, _, ok := parseName(rest)
+		if !ok {
+			return false
+		}
+		in, size := &GetXAttrRequest{Ino: ino, Name: name}, int(g.Size)
+		return serve("GetXAttr", func(r *request) { handleGetXAttr(r, in, size) })
+
+	case opListxattr:
+		g, _, ok := parse[getxattrIn](body)
+		if !ok {
+			return false
+		}
+		in, size := &ListXAttrsRequest{Ino: ino}, int(g.Size)
+		return serve("ListXAttr", func(r *request) { handleListXAttr(r, in, size) })
+
+	case opRemovexattr:
+		name, _, ok := parseName(body)
+		if !ok {
+			return false
+		}
+		in := &RemoveXAttrRequest{Ino: ino, Name: name}
+		return serve("RemoveXAttr", func(r *request) { handleRemoveXAttr(r, in) })
+
+	case opAccess:
+		a, _, ok := parse[accessIn](body)
+		if !ok {
+			return false
+		}
+		in := &AccessRequest{Ino: ino, Mask: int(a.Mask)}
+		return serve("Access", func(r *request) { handleAccess(r, in) })
+
+	case opCreate:
+		cr, rest, ok := parse[createIn](body)
+		if !ok {
+			return false
+		}
+		name, _, ok := parseName(rest)
+		if !ok {
+			return false
+		}
+		caller.Umask = int(cr.Umask)
+		in := &CreateRequest{Parent: ino, Name: name, Mode: int(cr.Mode), Flags: int(cr.Flags)}
+		return serve("Create", func(r *request) { handleCreate(r, in) })
+
+	default:
+		c.reply(unique, ENOSYS)
+		return true
+	}
+}
+
+// init negotiates the connection settings and initializes the filesystem.  Returns false if the
+// filesystem failed to initialize, which ends the session.
+func (c *conn) init(unique uint64, body []byte) bool {
+	in, _, ok := parse[initIn](body)
+	if !ok {
+		c.reply(unique, EINVAL)
+		return true
+	}
+	if in.Major < kernelVersion {
+		c.reply(unique, EPROTO)
+		return true
+	}
+	if in.Major > kernelVersion {
+		// The kernel will send a new init request with our major version.
+		out := initOut{Major: kernelVersion, Minor: kernelMinorVersion}
+		c.reply(unique, OK, structBytes(&out))
+		return true
+	}
+
+	capable := fromInitFlags(in.Flags)
+	req := &InitRequest{
+		Conn: ConnInfo{
+			ProtoMajor:   int(in.Major),
+			ProtoMinor:   int(in.Minor),
+			MaxWrite:     maxWrite,
+			MaxReadahead: int(in.MaxReadahead),
+			Capable:      capable,
+			Want:         capable & CAP_ASYNC_READ,
+			TimeGran:     1,
+		},
+	}
+	resp := &InitResponse{Conn: req.Conn}
+	err := OK
+	c.initOnce.Do(func() {
+		err = c.m.init(req, resp)
+		c.initialized.Store(err == OK)
+	})
+	if err != OK {
+		c.reply(unique, err)
+		return false
+	}
+
+	out := initOut{
+		Major:               kernelVersion,
+		Minor:               min(in.Minor, kernelMinorVersion),
+		MaxReadahead:        uint32(min(resp.Conn.MaxReadahead, int(in.MaxReadahead))),
+		Flags:               toInitFlags(resp.Conn.Want&capable) | initBigWrites&in.Flags,
+		MaxBackground:       uint16(min(max(resp.Conn.MaxBackground, 0), 0xffff)),
+		CongestionThreshold: uint16(min(max(resp.Conn.CongestionThreshold, 0), 0xffff)),
+		MaxWrite:            uint32(max(min(resp.Conn.MaxWrite, maxWrite), 4096)),
+		TimeGran:            uint32(max(resp.Conn.TimeGran, 0)),
+	}
+	c.reply(unique, OK, structBytes(&out))
+	return true
+}
+
+// initCaps maps capabilities to kernel init flags.  Splicing is not supported by this transport,
+// so the splice capabilities are never offered.
+var initCaps = []struct {
+	cap  Capability
+	flag uint32
+}{
+	{CAP_ASYNC_READ, initAsyncRead},
+	{CAP_ATOMIC_O_TRUNC, initAtomicOTrunc},
+	{CAP_EXPORT_SUPPORT, initExportSupport},
+	{CAP_WRITEBACK_CACHE, initWritebackCache},
+	{CAP_PARALLEL_DIROPS, initParallelDirops},
+	{CAP_POSIX_ACL, initPosixACL},
+	{CAP_HANDLE_KILLPRIV, initHandleKillpriv},
+	{CAP_CACHE_SYMLINKS, initCacheSymlinks},
+	{CAP_NO_OPENDIR_SUPPORT, initNoOpendirSupport},
+	{CAP_EXPLICIT_INVAL_DATA, initExplicitInvalData},
+	{CAP_DONT_MASK, initDontMask},
+}
+
+func fromInitFlags(flags uint32) Capability {
+	var caps Capability
+	for _, f := range initCaps {
+		if flags&f.flag != 0 {
+			caps |= f.cap
+		}
+	}
+	return caps
+}
+
+func toInitFlags(caps Capability) uint32 {
+	var flags uint32
+	for _, f := range initCaps {
+		if caps&f.cap != 0 {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// interrupt cancels the context of an active request.
+func (c *conn) interrupt(unique, target uint64) {
+	c.activeLock.Lock()
+	cancel := c.active[target]
+	c.activeLock.Unlock()
+
+	if cancel != nil {
+		cancel()
+		return
+	}
+
+	// The request may not have been registered yet, so ask the kernel to resend the interrupt.
+	// If the request has already been replied to, the kernel ignores this.
+	c.reply(unique, EAGAIN)
+}
+
+// setattrMask holds the setattr valid flags which have the same value in SetAttrMask.
+const setattrMask = SET_ATTR_MODE | SET_ATTR_UID | SET_ATTR_GID | SET_ATTR_SIZE | SET_ATTR_ATIME |
+	SET_ATTR_MTIME | SET_ATTR_ATIME_NOW | SET_ATTR_MTIME_NOW | SET_ATTR_CTIME
+
+func decodeSetAttr(ino int64, s *setattrIn) *SetAttrRequest {
+	mask := SetAttrMask(s.Valid) & setattrMask
+	if s.Valid&fattrKillSuidgid != 0 {
+		mask |= SET_ATTR_KILL_SUID | SET_ATTR_KILL_SGID
+	}
+	var fi *FileInfo
+	if s.Valid&fattrFh != 0 {
+		fi = &FileInfo{Handle: s.Fh, LockOwner: s.LockOwner}
+	}
+
+	uid, gid := int(s.UID), int(s.GID)
+	attr := &InoAttr{
+		Ino:   ino,
+		Size:  int64(s.Size),
+		Mode:  int(s.Mode),
+		UID:   &uid,
+		GID:   &gid,
+		ATime: time.Unix(int64(s.Atime), int64(s.Atimensec)),
+		MTime: time.Unix(int64(s.Mtime), int64(s.Mtimensec)),
+		CTime: time.Unix(int64(s.Ctime), int64(s.Ctimensec)),
+	}
+	return newSetAttrRequest(ino, mask, attr, fi)
+}
+
+// goReplier encodes replies in the kernel wire format.
+type goReplier struct {
+	c      *conn
+	unique uint64
+}
+
+func (g goReplier) err(err Status) Status {
+	return g.c.reply(g.unique, err)
+}
+
+func (g goReplier) none() {}
+
+func (g goReplier) entry(e *Entry) Status {
+	var out entryOut
+	e.toEntryOut(&out)
+	return g.c.reply(g.unique, OK, structBytes(&out))
+}
+
+func (g goReplier) create(e *Entry, o *OpenResponse) Status {
+	var out entryOut
+	e.toEntryOut(&out)
+	open := o.toOpenOut()
+	return g.c.reply(g.unique, OK, structBytes(&out), structBytes(&open))
+}
+
+func (g goReplier) attr(a *InoAttr) Status {
+	var out attrOut
+	out.AttrValid, out.AttrValidNsec = splitTimeout(a.timeout())
+	a.toAttr(&out.Attr)
+	return g.c.reply(g.unique, OK, structBytes(&out))
+}
+
+func (g goReplier) readlink(target string) Status {
+	return g.c.reply(g.unique, OK, []byte(target))
+}
+
+func (g goReplier) open(o *OpenResponse) Status {
+	out := o.toOpenOut()
+	return g.c.reply(g.unique, OK, structBytes(&out))
+}
+
+func (o *OpenResponse) toOpenOut() openOut {
+	out := openOut{Fh: o.Handle}
+	for _, f := range []struct {
+		set  bool
+		flag uint32
+	}{
+		{o.DirectIO, fopenDirectIO},
+		{o.KeepCache, fopenKeepCache},
+		{o.NonSeekable, fopenNonseekable},
+		{o.CacheReaddir, fopenCacheDir},
+		{o.NoFlush, fopenNoflush},
+	} {
+		if f.set {
+			out.OpenFlags |= f.flag
+		}
+	}
+	return out
+}
+
+func (g goReplier) write(n int) Status {
+	out := writeOut{Size: uint32(n)}
+	return g.c.reply(g.unique, OK, structBytes(&out))
+}
+
+func (g goReplier) buf(buf []byte) Status {
+	return g.c.reply(g.unique, OK, buf)
+}
+
+func (g goReplier) statfs(s *StatVFS) Status {
+	out := kstatfs{
+		Blocks:  uint64(s.Blocks),
+		Bfree:   uint64(s.BlocksFree),
+		Bavail:  uint64(s.BlocksAvail),
+		Files:   uint64(s.Files),
+		Ffree:   uint64(s.FilesFree),
+		Bsize:   uint32(s.BlockSize),
+		Namelen: uint32(s.NameMax),
+		Frsize:  uint32(s.fragmentSize()),
+	}
+	return g.c.reply(g.unique, OK, structBytes(&out))
+}
+
+func (g goReplier) xattr(size int) Status {
+	out := getxattrOut{Size: uint32(size)}
+	return g.c.reply(g.unique, OK, structBytes(&out))
+}
+
+func (g goReplier) addDirEntry(buf []byte, name string, ino int64, mode int, next int64) int {
+	size := direntAlign(direntSize + len(name))
+	if size > len(buf) {
+		return size
+	}
+
+	d := (*dirent)(unsafe.Pointer(&buf[0]))
+	d.Ino = uint64(ino)
+	d.Off = uint64(next)
+	d.Namelen = uint32(len(name))
+	d.Type = uint32(mode&syscall.S_IFMT) >> 12
+	n := copy(buf[direntSize:], name)
+	clear(buf[direntSize+n : size])
+	return size
+}
+
+// splitTimeout converts a timeout in seconds to the kernel representation.
+func splitTimeout(t float64) (uint64, uint32) {
+	if t <= 0 {
+		return 0, 0
+	}
+	d := time.Duration(t * float64(time.Second))
+	return uint64(d / time.Second), uint32(d % time.Second)
+}
+
+func (e *Entry) toEntryOut(o *entryOut) {
+	o.EntryValid, o.EntryValidNsec = splitTimeout(e.entryTimeout())
+	if e.IsNegative() {
+		// Only the entry timeout is used for a negative entry.
+		return
+	}
+
+	o.NodeID = uint64(e.Ino)
+	o.Generation = uint64(e.Generation)
+	if o.Generation == 0 {
+		o.Generation = 1 // FUSE doesn't like a 0 generation value.
+	}
+	o.AttrValid, o.AttrValidNsec = splitTimeout(e.attrTimeout())
+	if e.Attr != nil {
+		e.Attr.toAttr(&o.Attr)
+	}
+}
+
+func (a *InoAttr) toAttr(o *attr) {
+	o.Ino = uint64(a.Ino)
+	o.Size = uint64(a.Size)
+	o.Mode = uint32(a.Mode)
+	o.Nlink = uint32(a.NLink)
+	o.Rdev = uint32(a.Rdev)
+	o.Blocks = uint64(a.Blocks)
+	o.Blksize = uint32(a.BlkSize)
+	o.UID = uint32(os.Getuid())
+	if a.UID != nil {
+		o.UID = uint32(*a.UID)
+	}
+	o.GID = uint32(os.Getgid())
+	if a.GID != nil {
+		o.GID = uint32(*a.GID)
+	}
+	o.Atime, o.Atimensec = splitTime(a.ATime)
+	o.Mtime, o.Mtimensec = splitTime(a.MTime)
+	o.Ctime, o.Ctimensec = splitTime(a.CTime)
+}
+
+func splitTime(t time.Time) (uint64, uint32) {
+	return uint64(t.Unix()), uint32(t.Nanosecond())
+}
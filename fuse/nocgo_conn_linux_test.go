@@ -0,0 +1,669 @@
+//go:build !cgo || nocgo
+
+package fuse
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKernel plays the role of the kernel, using a socket which preserves message boundaries in
+// the same way as /dev/fuse.
+type testKernel struct {
+	t      *testing.T
+	fd     int
+	unique uint64
+}
+
+func (k *testKernel) send(op opcode, ino int64, parts ...[]byte) uint64 {
+	k.unique++
+	hdr := inHeader{Opcode: op, Unique: k.unique, NodeID: uint64(ino)}
+	msg := append([]byte{}, structBytes(&hdr)...)
+	for _, p := range parts {
+		msg = append(msg, p...)
+	}
+	(*inHeader)(unsafe.Pointer(&msg[0])).Len = uint32(len(msg))
+
+	_, err := syscall.Write(k.fd, msg)
+	require.NoError(k.t, err)
+	return k.unique
+}
+
+func (k *testKernel) recv(unique uint64) (Status, []byte) {
+	buf := make([]byte, 64*1024)
+	n, err := syscall.Read(k.fd, buf)
+	require.NoError(k.t, err)
+
+	hdr := (*outHeader)(unsafe.Pointer(&buf[0]))
+	require.Equal(k.t, unique, hdr.Unique)
+	require.Equal(k.t, n, int(hdr.Len))
+	return Status(-hdr.Error), buf[unsafe.Sizeof(*hdr):n]
+}
+
+func cstr(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func TestConn(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		require.NoError(t, err)
+		k := &testKernel{t: t, fd: fds[0]}
+
+		c := newConn(newMount(AdaptFileSystem(NewMemFS()), &Options{Async: async}), fds[1])
+		served := make(chan error)
+		go func() {
+			served <- c.serve(1)
+		}()
+
+		// Requests are rejected until the connection is initialized.
+		u := k.send(opStatfs, 1)
+		status, _ := k.recv(u)
+		require.Equal(t, EIO, status)
+		var data []byte
+
+		in := initIn{Major: 7, Minor: 40, MaxReadahead: 4096, Flags: initAsyncRead | 1<<31}
+		u = k.send(opInit, 0, structBytes(&in))
+		status, data = k.recv(u)
+		require.Equal(t, OK, status)
+		out := (*initOut)(unsafe.Pointer(&data[0]))
+		require.EqualValues(t, 7, out.Major)
+		require.EqualValues(t, kernelMinorVersion, out.Minor)
+		require.EqualValues(t, initAsyncRead, out.Flags)
+		require.EqualValues(t, maxWrite, out.MaxWrite)
+
+		mk := mkdirIn{Mode: 0755}
+		u = k.send(opMkdir, 1, structBytes(&mk), cstr("dir"))
+		status, data = k.recv(u)
+		require.Equal(t, OK, status)
+		ent := (*entryOut)(unsafe.Pointer(&data[0]))
+		require.NotZero(t, ent.NodeID)
+		require.EqualValues(t, S_IFDIR, ent.Attr.Mode&syscall.S_IFMT)
+
+		u = k.send(opLookup, 1, cstr("dir"))
+		status, data = k.recv(u)
+		require.Equal(t, OK, status)
+		require.Equal(t, ent.NodeID, (*entryOut)(unsafe.Pointer(&data[0])).NodeID)
+
+		u = k.send(opLookup, 1, cstr("missing"))
+		status, data = k.recv(u)
+		require.Equal(t, ENOENT, status)
+		require.Empty(t, data)
+
+		rd := readIn{Size: 4096}
+		u = k.send(opReaddir, 1, structBytes(&rd))
+		status, data = k.recv(u)
+		require.Equal(t, OK, status)
+		var names []string
+		for len(data) > 0 {
+			d := (*dirent)(unsafe.Pointer(&data[0]))
+			names = append(names, string(data[direntSize:direntSize+int(d.Namelen)]))
+			data = data[direntAlign(direntSize+int(d.Namelen)):]
+		}
+		require.Contains(t, names, "dir")
+
+		u = k.send(opcode(9999), 1)
+		status, _ = k.recv(u)
+		require.Equal(t, ENOSYS, status)
+
+		u = k.send(opDestroy, 0)
+		status, _ = k.recv(u)
+		require.Equal(t, OK, status)
+		require.NoError(t, <-served)
+
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	}
+}
+
+// initFS requests capabilities and settings during Init.
+type initFS struct {
+	FileSystemV2
+	offered ConnInfo
+}
+
+func (fs *initFS) Init(ctx context.Context, req *InitRequest, resp *InitResponse) Status {
+	fs.offered = req.Conn
+	resp.Conn.Want |= CAP_WRITEBACK_CACHE | CAP_POSIX_ACL | CAP_SPLICE_READ
+	resp.Conn.MaxBackground = 64
+	resp.Conn.CongestionThreshold = 48
+	resp.Conn.TimeGran = 1000
+	return OK
+}
+
+func TestConnInit(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	fs := &initFS{FileSystemV2: AdaptFileSystem(NewMemFS())}
+	c := newConn(newMount(fs, nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	// The kernel offers splice reads (1 << 9), which the transport does not support.
+	in := initIn{
+		Major:        7,
+		Minor:        31,
+		MaxReadahead: 4096,
+		Flags:        initAsyncRead | initWritebackCache | initParallelDirops | 1<<9,
+	}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+
+	require.Equal(t, CAP_ASYNC_READ|CAP_WRITEBACK_CACHE|CAP_PARALLEL_DIROPS, fs.offered.Capable)
+	require.Equal(t, CAP_ASYNC_READ, fs.offered.Want)
+
+	// Capabilities which were not offered are not enabled.
+	out := (*initOut)(unsafe.Pointer(&data[0]))
+	require.EqualValues(t, initAsyncRead|initWritebackCache, out.Flags)
+	require.EqualValues(t, 64, out.MaxBackground)
+	require.EqualValues(t, 48, out.CongestionThreshold)
+	require.EqualValues(t, 1000, out.TimeGran)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+// directFS opens files with direct I/O, and records the last released file.
+type directFS struct {
+	*MemFS
+	released *FileInfo
+}
+
+// WithContext keeps the overridden methods, instead of those of the embedded MemFS.
+func (fs *directFS) WithContext(ctx context.Context) FileSystem {
+	return fs
+}
+
+func (fs *directFS) Open(ino int64, fi *FileInfo) Status {
+	fi.Handle = 42
+	fi.DirectIO = true
+	fi.NonSeekable = true
+	return fs.MemFS.Open(ino, fi)
+}
+
+func (fs *directFS) Release(ino int64, fi *FileInfo) Status {
+	fs.released = fi
+	return OK
+}
+
+func TestConnOpen(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	fs := &directFS{MemFS: NewMemFS()}
+	c := newConn(newMount(AdaptFileSystem(fs), nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, OK, status)
+
+	mk := mknodIn{Mode: S_IFREG | 0644}
+	u = k.send(opMknod, 1, structBytes(&mk), cstr("file"))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	ino := int64((*entryOut)(unsafe.Pointer(&data[0])).NodeID)
+
+	op := openIn{Flags: syscall.O_RDONLY}
+	u = k.send(opOpen, ino, structBytes(&op))
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	out := (*openOut)(unsafe.Pointer(&data[0]))
+	require.EqualValues(t, 42, out.Fh)
+	require.EqualValues(t, fopenDirectIO|fopenNonseekable, out.OpenFlags)
+
+	rl := releaseIn{Fh: 42, ReleaseFlags: releaseFlush}
+	u = k.send(opRelease, ino, structBytes(&rl))
+	status, _ = k.recv(u)
+	require.Equal(t, OK, status)
+	require.True(t, fs.released.Flush)
+	require.False(t, fs.released.FlockRelease)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+func TestConnPollHack(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	c := newConn(newMount(AdaptFileSystem(NewMemFS()), nil), fds[1])
+	// Without a mountpoint, the reserved file is not polled by the connection itself, so the
+	// workaround is enabled here instead of with Options.PollWorkaround.
+	c.pollReady = make(chan struct{})
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, OK, status)
+
+	mk := mknodIn{Mode: S_IFREG | 0644}
+	u = k.send(opMknod, 1, structBytes(&mk), cstr("file"))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	ino := int64((*entryOut)(unsafe.Pointer(&data[0])).NodeID)
+
+	// The open is not answered until the reserved file has been polled.
+	op := openIn{Flags: syscall.O_RDONLY}
+	opened := k.send(opOpen, ino, structBytes(&op))
+
+	u = k.send(opLookup, 1, cstr(pollHackName))
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	require.EqualValues(t, uint64(pollHackIno), (*entryOut)(unsafe.Pointer(&data[0])).NodeID)
+
+	u = k.send(opOpen, pollHackIno, structBytes(&op))
+	status, _ = k.recv(u)
+	require.Equal(t, OK, status)
+
+	u = k.send(opPoll, pollHackIno)
+	status, _ = k.recv(u)
+	require.Equal(t, ENOSYS, status)
+
+	close(c.pollReady)
+	status, _ = k.recv(opened)
+	require.Equal(t, OK, status)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+// failFS fails to initialize.
+type failFS struct {
+	DefaultFileSystemV2
+	destroyed bool
+}
+
+func (fs *failFS) Init(ctx context.Context, req *InitRequest, resp *InitResponse) Status {
+	return ENODEV
+}
+
+func (fs *failFS) Destroy(ctx context.Context) {
+	fs.destroyed = true
+}
+
+func TestConnInitFailure(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	fs := &failFS{}
+	c := newConn(newMount(fs, nil), fds[1])
+	stopped := false
+	c.stop = func() { stopped = true }
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, ENODEV, status)
+
+	err = <-served
+	require.ErrorIs(t, err, syscall.ENODEV)
+	require.True(t, stopped)
+	require.False(t, fs.destroyed)
+}
+
+// negativeFS caches lookups of missing names.
+type negativeFS struct {
+	DefaultFileSystemV2
+}
+
+func (n *negativeFS) Lookup(ctx context.Context, req *LookupRequest, resp *EntryResponse) Status {
+	resp.Entry = *NegativeEntry(2.5)
+	return OK
+}
+
+func TestConnNegativeEntry(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	c := newConn(newMount(&negativeFS{}, nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, OK, status)
+
+	u = k.send(opLookup, 1, cstr("missing"))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	out := (*entryOut)(unsafe.Pointer(&data[0]))
+	require.Equal(t, entryOut{EntryValid: 2, EntryValidNsec: 5e8}, *out)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+// statFS reports every field of the attributes and filesystem statistics.
+type statFS struct {
+	DefaultFileSystemV2
+}
+
+func (s *statFS) GetAttr(ctx context.Context, req *GetAttrRequest, resp *AttrResponse) Status {
+	resp.Attr = InoAttr{
+		Ino:     req.Ino,
+		Mode:    syscall.S_IFCHR | 0600,
+		NLink:   1,
+		Rdev:    0x0103,
+		Blocks:  8,
+		BlkSize: 4096,
+		Timeout: 1,
+		TTL:     1500 * time.Millisecond,
+	}
+	return OK
+}
+
+func (s *statFS) StatFS(ctx context.Context, req *StatFSRequest, resp *StatFSResponse) Status {
+	resp.Stat = StatVFS{
+		BlockSize:   4096,
+		Blocks:      100,
+		BlocksFree:  50,
+		BlocksAvail: 40,
+		Files:       10,
+		FilesFree:   5,
+		NameMax:     255,
+	}
+	return OK
+}
+
+func TestConnDontMask(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	c := newConn(newMount(AdaptFileSystem(NewMemFS()), nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31, Flags: initPosixACL | initDontMask}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	out := (*initOut)(unsafe.Pointer(&data[0]))
+	require.EqualValues(t, initPosixACL|initDontMask, out.Flags)
+
+	// The umask is applied by MemFS, as the parent has no default ACL.
+	mk := mkdirIn{Mode: 0o777, Umask: 0o022}
+	u = k.send(opMkdir, 1, structBytes(&mk), cstr("dir"))
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	require.EqualValues(t, S_IFDIR|0o755, (*entryOut)(unsafe.Pointer(&data[0])).Attr.Mode)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+func TestConnStat(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	c := newConn(newMount(&statFS{}, nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, OK, status)
+
+	u = k.send(opGetattr, 2, structBytes(&getattrIn{}))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	out := (*attrOut)(unsafe.Pointer(&data[0]))
+	require.EqualValues(t, 1, out.AttrValid)
+	require.EqualValues(t, 5e8, out.AttrValidNsec)
+	require.EqualValues(t, 0x0103, out.Attr.Rdev)
+	require.EqualValues(t, 8, out.Attr.Blocks)
+	require.EqualValues(t, 4096, out.Attr.Blksize)
+
+	u = k.send(opStatfs, 1)
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	st := (*kstatfs)(unsafe.Pointer(&data[0]))
+	require.EqualValues(t, 50, st.Bfree)
+	require.EqualValues(t, 40, st.Bavail)
+	require.EqualValues(t, 4096, st.Frsize)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+// lookupFS only implements Lookup.
+type lookupFS struct{}
+
+func (l *lookupFS) Lookup(ctx context.Context, req *LookupRequest, resp *EntryResponse) Status {
+	return ENOENT
+}
+
+func TestConnPartialFileSystem(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	c := newConn(newMount(&lookupFS{}, nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, OK, status)
+
+	u = k.send(opLookup, 1, cstr("missing"))
+	status, _ = k.recv(u)
+	require.Equal(t, ENOENT, status)
+
+	// Operations which are not implemented are answered in the same way as libfuse.
+	u = k.send(opGetattr, 1, structBytes(&getattrIn{}))
+	status, _ = k.recv(u)
+	require.Equal(t, ENOSYS, status)
+
+	u = k.send(opOpen, 1, structBytes(&openIn{}))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	require.Zero(t, (*openOut)(unsafe.Pointer(&data[0])).Fh)
+
+	u = k.send(opStatfs, 1)
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	require.EqualValues(t, 512, (*kstatfs)(unsafe.Pointer(&data[0])).Bsize)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+// exportFS is an exported filesystem, where directory 2 is in the root.  Inode 3 no longer exists,
+// and inode 4 is returned without a generation.
+type exportFS struct{}
+
+func (e *exportFS) Lookup(ctx context.Context, req *LookupRequest, resp *EntryResponse) Status {
+	resp.Entry = Entry{Ino: 4}
+	return OK
+}
+
+func (e *exportFS) ResolveInode(ctx context.Context, req *ResolveRequest,
+	resp *EntryResponse,
+) Status {
+	if req.Ino == 3 {
+		return ESTALE
+	}
+	resp.Entry = Entry{Ino: req.Ino, Generation: 7}
+	return OK
+}
+
+func (e *exportFS) ResolveParent(ctx context.Context, req *ResolveRequest,
+	resp *EntryResponse,
+) Status {
+	resp.Entry = Entry{Ino: 1, Generation: 7}
+	return OK
+}
+
+func TestConnExport(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	c := newConn(newMount(&exportFS{}, nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31, Flags: initExportSupport}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	require.EqualValues(t, initExportSupport, (*initOut)(unsafe.Pointer(&data[0])).Flags)
+
+	u = k.send(opLookup, 2, cstr("."))
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	ent := (*entryOut)(unsafe.Pointer(&data[0]))
+	require.EqualValues(t, 2, ent.NodeID)
+	require.EqualValues(t, 7, ent.Generation)
+
+	u = k.send(opLookup, 2, cstr(".."))
+	status, data = k.recv(u)
+	require.Equal(t, OK, status)
+	require.EqualValues(t, 1, (*entryOut)(unsafe.Pointer(&data[0])).NodeID)
+
+	u = k.send(opLookup, 3, cstr("."))
+	status, _ = k.recv(u)
+	require.Equal(t, ESTALE, status)
+
+	u = k.send(opLookup, 1, cstr("file"))
+	status, _ = k.recv(u)
+	require.Equal(t, EIO, status)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
+
+func TestDecodeSetAttr(t *testing.T) {
+	in := decodeSetAttr(2, &setattrIn{
+		Valid: uint32(SET_ATTR_UID|SET_ATTR_CTIME) | fattrFh | fattrKillSuidgid,
+		Fh:    9,
+		UID:   5,
+		GID:   6,
+		Ctime: 100,
+	})
+	require.Equal(t, 5, *in.UID)
+	require.Nil(t, in.GID)
+	require.Equal(t, time.Unix(100, 0), *in.CTime)
+	require.True(t, in.KillSUID)
+	require.True(t, in.KillSGID)
+	require.EqualValues(t, 9, in.File.Handle)
+}
+
+func TestConnLookupCounts(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	k := &testKernel{t: t, fd: fds[0]}
+
+	fs := NewMemFS()
+	c := newConn(newMount(AdaptFileSystem(fs), nil), fds[1])
+	served := make(chan error)
+	go func() {
+		served <- c.serve(1)
+	}()
+
+	in := initIn{Major: 7, Minor: 31}
+	u := k.send(opInit, 0, structBytes(&in))
+	status, _ := k.recv(u)
+	require.Equal(t, OK, status)
+
+	mk := mkdirIn{Mode: 0o755}
+	u = k.send(opMkdir, 1, structBytes(&mk), cstr("dir"))
+	status, data := k.recv(u)
+	require.Equal(t, OK, status)
+	ino := int64((*entryOut)(unsafe.Pointer(&data[0])).NodeID)
+
+	u = k.send(opLookup, 1, cstr("dir"))
+	status, _ = k.recv(u)
+	require.Equal(t, OK, status)
+	require.EqualValues(t, 2, fs.inodes.Lookups(ino))
+
+	// The removed directory remains until the kernel forgets it.
+	u = k.send(opRmdir, 1, cstr("dir"))
+	status, _ = k.recv(u)
+	require.Equal(t, OK, status)
+	u = k.send(opGetattr, ino, structBytes(&getattrIn{}))
+	status, _ = k.recv(u)
+	require.Equal(t, OK, status)
+
+	k.send(opForget, ino, structBytes(&forgetIn{Nlookup: 1}))
+	bf := batchForgetIn{Count: 1}
+	one := forgetOne{NodeID: uint64(ino), Nlookup: 1}
+	k.send(opBatchForget, 0, structBytes(&bf), structBytes(&one))
+	u = k.send(opGetattr, ino, structBytes(&getattrIn{}))
+	status, _ = k.recv(u)
+	require.Equal(t, ENOENT, status)
+
+	u = k.send(opDestroy, 0)
+	k.recv(u)
+	require.NoError(t, <-served)
+}
@@ -0,0 +1,291 @@
+//go:build !cgo || nocgo
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Version returns the version number from the linked libfuse client implementation.
+//
+// The pure Go transport does not use libfuse, so this always returns 0.
+func Version() int {
+	return 0
+}
+
+// MountAndRunV2 mounts a FileSystemV2 and serves it until the filesystem is unmounted.
+// If opts is nil, the default options are used.  See MountAndRun for details.
+//
+// This is the pure Go transport, which speaks the kernel protocol over /dev/fuse.  The
+// filesystem is mounted with mount(2) when running as root, and otherwise with fusermount3.  The
+// supported arguments are the mountpoint, -o with a comma separated list of mount options, and
+// -h.  The -f, -s and -d flags are accepted for compatibility with libfuse, but the process is
+// never daemonized.
+//
+// The filesystem may implement any subset of the operation interfaces, such as Lookuper, instead
+// of the complete FileSystemV2.  Unsupported operations are answered in the same way as libfuse.
+// A FileSystem is served through AdaptFileSystem.
+//
+// Errors, including a failed Init, are printed.  Use MountAndServe to handle them instead.
+func MountAndRunV2(args []string, fs any, opts *Options) int {
+	if err := MountAndServe(args, fs, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// MountAndServe is like MountAndRunV2, but returns an error instead of an exit status.  If Init
+// fails, the returned error wraps the Status which it returned.
+func MountAndServe(args []string, fs any, opts *Options) error {
+	ma, err := parseMountArgs(args)
+	if err != nil {
+		printUsage(args)
+		return err
+	}
+	if ma.help {
+		printUsage(args)
+		return nil
+	}
+
+	fd, err := mountFUSE(ma.mountpoint, ma.options)
+	if err != nil {
+		return fmt.Errorf("mount failed: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	// Unmount on the signals handled by libfuse, which ends the session.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stop := make(chan struct{})
+	defer func() {
+		signal.Stop(sigs)
+		close(stop)
+	}()
+	go func() {
+		select {
+		case <-sigs:
+			unmountFUSE(ma.mountpoint)
+		case <-stop:
+		}
+	}()
+
+	m := newMount(fs, opts)
+	workers := m.opts.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	c := newConn(m, fd)
+	c.stop = func() { unmountFUSE(ma.mountpoint) }
+	if m.opts.PollWorkaround {
+		c.startPollHack(ma.mountpoint)
+	}
+	err = c.serve(workers)
+	unmountFUSE(ma.mountpoint)
+	return err
+}
+
+// mountArgs holds the parsed command line arguments.
+type mountArgs struct {
+	mountpoint string
+	options    []string
+	help       bool
+}
+
+func parseMountArgs(args []string) (*mountArgs, error) {
+	ma := &mountArgs{}
+	if len(args) < 2 {
+		ma.help = true
+		return ma, nil
+	}
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-h" || arg == "--help":
+			ma.help = true
+		case arg == "-f" || arg == "-s":
+			// Always in the foreground, and the number of workers is set with Options.
+		case arg == "-d":
+			ma.options = append(ma.options, "debug")
+		case arg == "-o":
+			if i+1 == len(args) {
+				return nil, errors.New("missing argument after -o")
+			}
+			i++
+			ma.options = append(ma.options, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(arg, "-o"):
+			ma.options = append(ma.options, strings.Split(arg[2:], ",")...)
+		case strings.HasPrefix(arg, "-"):
+			return nil, fmt.Errorf("unknown option %q", arg)
+		case ma.mountpoint == "":
+			ma.mountpoint = arg
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+
+	if ma.mountpoint == "" && !ma.help {
+		return nil, errors.New("no mountpoint specified")
+	}
+	return ma, nil
+}
+
+func printUsage(args []string) {
+	name := "fuse"
+	if len(args) > 0 {
+		name = filepath.Base(args[0])
+	}
+	fmt.Printf("usage: %s [options] <mountpoint>\n\n", name)
+	fmt.Printf("    -h   --help            print help\n")
+	fmt.Printf("    -o opt,[opt...]        mount options\n")
+}
+
+// mountFUSE mounts a FUSE filesystem, and returns the file descriptor of the connection.
+func mountFUSE(mountpoint string, options []string) (int, error) {
+	if os.Geteuid() == 0 {
+		fd, err := mountDirect(mountpoint, options)
+		if err == nil {
+			return fd, nil
+		}
+	}
+	return mountFusermount(mountpoint, options)
+}
+
+// Generic mount options, which are passed to mount(2) as flags.
+var mountFlags = map[string]uintptr{
+	"ro":         syscall.MS_RDONLY,
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"sync":       syscall.MS_SYNCHRONOUS,
+	"dirsync":    syscall.MS_DIRSYNC,
+}
+
+// mountDirect mounts the filesystem with mount(2), which requires privileges.
+func mountDirect(mountpoint string, options []string) (int, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &st); err != nil {
+		return -1, err
+	}
+
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	source, fstype := "fuse", "fuse"
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	data := []string{
+		"fd=" + strconv.Itoa(fd),
+		"rootmode=" + strconv.FormatUint(uint64(st.Mode&syscall.S_IFMT), 8),
+		"user_id=" + strconv.Itoa(os.Getuid()),
+		"group_id=" + strconv.Itoa(os.Getgid()),
+	}
+	for _, opt := range options {
+		name, value, _ := strings.Cut(opt, "=")
+		switch {
+		case opt == "" || opt == "rw" || opt == "debug":
+		case name == "fsname":
+			source = value
+		case name == "subtype":
+			fstype = "fuse." + value
+		case mountFlags[opt] != 0:
+			flags |= mountFlags[opt]
+		default:
+			data = append(data, opt)
+		}
+	}
+
+	err = syscall.Mount(source, mountpoint, fstype, flags, strings.Join(data, ","))
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// fusermountPath returns the path of the fusermount helper.
+func fusermountPath() (string, error) {
+	path, err := exec.LookPath("fusermount3")
+	if err != nil {
+		path, err = exec.LookPath("fusermount")
+	}
+	return path, err
+}
+
+// mountFusermount mounts the filesystem with the setuid fusermount helper, which passes the
+// connection back over a socket.
+func mountFusermount(mountpoint string, options []string) (int, error) {
+	helper, err := fusermountPath()
+	if err != nil {
+		return -1, err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	defer remote.Close()
+
+	var args []string
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, "--", mountpoint)
+	cmd := exec.Command(helper, args...)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return -1, fmt.Errorf("%s: %w", helper, err)
+	}
+
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(fds[0], buf, oob, 0)
+	if err != nil {
+		return -1, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return -1, fmt.Errorf("%s: no file descriptor received", helper)
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) == 0 {
+		return -1, fmt.Errorf("%s: no file descriptor received", helper)
+	}
+	syscall.CloseOnExec(rights[0])
+	return rights[0], nil
+}
+
+// unmountFUSE unmounts the filesystem, if it is still mounted.
+func unmountFUSE(mountpoint string) {
+	if os.Geteuid() == 0 {
+		if err := syscall.Unmount(mountpoint, syscall.MNT_DETACH); err == nil {
+			return
+		}
+	}
+
+	helper, err := fusermountPath()
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(helper, "-u", "-q", "-z", "--", mountpoint)
+	_ = cmd.Run()
+}
@@ -0,0 +1,33 @@
+//go:build (!cgo || nocgo) && !linux
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Version returns the version number from the linked libfuse client implementation.
+//
+// The pure Go transport does not use libfuse, so this always returns 0.
+func Version() int {
+	return 0
+}
+
+// MountAndRunV2 mounts a FileSystemV2 and enters the Fuse event loop.
+//
+// The pure Go transport is only available on Linux, so this always fails on other systems.
+func MountAndRunV2(args []string, fs any, opts *Options) int {
+	fmt.Fprintln(os.Stderr, errUnsupported)
+	return 1
+}
+
+// MountAndServe is like MountAndRunV2, but returns an error instead of an exit status.
+//
+// The pure Go transport is only available on Linux, so this always fails on other systems.
+func MountAndServe(args []string, fs any, opts *Options) error {
+	return errUnsupported
+}
+
+var errUnsupported = errors.New("the pure Go FUSE transport is only supported on Linux")
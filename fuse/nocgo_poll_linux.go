@@ -0,0 +1,130 @@
+//go:build !cgo || nocgo
+
+package fuse
+
+import (
+	"bytes"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// The Go runtime adds every file it opens to its epoll set, which makes the kernel send a poll
+// request for a file on a FUSE mount.  The epoll_ctl call does not release the P of the calling
+// goroutine, so when the filesystem is used by the process which serves it, with GOMAXPROCS=1,
+// no worker can run to reply and the process deadlocks.
+//
+// Once a poll request has been answered with ENOSYS, the kernel no longer sends them.  So with
+// Options.PollWorkaround, a reserved file is opened and polled after mounting, and opens of other
+// files are held back until this is done.  The same workaround is used by go-fuse.
+//
+// Creates cannot be held back, as they lock the directory in which the reserved file is looked
+// up, so a file created before the reserved file has been polled is not covered.
+const (
+	// pollHackName is the name of the reserved file, in the root directory.
+	pollHackName = ".go-fuse-c-poll-hack"
+
+	// pollHackIno is the inode of the reserved file.
+	pollHackIno = 1<<63 - 1
+)
+
+// startPollHack opens and polls the reserved file in the background, after which opens are
+// served.
+func (c *conn) startPollHack(mountpoint string) {
+	c.pollReady = make(chan struct{})
+	go func() {
+		defer close(c.pollReady)
+		// Errors are ignored, as they only mean that the session has already ended.
+		_ = pollHack(filepath.Join(mountpoint, pollHackName))
+	}()
+}
+
+// pollHack opens path and adds it to an epoll set, which sends a poll request to the filesystem.
+// Unlike the Go runtime, the P is released while the request is served.
+func pollHack(path string) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+
+	// syscall.EpollCtl is a raw system call as well, so it cannot be used here.
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	_, _, errno := syscall.Syscall6(syscall.SYS_EPOLL_CTL, uintptr(epfd),
+		uintptr(syscall.EPOLL_CTL_ADD), uintptr(fd), uintptr(unsafe.Pointer(&ev)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// servePollHack replies to a request for the reserved file.  Returns false if the request is for
+// another file, or the workaround is not used.
+func (c *conn) servePollHack(op opcode, unique uint64, ino int64, body []byte) bool {
+	if c.pollReady == nil {
+		return false
+	}
+	if op == opLookup && ino == 1 {
+		name, _, ok := parseName(body)
+		if !ok || name != pollHackName {
+			return false
+		}
+		out := entryOut{NodeID: pollHackIno, Generation: 1}
+		pollHackAttr().toAttr(&out.Attr)
+		c.reply(unique, OK, structBytes(&out))
+		return true
+	}
+	if ino != pollHackIno {
+		return false
+	}
+
+	switch op {
+	case opGetattr:
+		var out attrOut
+		pollHackAttr().toAttr(&out.Attr)
+		c.reply(unique, OK, structBytes(&out))
+	case opOpen:
+		var out openOut
+		c.reply(unique, OK, structBytes(&out))
+	case opFlush, opRelease:
+		c.reply(unique, OK)
+	case opForget:
+		// Forget has no reply.
+	default:
+		c.reply(unique, ENOSYS)
+	}
+	return true
+}
+
+func pollHackAttr() *InoAttr {
+	return &InoAttr{Ino: pollHackIno, Mode: S_IFREG | 0o444, NLink: 1}
+}
+
+// deferOpen holds back an open until the reserved file has been polled.  Returns true if the
+// request will be served later.
+func (c *conn) deferOpen(op opcode, unique uint64, ino int64, caller *Caller, body []byte) bool {
+	if op != opOpen || c.pollReady == nil {
+		return false
+	}
+	select {
+	case <-c.pollReady:
+		return false
+	default:
+	}
+
+	// The request buffer is reused by the worker.
+	body = bytes.Clone(body)
+	go func() {
+		<-c.pollReady
+		if !c.decode(op, unique, ino, caller, body) {
+			c.reply(unique, EINVAL)
+		}
+	}()
+	return true
+}
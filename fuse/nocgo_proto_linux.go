@@ -0,0 +1,353 @@
+//go:build !cgo || nocgo
+
+package fuse
+
+import "unsafe"
+
+// Kernel FUSE wire protocol, as defined in linux/fuse.h.  Structures are sent in native byte
+// order, and the Go definitions below match the kernel layout.
+
+const (
+	kernelVersion      = 7
+	kernelMinorVersion = 31
+)
+
+type opcode uint32
+
+const (
+	opLookup      opcode = 1
+	opForget      opcode = 2
+	opGetattr     opcode = 3
+	opSetattr     opcode = 4
+	opReadlink    opcode = 5
+	opSymlink     opcode = 6
+	opMknod       opcode = 8
+	opMkdir       opcode = 9
+	opUnlink      opcode = 10
+	opRmdir       opcode = 11
+	opRename      opcode = 12
+	opLink        opcode = 13
+	opOpen        opcode = 14
+	opRead        opcode = 15
+	opWrite       opcode = 16
+	opStatfs      opcode = 17
+	opRelease     opcode = 18
+	opFsync       opcode = 20
+	opSetxattr    opcode = 21
+	opGetxattr    opcode = 22
+	opListxattr   opcode = 23
+	opRemovexattr opcode = 24
+	opFlush       opcode = 25
+	opInit        opcode = 26
+	opOpendir     opcode = 27
+	opReaddir     opcode = 28
+	opReleasedir  opcode = 29
+	opFsyncdir    opcode = 30
+	opAccess      opcode = 34
+	opCreate      opcode = 35
+	opInterrupt   opcode = 36
+	opDestroy     opcode = 38
+	opPoll        opcode = 40
+	opBatchForget opcode = 42
+	opRename2     opcode = 45
+)
+
+// Init flags.
+const (
+	initAsyncRead         = 1 << 0
+	initAtomicOTrunc      = 1 << 3
+	initExportSupport     = 1 << 4
+	initBigWrites         = 1 << 5
+	initDontMask          = 1 << 6
+	initWritebackCache    = 1 << 16
+	initParallelDirops    = 1 << 18
+	initHandleKillpriv    = 1 << 19
+	initPosixACL          = 1 << 20
+	initCacheSymlinks     = 1 << 23
+	initNoOpendirSupport  = 1 << 24
+	initExplicitInvalData = 1 << 25
+)
+
+// Setattr valid flags, which are not part of SetAttrMask.
+const (
+	fattrFh          = 1 << 6
+	fattrKillSuidgid = 1 << 11
+)
+
+// Open flags.
+const (
+	fopenDirectIO    = 1 << 0
+	fopenKeepCache   = 1 << 1
+	fopenNonseekable = 1 << 2
+	fopenCacheDir    = 1 << 3
+	fopenNoflush     = 1 << 5
+)
+
+// Release flags.
+const (
+	releaseFlush       = 1 << 0
+	releaseFlockUnlock = 1 << 1
+)
+
+// Getattr flags.
+const (
+	getattrFh = 1 << 0
+)
+
+type inHeader struct {
+	Len     uint32
+	Opcode  opcode
+	Unique  uint64
+	NodeID  uint64
+	UID     uint32
+	GID     uint32
+	PID     uint32
+	Padding uint32
+}
+
+type outHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type initIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type initOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	MapAlignment        uint16
+	Unused              [8]uint32
+}
+
+type attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	UID       uint32
+	GID       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Padding   uint32
+}
+
+type entryOut struct {
+	NodeID         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           attr
+}
+
+type attrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          attr
+}
+
+type forgetIn struct {
+	Nlookup uint64
+}
+
+type batchForgetIn struct {
+	Count uint32
+	Dummy uint32
+}
+
+type forgetOne struct {
+	NodeID  uint64
+	Nlookup uint64
+}
+
+type getattrIn struct {
+	GetattrFlags uint32
+	Dummy        uint32
+	Fh           uint64
+}
+
+type setattrIn struct {
+	Valid     uint32
+	Padding   uint32
+	Fh        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Unused4   uint32
+	UID       uint32
+	GID       uint32
+	Unused5   uint32
+}
+
+type mknodIn struct {
+	Mode    uint32
+	Rdev    uint32
+	Umask   uint32
+	Padding uint32
+}
+
+type mkdirIn struct {
+	Mode  uint32
+	Umask uint32
+}
+
+type renameIn struct {
+	Newdir uint64
+}
+
+type rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+}
+
+type linkIn struct {
+	Oldnodeid uint64
+}
+
+type openIn struct {
+	Flags  uint32
+	Unused uint32
+}
+
+type openOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+type createIn struct {
+	Flags   uint32
+	Mode    uint32
+	Umask   uint32
+	Padding uint32
+}
+
+type releaseIn struct {
+	Fh           uint64
+	Flags        uint32
+	ReleaseFlags uint32
+	LockOwner    uint64
+}
+
+type flushIn struct {
+	Fh        uint64
+	Unused    uint32
+	Padding   uint32
+	LockOwner uint64
+}
+
+type readIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+type writeIn struct {
+	Fh         uint64
+	Offset     uint64
+	Size       uint32
+	WriteFlags uint32
+	LockOwner  uint64
+	Flags      uint32
+	Padding    uint32
+}
+
+type writeOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+type kstatfs struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+type fsyncIn struct {
+	Fh         uint64
+	FsyncFlags uint32
+	Padding    uint32
+}
+
+type setxattrIn struct {
+	Size  uint32
+	Flags uint32
+}
+
+type getxattrIn struct {
+	Size    uint32
+	Padding uint32
+}
+
+type getxattrOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+type accessIn struct {
+	Mask    uint32
+	Padding uint32
+}
+
+type interruptIn struct {
+	Unique uint64
+}
+
+type dirent struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+const direntSize = int(unsafe.Sizeof(dirent{}))
+
+// direntAlign rounds n up to the alignment of directory entries.
+func direntAlign(n int) int {
+	return (n + 7) &^ 7
+}
+
+// structBytes returns the memory of a protocol structure as a byte slice.
+func structBytes[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
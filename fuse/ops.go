@@ -0,0 +1,349 @@
+package fuse
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Handlers for each operation, shared by the FUSE transports.  Each transport decodes the
+// request, and then serves it with the corresponding handler.
+
+func handleStatFS(r *request, in *StatFSRequest) {
+	var resp StatFSResponse
+	if err := r.m.fs.(StatFSer).StatFS(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyStatFS(&resp.Stat)
+}
+
+func handleLookup(r *request, in *LookupRequest) {
+	var resp EntryResponse
+	if err := lookup(r, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	replyNewEntry(r, &resp.Entry)
+}
+
+// lookup passes lookups of "." and ".." to an Exporter, and other names to the Lookuper.
+func lookup(r *request, in *LookupRequest, resp *EntryResponse) Status {
+	fs, ok := r.m.fs.(Exporter)
+	switch {
+	case ok && in.Name == ".":
+		err := fs.ResolveInode(r.ctx, &ResolveRequest{Ino: in.Parent}, resp)
+		if err == OK && resp.Entry.Ino != in.Parent {
+			discardEntry(r, &resp.Entry)
+			return ESTALE
+		}
+		return err
+	case ok && in.Name == "..":
+		return fs.ResolveParent(r.ctx, &ResolveRequest{Ino: in.Parent}, resp)
+	default:
+		return r.m.fs.(Lookuper).Lookup(r.ctx, in, resp)
+	}
+}
+
+// replyNewEntry replies with an entry, which gives the kernel a new lookup reference.  If the
+// reply fails, for example because the request was interrupted, the filesystem is told that the
+// reference was dropped so that lookup counts stay balanced.
+func replyNewEntry(r *request, e *Entry) {
+	if err := checkEntry(r, e); err != OK {
+		discardEntry(r, e)
+		r.replyErr(err)
+		return
+	}
+	addLookup(r, e)
+	if r.replyEntry(e) != OK {
+		forgetEntry(r, e)
+	}
+}
+
+// checkEntry enforces the rules for entries from an Exporter, which must have a generation.
+func checkEntry(r *request, e *Entry) Status {
+	if r.m.export && e.Ino != 0 && e.Generation == 0 {
+		slog.Error("entry without a generation from an exported filesystem", "op", r.op,
+			"ino", e.Ino)
+		return EIO
+	}
+	return OK
+}
+
+// addLookup counts the lookup reference for an entry, if the filesystem has a LookupCounter.
+// The reference is counted before the reply is sent, so that it cannot race with a Forget.
+func addLookup(r *request, e *Entry) {
+	if r.m.lookups != nil && e.Ino != 0 {
+		r.m.lookups.AddLookup(e.Ino)
+	}
+}
+
+// forgetEntry drops the lookup reference for an entry which did not reach the kernel.
+func forgetEntry(r *request, e *Entry) {
+	if e.Ino != 0 {
+		forget(r.m, r.m.ctx, &ForgetRequest{Ino: e.Ino, N: 1})
+	}
+}
+
+// discardEntry drops the lookup reference for an entry from the filesystem which is not sent to
+// the kernel.
+func discardEntry(r *request, e *Entry) {
+	addLookup(r, e)
+	forgetEntry(r, e)
+}
+
+// forget drops lookup references from the LookupCounter, and then tells the filesystem.
+func forget(m *mount, ctx context.Context, in *ForgetRequest) {
+	if m.lookups != nil {
+		m.lookups.ForgetLookups(in.Ino, in.N)
+	}
+	if fs, ok := m.fs.(Forgetter); ok {
+		fs.Forget(ctx, in)
+	}
+}
+
+func handleForget(r *request, in *ForgetRequest) {
+	forget(r.m, r.ctx, in)
+	r.replyNone()
+}
+
+// handleForgetMulti handles a batch of Forget requests, which has a single reply.
+func handleForgetMulti(r *request, in []*ForgetRequest) {
+	for _, f := range in {
+		forget(r.m, r.ctx, f)
+	}
+	r.replyNone()
+}
+
+func handleGetAttr(r *request, in *GetAttrRequest) {
+	var resp AttrResponse
+	if err := r.m.fs.(GetAttrer).GetAttr(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyAttr(&resp.Attr)
+}
+
+func handleSetAttr(r *request, in *SetAttrRequest) {
+	var resp AttrResponse
+	if err := r.m.fs.(SetAttrer).SetAttr(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyAttr(&resp.Attr)
+}
+
+func handleReadLink(r *request, in *ReadLinkRequest) {
+	var resp ReadLinkResponse
+	if err := r.m.fs.(ReadLinker).ReadLink(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyReadlink(resp.Target)
+}
+
+func handleMknod(r *request, in *MknodRequest) {
+	var resp EntryResponse
+	if err := r.m.fs.(Mknoder).Mknod(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	replyNewEntry(r, &resp.Entry)
+}
+
+func handleMkdir(r *request, in *MkdirRequest) {
+	var resp EntryResponse
+	if err := r.m.fs.(Mkdirer).Mkdir(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	replyNewEntry(r, &resp.Entry)
+}
+
+func handleUnlink(r *request, in *UnlinkRequest) {
+	r.replyErr(r.m.fs.(Unlinker).Unlink(r.ctx, in))
+}
+
+func handleRmdir(r *request, in *RmdirRequest) {
+	r.replyErr(r.m.fs.(Rmdirer).Rmdir(r.ctx, in))
+}
+
+func handleSymlink(r *request, in *SymlinkRequest) {
+	var resp EntryResponse
+	if err := r.m.fs.(Symlinker).Symlink(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	replyNewEntry(r, &resp.Entry)
+}
+
+func handleRename(r *request, in *RenameRequest) {
+	r.replyErr(r.m.fs.(Renamer).Rename(r.ctx, in))
+}
+
+func handleLink(r *request, in *LinkRequest) {
+	var resp EntryResponse
+	if err := r.m.fs.(Linker).Link(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	replyNewEntry(r, &resp.Entry)
+}
+
+func handleOpen(r *request, in *OpenRequest) {
+	var resp OpenResponse
+	if err := r.m.fs.(Opener).Open(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	if r.replyOpen(&resp) != OK {
+		// The file was not opened by the kernel, so tell filesystem that it was closed.
+		releaseFile(r, in.Ino, in.Flags, resp.Handle)
+	}
+}
+
+// releaseFile closes a file which did not reach the kernel.
+func releaseFile(r *request, ino int64, flags int, handle uint64) {
+	if fs, ok := r.m.fs.(Releaser); ok {
+		fs.Release(r.m.ctx, &ReleaseRequest{
+			Ino:  ino,
+			File: &FileInfo{Flags: flags, Handle: handle},
+		})
+	}
+}
+
+func handleRead(r *request, in *ReadRequest) {
+	var resp ReadResponse
+	if err := r.m.fs.(Reader).Read(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyBuf(resp.Data)
+}
+
+func handleWrite(r *request, in *WriteRequest) {
+	var resp WriteResponse
+	if err := r.m.fs.(Writer).Write(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyWrite(resp.Written)
+}
+
+func handleFlush(r *request, in *FlushRequest) {
+	r.replyErr(r.m.fs.(Flusher).Flush(r.ctx, in))
+}
+
+func handleRelease(r *request, in *ReleaseRequest) {
+	r.replyErr(r.m.fs.(Releaser).Release(r.ctx, in))
+}
+
+func handleFSync(r *request, in *FSyncRequest) {
+	r.replyErr(r.m.fs.(FSyncer).FSync(r.ctx, in))
+}
+
+func handleOpenDir(r *request, in *OpenRequest) {
+	var resp OpenResponse
+	if err := r.m.fs.(DirOpener).OpenDir(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	if r.replyOpen(&resp) != OK {
+		// The directory was not opened by the kernel, so tell filesystem that it was closed.
+		if fs, ok := r.m.fs.(DirReleaser); ok {
+			fs.ReleaseDir(r.m.ctx, &ReleaseRequest{
+				Ino:  in.Ino,
+				File: &FileInfo{Flags: in.Flags, Handle: resp.Handle},
+			})
+		}
+	}
+}
+
+func handleReadDir(r *request, in *ReadDirRequest) {
+	db := newDirBuf(r.out, in.Size)
+	if fs, ok := r.m.fs.(DirLister); ok {
+		resp := ListDirResponse{Parent: in.Ino}
+		if err := fs.ListDir(r.ctx, &ListDirRequest{Ino: in.Ino, File: in.File}, &resp); err != OK {
+			r.replyErr(err)
+			return
+		}
+		if resp.Entries != nil {
+			WriteDir(db, in.Offset, in.Ino, resp.Parent, resp.Entries)
+		}
+		r.replyBuf(db.buf)
+		return
+	}
+
+	if err := r.m.fs.(DirReader).ReadDir(r.ctx, in, &ReadDirResponse{db}); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyBuf(db.buf)
+}
+
+func handleReleaseDir(r *request, in *ReleaseRequest) {
+	r.replyErr(r.m.fs.(DirReleaser).ReleaseDir(r.ctx, in))
+}
+
+func handleFSyncDir(r *request, in *FSyncRequest) {
+	r.replyErr(r.m.fs.(DirFSyncer).FSyncDir(r.ctx, in))
+}
+
+func handleSetXAttr(r *request, in *SetXAttrRequest) {
+	r.replyErr(r.m.fs.(XAttrSetter).SetXAttr(r.ctx, in))
+}
+
+// handleGetXAttr replies with an attribute value.  A size of zero is a query for the size of the
+// value.
+func handleGetXAttr(r *request, in *GetXAttrRequest, size int) {
+	var resp GetXAttrResponse
+	if err := r.m.fs.(XAttrGetter).GetXAttr(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	r.replyXattrValue(resp.Value, size)
+}
+
+// handleListXAttr replies with the NUL terminated attribute names.  Size is handled in the same
+// way as handleGetXAttr.
+func handleListXAttr(r *request, in *ListXAttrsRequest, size int) {
+	var resp ListXAttrsResponse
+	if err := r.m.fs.(XAttrLister).ListXAttrs(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+
+	var packed []byte
+	for _, n := range resp.Names {
+		packed = append(packed, n...)
+		packed = append(packed, 0)
+	}
+	r.replyXattrValue(packed, size)
+}
+
+func handleRemoveXAttr(r *request, in *RemoveXAttrRequest) {
+	r.replyErr(r.m.fs.(XAttrRemover).RemoveXAttr(r.ctx, in))
+}
+
+func handleAccess(r *request, in *AccessRequest) {
+	r.replyErr(r.m.fs.(Accesser).Access(r.ctx, in))
+}
+
+func handleCreate(r *request, in *CreateRequest) {
+	var resp CreateResponse
+	if err := r.m.fs.(Creator).Create(r.ctx, in, &resp); err != OK {
+		r.replyErr(err)
+		return
+	}
+	if err := checkEntry(r, &resp.Entry); err != OK {
+		releaseFile(r, resp.Entry.Ino, in.Flags, resp.Handle)
+		discardEntry(r, &resp.Entry)
+		r.replyErr(err)
+		return
+	}
+	addLookup(r, &resp.Entry)
+	if r.replyCreate(&resp.Entry, &resp.OpenResponse) != OK {
+		// Neither the lookup reference nor the open file reached the kernel.
+		releaseFile(r, resp.Entry.Ino, in.Flags, resp.Handle)
+		forgetEntry(r, &resp.Entry)
+	}
+}
@@ -1,14 +1,21 @@
 package fuse
 
 import (
+	"context"
 	"time"
 )
 
 // FileSystem operations for FUSE's LowLevel API.
+//
+// FileSystem methods are not passed the request context.  Implement ContextFileSystem to receive
+// it, or implement FileSystemV2 instead.
 type FileSystem interface {
 	// Init initializes a filesystem.
 	// Called before any other filesystem method.
-	Init(*ConnInfo)
+	//
+	// If an error is returned, the session is ended and the mount fails with that error.  Destroy
+	// is not called in this case.
+	Init(*ConnInfo) Status
 
 	// Destroy cleans up a filesystem.
 	// Called on filesystem exit.
@@ -65,14 +72,14 @@ type FileSystem interface {
 	// fi is for future use, currently always nil.
 	GetAttr(ino int64, fi *FileInfo) (attr *InoAttr, err Status)
 
-	// Setattr sets file attributes.
+	// Setattr sets file attributes, and returns the updated attributes.
 	//
-	// In the 'attr' argument, only members indicated by the mask contain valid values.  Other
-	// members contain undefined values.
+	// Only the fields of req which are set should be changed.  req.ApplyTo applies the changes
+	// to a set of attributes.
 	//
-	// If the setattr was invoked from the ftruncate() system call, the fi.Handle will contain the
-	// value set by the open method.  Otherwise, the fi argument may be nil.
-	SetAttr(ino int64, attr *InoAttr, mask SetAttrMask, fi *FileInfo) (*InoAttr, Status)
+	// If the setattr was invoked from the ftruncate() system call, req.File.Handle will contain
+	// the value set by the open method.  Otherwise, req.File may be nil.
+	SetAttr(req *SetAttrRequest) (*InoAttr, Status)
 
 	// ReadLink reads a symbolic link.
 	ReadLink(ino int64) (string, Status)
@@ -157,7 +164,7 @@ type FileSystem interface {
 	// Access checks file access permissions.
 	//
 	// This will be called for the access() system call.  If the 'default_permissions' mount option
-	// is given, this method is not called.
+	// is given, or CAP_POSIX_ACL is negotiated, this method is not called.
 	Access(ino int64, mask int) Status
 
 	// Create creates and opens a file.
@@ -169,10 +176,14 @@ type FileSystem interface {
 	// Filesystems may store an arbitrary file handle in fi.Handle and use this in all other file
 	// operations (Read, Write, Flush, Release, FSync).
 	//
-	// If this method is not implemented, then Mknod and Open methods will be called instead.
+	// If this method returns ENOSYS, then the kernel calls Mknod and Open instead for this and
+	// future requests.  Create is always registered for a FileSystem, so the first request is
+	// still sent here.  A FileSystemV2 can leave Creator unimplemented to skip it.
 	Create(parent int64, name string, mode int, fi *FileInfo) (*Entry, Status)
 
 	// Returns a list of the extended attribute keys.
+	//
+	// The bridge packs the names, and handles size queries and ERANGE replies.
 	ListXAttrs(ino int64) ([]string, Status)
 
 	// Returns the size of the attribute value.
@@ -181,29 +192,61 @@ type FileSystem interface {
 	// Get an extended attribute.
 	// Result placed in out buffer.
 	// Returns the number of bytes copied.
+	//
+	// The buffer is sized with GetXAttrSize, so ERANGE is only returned if the value grew in
+	// between, in which case the size is queried again.  The bridge handles the caller's size
+	// queries and ERANGE replies.  See GetSizedXAttr.
 	GetXAttr(ino int64, name string, out []byte) (int, Status)
 
 	// Set an extended attribute.
-	SetXAttr(ino int64, name string, value []byte, flags int) Status
+	SetXAttr(ino int64, name string, value []byte, flags XAttrFlags) Status
 
 	// Remove an extended attribute.
 	RemoveXAttr(ino int64, name string) Status
 }
 
+// ContextFileSystem is implemented by a FileSystem which needs the context of each request.
+//
+// The context is cancelled if the kernel interrupts the request, for example when the calling
+// process receives a signal.  Operations which may block, such as those waiting on a remote
+// backend, should stop once the context is done and return EINTR.  The context also holds the
+// caller, see CallerFromContext.
+//
+// WithContext is promoted through embedding like any other method, so a type which embeds a
+// ContextFileSystem and overrides some of its methods must also implement WithContext.
+type ContextFileSystem interface {
+	FileSystem
+
+	// WithContext returns the FileSystem which handles a single request, typically a shallow
+	// copy of the filesystem which holds ctx.  Init and Destroy are not called on the result.
+	WithContext(ctx context.Context) FileSystem
+}
+
 // StatVFS contains filesystem statistics for StatFS calls.
 type StatVFS struct {
-	BlockSize  int64 // Filesystem block size
-	Blocks     int64 // Size of filesystem
-	BlocksFree int64 // Number of free blocks
+	BlockSize    int64 // Filesystem block size
+	FragmentSize int64 // Fundamental block size, in which Blocks are counted.  Defaults to BlockSize
+	Blocks       int64 // Size of filesystem
+	BlocksFree   int64 // Number of free blocks
+	BlocksAvail  int64 // Number of free blocks available to unprivileged users
 
-	Files     int64 // Number of files
-	FilesFree int64 // Number of free inodes
+	Files      int64 // Number of files
+	FilesFree  int64 // Number of free inodes
+	FilesAvail int64 // Free inodes for unprivileged users.  Linux reports FilesFree instead
 
 	Fsid    int // Filesystem id
 	Flags   FsFlags
 	NameMax int // Maximum filename length
 }
 
+// fragmentSize returns the fundamental block size.
+func (s *StatVFS) fragmentSize() int64 {
+	if s.FragmentSize != 0 {
+		return s.FragmentSize
+	}
+	return s.BlockSize
+}
+
 // DirEntryWriter is part of the ReadDir API for storing directory entries.
 type DirEntryWriter interface {
 	// Returns true if the entry was added, false if there is no more space
@@ -213,15 +256,32 @@ type DirEntryWriter interface {
 
 // FileInfo holds file information, used in a number of APIs.
 type FileInfo struct {
-	Flags     int
+	Flags int
+
+	// Writepage is set in Write if the write was caused by a delayed write from the page cache.
 	Writepage bool
-	// Bitfields not supported by CGO.
-	// TODO: create separate wrapper?
-	// DirectIo     bool
-	// KeepCache    bool
-	// Flush        bool
-	// NonSeekable  bool
-	// FlockRelease bool
+
+	// DirectIO can be set in Open to bypass the page cache for the file.
+	DirectIO bool
+
+	// KeepCache can be set in Open to keep previously cached data for the file.
+	KeepCache bool
+
+	// Flush is set in Release if the data should be flushed.
+	Flush bool
+
+	// NonSeekable can be set in Open to indicate that the file is not seekable.
+	NonSeekable bool
+
+	// FlockRelease is set in Release if flock locks should be released.
+	FlockRelease bool
+
+	// CacheReaddir can be set in OpenDir to allow the kernel to cache directory entries.
+	CacheReaddir bool
+
+	// NoFlush can be set in Open to skip Flush calls when the file is closed.
+	NoFlush bool
+
 	Handle    uint64
 	LockOwner uint64
 }
@@ -244,6 +304,25 @@ type ConnInfo struct {
 
 	// Maximum readahead
 	MaxReadahead int
+
+	// Capabilities supported by both the kernel and the FUSE library (read-only).
+	Capable Capability
+
+	// Capabilities to enable (writable).  Initially holds the default capabilities.  Flags
+	// which are not in Capable are ignored.
+	Want Capability
+
+	// Maximum number of pending background requests, such as asynchronous reads (writable).
+	// Zero uses the kernel default.
+	MaxBackground int
+
+	// Number of pending background requests at which the kernel considers the filesystem
+	// congested (writable).  Zero uses the kernel default.
+	CongestionThreshold int
+
+	// Granularity of timestamps in nanoseconds, as a power of 10 (writable).  Zero or one means
+	// nanosecond resolution.  Not supported on macOS.
+	TimeGran int
 }
 
 // Entry is used by Lookup operations.
@@ -253,7 +332,7 @@ type Entry struct {
 	// In lookup, zero means negative entry (from version 2.5)
 	// Returning ENOENT also means negative entry, but by setting zero
 	// ino the kernel may cache negative entries for entry_timeout
-	// seconds.
+	// seconds.  See NegativeEntry.
 	Ino int64
 
 	// Generation number for this entry.
@@ -266,7 +345,7 @@ type Entry struct {
 	// to the inode at the same time.
 	//
 	// The generation must be non-zero, otherwise FUSE will treat
-	// it as an error.
+	// it as an error.  See Exporter.
 	Generation uint64
 
 	// Inode attributes.
@@ -277,6 +356,40 @@ type Entry struct {
 
 	// Validity timeout (in seconds) for the name
 	EntryTimeout float64
+
+	// Validity timeouts as durations.  If non-zero, these are used in place of AttrTimeout and
+	// EntryTimeout.
+	AttrTTL  time.Duration
+	EntryTTL time.Duration
+}
+
+// NegativeEntry returns an entry for a name which does not exist.  Unlike ENOENT, the kernel
+// caches the result for timeout seconds, so repeated lookups of the name are not sent to the
+// filesystem.  Only valid as the result of Lookup.
+func NegativeEntry(timeout float64) *Entry {
+	return &Entry{EntryTimeout: timeout}
+}
+
+// IsNegative returns true if the entry is a negative entry, with a zero inode.
+func (e *Entry) IsNegative() bool {
+	return e.Ino == 0
+}
+
+// attrTimeout returns the validity timeout for the attributes, in seconds.
+func (e *Entry) attrTimeout() float64 {
+	return timeoutSeconds(e.AttrTTL, e.AttrTimeout)
+}
+
+// entryTimeout returns the validity timeout for the name, in seconds.
+func (e *Entry) entryTimeout() float64 {
+	return timeoutSeconds(e.EntryTTL, e.EntryTimeout)
+}
+
+func timeoutSeconds(ttl time.Duration, seconds float64) float64 {
+	if ttl != 0 {
+		return ttl.Seconds()
+	}
+	return seconds
 }
 
 // InoAttr holds inode attributes.
@@ -290,14 +403,27 @@ type InoAttr struct {
 	Size  int64
 	Mode  int
 	NLink int
+	Rdev  int // Device number, for character and block devices
+
+	Blocks  int64 // Number of 512 byte blocks allocated
+	BlkSize int   // Preferred I/O block size
 
 	UID *int // Defaults to the current UID
 	GID *int // Defaults to the current gid
 
 	ATime time.Time // ATime is the inode access time
-	CTime time.Time // CTime is the inode creation time
+	CTime time.Time // CTime is the inode status change time
 	MTime time.Time // MTime is the inode modification time
+	BTime time.Time // BTime is the inode creation (birth) time.  Only reported on macOS
 
 	// Validity timeout (in seconds) for the attributes.
 	Timeout float64
+
+	// Validity timeout as a duration.  If non-zero, this is used in place of Timeout.
+	TTL time.Duration
+}
+
+// timeout returns the validity timeout for the attributes, in seconds.
+func (a *InoAttr) timeout() float64 {
+	return timeoutSeconds(a.TTL, a.Timeout)
 }
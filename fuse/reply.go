@@ -0,0 +1,116 @@
+//go:build cgo && !nocgo
+
+package fuse
+
+import "unsafe"
+
+// #include "wrapper.h"
+// #include <stdlib.h>  // for free()
+import "C"
+
+// serve handles a request from the FUSE bridge.  The operation name and inode are used to report
+// panics.
+//
+// Any data referenced by C pointers must be copied before calling serve, as the request may be
+// handled after the bridge callback returns.
+func serve(id C.int, req C.fuse_req_t, op string, ino C.fuse_ino_t, handle func(r *request)) {
+	m := getMount(int(id))
+	c := C.get_caller(req)
+	caller := newCaller(int(c.uid), int(c.gid), int(c.pid))
+	caller.Umask = int(c.umask)
+	ctx, done := newRequestContext(withCaller(m.ctx, caller), req)
+	m.serve(&request{
+		m:    m,
+		ctx:  ctx,
+		out:  cReplier{req},
+		done: done,
+		op:   op,
+		ino:  int64(ino),
+	}, handle)
+}
+
+// cReplier sends replies using the libfuse reply functions.
+type cReplier struct {
+	req C.fuse_req_t
+}
+
+func replyStatus(res C.int) Status {
+	return Status(-res)
+}
+
+func (c cReplier) err(err Status) Status {
+	return replyStatus(C.reply_err(c.req, C.int(err)))
+}
+
+func (c cReplier) none() {
+	C.reply_none(c.req)
+}
+
+func (c cReplier) entry(e *Entry) Status {
+	var cent C.struct_fuse_entry_param
+	e.toCEntry(&cent)
+	return replyStatus(C.reply_entry(c.req, &cent))
+}
+
+func (c cReplier) create(e *Entry, o *OpenResponse) Status {
+	var cent C.struct_fuse_entry_param
+	e.toCEntry(&cent)
+	var fi C.struct_fuse_file_info
+	o.toCFileInfo(&fi)
+	return replyStatus(C.reply_create(c.req, &cent, &fi))
+}
+
+func (c cReplier) attr(a *InoAttr) Status {
+	var attr C.struct_stat
+	var timeout C.double
+	a.toCStat(&attr, &timeout)
+	return replyStatus(C.reply_attr(c.req, &attr, timeout))
+}
+
+func (c cReplier) readlink(target string) Status {
+	link := C.CString(target)
+	defer C.free(unsafe.Pointer(link))
+	return replyStatus(C.reply_readlink(c.req, link))
+}
+
+func (c cReplier) open(o *OpenResponse) Status {
+	var fi C.struct_fuse_file_info
+	o.toCFileInfo(&fi)
+	return replyStatus(C.reply_open(c.req, &fi))
+}
+
+func (c cReplier) write(n int) Status {
+	return replyStatus(C.reply_write(c.req, C.size_t(n)))
+}
+
+func (c cReplier) buf(buf []byte) Status {
+	if len(buf) == 0 {
+		return replyStatus(C.reply_buf(c.req, nil, 0))
+	}
+	ptr := (*C.char)(unsafe.Pointer(&buf[0]))
+	return replyStatus(C.reply_buf(c.req, ptr, C.size_t(len(buf))))
+}
+
+func (c cReplier) statfs(s *StatVFS) Status {
+	var stat C.struct_statvfs
+	s.toCStat(&stat)
+	return replyStatus(C.reply_statfs(c.req, &stat))
+}
+
+func (c cReplier) xattr(size int) Status {
+	return replyStatus(C.reply_xattr(c.req, C.size_t(size)))
+}
+
+func (c cReplier) addDirEntry(buf []byte, name string, ino int64, mode int, next int64) int {
+	cstr := C.CString(name)
+	defer C.free(unsafe.Pointer(cstr))
+
+	// A nil buffer only computes the size of the entry.
+	var ptr *C.char
+	if len(buf) > 0 {
+		ptr = (*C.char)(unsafe.Pointer(&buf[0]))
+	}
+	n := C.AddDirEntry(c.req, ptr, C.size_t(len(buf)), cstr, C.fuse_ino_t(ino), C.int(mode),
+		C.off_t(next))
+	return int(n)
+}
@@ -0,0 +1,445 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// MountAndRun mounts the filesystem and enters the Fuse event loop.
+// The argumenst are passed to libfuse to mount the filesystem.  Any flags supported by libfuse are
+// allowed. The call returns immediately on error, or else blocks until the filesystem is
+// unmounted.
+//
+// Example:
+//
+//	fs := &MyFs{}
+//	err := fuse.MountAndRun(os.Args, fs)
+//
+// The filesystem is served through AdaptFileSystem, which registers every operation with the
+// kernel.  See AdaptFileSystem for how this differs from MountAndRunV2.
+func MountAndRun(args []string, fs FileSystem) int {
+	return MountAndRunV2(args, AdaptFileSystem(fs), nil)
+}
+
+// Options control how a filesystem is served.
+type Options struct {
+	// Async handles each request in a new goroutine, rather than on the thread which received it.
+	// The reply is sent from the goroutine once the filesystem method returns, which allows slow
+	// operations to run concurrently without tying up the threads which read requests.
+	//
+	// Filesystem methods must be safe for concurrent use.  Request data, such as write buffers,
+	// is copied so that it remains valid for the duration of the call.
+	Async bool
+
+	// Workers is the number of goroutines which read requests from the kernel and dispatch them
+	// to the filesystem.  If zero, the libfuse event loop is used, which reads requests on threads
+	// created by libfuse.  The pure Go transport uses one worker per CPU by default.
+	//
+	// Each worker handles one request at a time, unless Async is also set.  Only supported with
+	// FUSE 3, and ignored otherwise.
+	Workers int
+
+	// PollWorkaround lets the process which serves the filesystem with the pure Go transport use
+	// it while GOMAXPROCS is 1.  The Go runtime polls every file it opens without releasing its
+	// P, and the kernel sends a poll request for a file on a FUSE mount, which no worker can then
+	// run to answer.  With the workaround, a reserved file is opened and polled once the
+	// filesystem is mounted, which stops the kernel from sending poll requests.  Opens of other
+	// files are held back until then, but a file created before then is not covered.
+	//
+	// The reserved file is named .go-fuse-c-poll-hack, in the root directory, and has the inode
+	// number 1<<63 - 1.  Requests for the name and the inode are answered by the transport, so
+	// the filesystem must not use either.  Ignored by the libfuse transport, which reads requests
+	// on threads which the Go runtime does not block.
+	PollWorkaround bool
+
+	// PanicHandler is called if a filesystem method panics, with the name of the operation, the
+	// inode it was called for and the value passed to panic.  The panic is always logged and the
+	// request fails with EIO, so the filesystem remains mounted.  Optional.
+	PanicHandler func(op string, ino int64, v any)
+
+	// ReplyErrorHandler is called if a reply could not be sent to the kernel, with the name of the
+	// operation, the inode it was called for and the error.  ENOENT indicates that the request
+	// was interrupted.  The filesystem is told about lookup references and open files which did
+	// not reach the kernel, so the handler is only needed for reporting.  If nil, the failure is
+	// logged.
+	ReplyErrorHandler func(op string, ino int64, err Status)
+}
+
+// mount holds a filesystem, along with the state used to serve requests.
+type mount struct {
+	fs   any
+	opts Options
+
+	// ops holds the names of the operations implemented by fs.
+	ops map[string]bool
+
+	// lookups counts lookup references, if fs implements LookupTracker.
+	lookups LookupCounter
+
+	// export is set if fs implements Exporter.
+	export bool
+
+	// ctx is the parent of every request context.  It is cancelled when the filesystem is
+	// destroyed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// inflight tracks requests which are handled asynchronously.
+	inflight sync.WaitGroup
+
+	// initErr holds the error returned by Init, if any.
+	initErr Status
+}
+
+// newMount returns the state for serving fs.  A FileSystem is served through AdaptFileSystem, as
+// it does not implement any of the operation interfaces itself.
+func newMount(fs any, opts *Options) *mount {
+	if v1, ok := fs.(FileSystem); ok {
+		fs = AdaptFileSystem(v1)
+	}
+	m := &mount{fs: fs, ops: implementedOps(fs), export: implements[Exporter](fs)}
+	if t, ok := fs.(LookupTracker); ok {
+		m.lookups = t.LookupTable()
+	}
+	if opts != nil {
+		m.opts = *opts
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+// operations holds the name of each operation which is served with mount.serve, along with a
+// check for whether a filesystem implements it.
+var operations = map[string]func(fs any) bool{
+	"StatFS":      implements[StatFSer],
+	"Lookup":      implements[Lookuper],
+	"Forget":      implementsAny[Forgetter, LookupTracker],
+	"GetAttr":     implements[GetAttrer],
+	"SetAttr":     implements[SetAttrer],
+	"ReadLink":    implements[ReadLinker],
+	"Mknod":       implements[Mknoder],
+	"Mkdir":       implements[Mkdirer],
+	"Unlink":      implements[Unlinker],
+	"Rmdir":       implements[Rmdirer],
+	"Symlink":     implements[Symlinker],
+	"Rename":      implements[Renamer],
+	"Link":        implements[Linker],
+	"Open":        implements[Opener],
+	"Read":        implements[Reader],
+	"Write":       implements[Writer],
+	"Flush":       implements[Flusher],
+	"Release":     implements[Releaser],
+	"FSync":       implements[FSyncer],
+	"OpenDir":     implements[DirOpener],
+	"ReadDir":     implementsAny[DirReader, DirLister],
+	"ReleaseDir":  implements[DirReleaser],
+	"FSyncDir":    implements[DirFSyncer],
+	"SetXAttr":    implements[XAttrSetter],
+	"GetXAttr":    implements[XAttrGetter],
+	"ListXAttr":   implements[XAttrLister],
+	"RemoveXAttr": implements[XAttrRemover],
+	"Access":      implements[Accesser],
+	"Create":      implements[Creator],
+}
+
+func implements[T any](fs any) bool {
+	_, ok := fs.(T)
+	return ok
+}
+
+func implementsAny[T, U any](fs any) bool {
+	return implements[T](fs) || implements[U](fs)
+}
+
+// implementedOps returns the names of the operations which fs implements.
+func implementedOps(fs any) map[string]bool {
+	ops := make(map[string]bool)
+	for name, implemented := range operations {
+		if implemented(fs) {
+			ops[name] = true
+		}
+	}
+	return ops
+}
+
+// init initializes the filesystem.  A failure is recorded, so that it can be reported once the
+// session ends.  A panic is treated as a failure with EIO.
+func (m *mount) init(req *InitRequest, resp *InitResponse) (err Status) {
+	defer func() {
+		if v := recover(); v != nil {
+			m.panicked("Init", 0, v)
+			err = EIO
+		}
+		m.initErr = err
+	}()
+	if m.export {
+		resp.Conn.Want |= CAP_EXPORT_SUPPORT
+	}
+	if fs, ok := m.fs.(Initer); ok {
+		return fs.Init(m.ctx, req, resp)
+	}
+	return OK
+}
+
+// serve runs handle for a request.  The handle function must call one of the reply methods,
+// which may happen after serve returns if the filesystem is served asynchronously.
+//
+// Requests for operations which the filesystem does not implement are answered without calling
+// handle.
+func (m *mount) serve(r *request, handle func(r *request)) {
+	if !m.ops[r.op] {
+		r.replyUnsupported()
+		return
+	}
+	if !m.opts.Async {
+		m.handle(r, handle)
+		return
+	}
+
+	m.inflight.Add(1)
+	go func() {
+		defer m.inflight.Done()
+		m.handle(r, handle)
+	}()
+}
+
+// handle runs handle for a request, and recovers from a panic by replying with EIO if a reply
+// has not been sent yet.
+func (m *mount) handle(r *request, handle func(r *request)) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		m.panicked(r.op, r.ino, v)
+		if r.replied {
+			return
+		}
+		if r.op == "Forget" {
+			r.replyNone()
+		} else {
+			r.replyErr(EIO)
+		}
+	}()
+	handle(r)
+}
+
+// panicked logs a panic from a filesystem method, and passes it to the panic handler.
+func (m *mount) panicked(op string, ino int64, v any) {
+	slog.Error("panic in filesystem method", "op", op, "ino", ino, "panic", v,
+		"stack", string(debug.Stack()))
+	if m.opts.PanicHandler != nil {
+		m.opts.PanicHandler(op, ino, v)
+	}
+}
+
+// replyFailed reports a reply which could not be sent.
+func (m *mount) replyFailed(op string, ino int64, err Status) {
+	if m.opts.ReplyErrorHandler != nil {
+		m.opts.ReplyErrorHandler(op, ino, err)
+		return
+	}
+	if err == ENOENT {
+		slog.Debug("reply to interrupted request discarded", "op", op, "ino", ino)
+		return
+	}
+	slog.Warn("failed to send reply", "op", op, "ino", ino, "err", err)
+}
+
+// destroy interrupts any requests which are still being handled, and waits for them to finish
+// before cleaning up the filesystem.  The filesystem is not cleaned up if Init failed.
+func (m *mount) destroy() {
+	m.cancel()
+	m.inflight.Wait()
+	if m.initErr != OK {
+		return
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			m.panicked("Destroy", 0, v)
+		}
+	}()
+	if fs, ok := m.fs.(Destroyer); ok {
+		fs.Destroy(context.Background())
+	}
+}
+
+// requestBuf returns a byte slice holding the contents of a buffer owned by the transport.
+// The buffer is copied if the request may be handled after the transport reuses it.
+func (m *mount) requestBuf(b []byte) []byte {
+	if m.opts.Async {
+		return bytes.Clone(b)
+	}
+	return b
+}
+
+// replier sends replies to the kernel, and is implemented by each transport.
+//
+// The methods return OK if the reply was sent, otherwise the error reported by the transport.
+// ENOENT indicates that the request was interrupted and the reply was discarded by the kernel.
+type replier interface {
+	err(err Status) Status
+	none()
+	entry(e *Entry) Status
+	create(e *Entry, o *OpenResponse) Status
+	attr(a *InoAttr) Status
+	readlink(target string) Status
+	open(o *OpenResponse) Status
+	write(n int) Status
+	buf(buf []byte) Status
+	statfs(s *StatVFS) Status
+	xattr(size int) Status
+
+	// addDirEntry encodes a directory entry into buf, if it fits.  Returns the size of the
+	// encoded entry, even if it did not fit.
+	addDirEntry(buf []byte, name string, ino int64, mode int, next int64) int
+}
+
+// request tracks a single FUSE request while a filesystem method handles it.
+//
+// Exactly one of the reply methods must be called for each request.
+type request struct {
+	m   *mount
+	ctx context.Context
+	out replier
+
+	// done releases the request context.  This must happen before the reply is sent, as the
+	// transport may reuse the request once a reply has been sent.
+	done func()
+
+	// op and ino identify the request when reporting a panic.
+	op  string
+	ino int64
+
+	// replied is set once a reply has been sent.
+	replied bool
+}
+
+// finish releases the request context before a reply is sent.
+func (r *request) finish() {
+	if r.done != nil {
+		r.done()
+		r.done = nil
+	}
+}
+
+// sent records that a reply was sent, and returns the result of sending it.  Failures are
+// reported to the reply error handler.
+func (r *request) sent(err Status) Status {
+	r.replied = true
+	if err != OK {
+		r.m.replyFailed(r.op, r.ino, err)
+	}
+	return err
+}
+
+// replyUnsupported replies to a request for an operation which the filesystem does not
+// implement, in the same way as libfuse.
+func (r *request) replyUnsupported() {
+	switch r.op {
+	case "Forget":
+		r.replyNone()
+	case "Open", "OpenDir":
+		r.replyOpen(&OpenResponse{})
+	case "Release", "ReleaseDir":
+		r.replyErr(OK)
+	case "StatFS":
+		r.replyStatFS(&StatVFS{BlockSize: 512, NameMax: 255})
+	default:
+		r.replyErr(ENOSYS)
+	}
+}
+
+func (r *request) replyErr(err Status) Status {
+	r.finish()
+	return r.sent(r.out.err(err))
+}
+
+func (r *request) replyNone() {
+	r.finish()
+	r.out.none()
+	r.replied = true
+}
+
+func (r *request) replyEntry(e *Entry) Status {
+	r.finish()
+	return r.sent(r.out.entry(e))
+}
+
+func (r *request) replyCreate(e *Entry, o *OpenResponse) Status {
+	r.finish()
+	return r.sent(r.out.create(e, o))
+}
+
+func (r *request) replyAttr(a *InoAttr) Status {
+	r.finish()
+	return r.sent(r.out.attr(a))
+}
+
+func (r *request) replyReadlink(target string) Status {
+	r.finish()
+	return r.sent(r.out.readlink(target))
+}
+
+func (r *request) replyOpen(o *OpenResponse) Status {
+	r.finish()
+	return r.sent(r.out.open(o))
+}
+
+func (r *request) replyWrite(n int) Status {
+	r.finish()
+	return r.sent(r.out.write(n))
+}
+
+func (r *request) replyBuf(buf []byte) Status {
+	r.finish()
+	return r.sent(r.out.buf(buf))
+}
+
+func (r *request) replyStatFS(s *StatVFS) Status {
+	r.finish()
+	return r.sent(r.out.statfs(s))
+}
+
+func (r *request) replyXattr(size int) Status {
+	r.finish()
+	return r.sent(r.out.xattr(size))
+}
+
+// replyXattrValue replies to a getxattr or listxattr request, following the xattr calling
+// conventions: a zero size queries the required size, and ERANGE is returned if the value does
+// not fit in the caller's buffer.
+func (r *request) replyXattrValue(value []byte, size int) Status {
+	switch {
+	case size == 0:
+		return r.replyXattr(len(value))
+	case len(value) > size:
+		return r.replyErr(ERANGE)
+	default:
+		return r.replyBuf(value)
+	}
+}
+
+// dirBuf collects directory entries for a readdir reply.
+type dirBuf struct {
+	out replier
+	buf []byte // The capacity limits the size of the reply.
+}
+
+func newDirBuf(out replier, size int) *dirBuf {
+	return &dirBuf{out: out, buf: make([]byte, 0, size)}
+}
+
+func (d *dirBuf) Add(name string, ino int64, mode int, next int64) bool {
+	free := d.buf[len(d.buf):cap(d.buf)]
+	n := d.out.addDirEntry(free, name, ino, mode, next)
+	if n > len(free) {
+		return false
+	}
+	d.buf = d.buf[:len(d.buf)+n]
+	return true
+}
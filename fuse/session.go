@@ -0,0 +1,186 @@
+//go:build cgo && !nocgo
+
+package fuse
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// #include "wrapper.h"
+import "C"
+
+// exitPollInterval is how often the session loop checks whether the session has ended.  The libfuse
+// signal handlers only set a flag, which blocked workers do not see until a request arrives.
+const exitPollInterval = 100 * time.Millisecond
+
+// fuseConnectionsDir is where the fusectl filesystem is mounted.  It has a directory for each FUSE
+// connection, named after the device number of the mount.
+const fuseConnectionsDir = "/sys/fs/fuse/connections"
+
+// ll_SessionLoop reads and dispatches requests with the given number of worker goroutines, until
+// the session exits.  Returns 0 on success, or a negative error code.
+//
+//export ll_SessionLoop
+func ll_SessionLoop(se *C.struct_fuse_session, workers C.int, mountpoint *C.char) C.int {
+	mnt := C.GoString(mountpoint)
+	res := runSession(int(workers),
+		func() int { return int(sessionWorker(se)) },
+		func() bool { return C.fuse_session_exited(se) != 0 },
+		func() {
+			C.fuse_session_exit(se)
+			abortConnection(mnt)
+		})
+	return C.int(res)
+}
+
+// abortConnection aborts the FUSE connection of the filesystem mounted at mountpoint, which fails
+// pending reads of /dev/fuse with ENODEV.  The session file descriptor is left open until every
+// worker has returned, as closing it could make a blocked worker read from a reused descriptor.
+//
+// This requires fusectl to be mounted.  Otherwise, blocked workers only return once a request
+// arrives, or the filesystem is unmounted.
+func abortConnection(mountpoint string) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return
+	}
+	dev, ok := fuseDevice(f, mountpoint)
+	f.Close()
+	if !ok {
+		return
+	}
+
+	path := filepath.Join(fuseConnectionsDir, strconv.FormatUint(dev, 10), "abort")
+	abort, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	_, _ = abort.WriteString("1")
+	abort.Close()
+}
+
+// fuseDevice returns the kernel device number of the FUSE filesystem mounted at mountpoint,
+// according to mountinfo.  If filesystems are stacked on the mountpoint, the last one is used.
+func fuseDevice(mountinfo io.Reader, mountpoint string) (uint64, bool) {
+	var dev uint64
+	found := false
+
+	// Each line is "id parent major:minor root mountpoint options ... - fstype source super".
+	s := bufio.NewScanner(mountinfo)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != mountpoint {
+			continue
+		}
+		sep := slices.Index(fields, "-")
+		if sep < 0 || sep+1 == len(fields) || !strings.HasPrefix(fields[sep+1], "fuse") {
+			continue
+		}
+		major, minor, ok := strings.Cut(fields[2], ":")
+		if !ok {
+			continue
+		}
+		ma, err1 := strconv.ParseUint(major, 10, 32)
+		mi, err2 := strconv.ParseUint(minor, 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		// The kernel encodes device numbers with 20 bits for the minor number.
+		dev, found = ma<<20|mi, true
+	}
+	return dev, found
+}
+
+// unescapeMountinfo decodes the octal escapes used for spaces and other special characters in
+// mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// runSession runs work on the given number of goroutines, until they have all returned.  Once the
+// session ends, because a worker returned or exited reports true, end is called to wake the
+// workers which are blocked waiting for a request.  Returns the first non-zero worker result.
+func runSession(workers int, work func() int, exited func() bool, end func()) int {
+	results := make(chan int, workers)
+	for range workers {
+		go func() {
+			results <- work()
+		}()
+	}
+
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+
+	res, ended := 0, false
+	for running := workers; running > 0; {
+		select {
+		case r := <-results:
+			running--
+			if res == 0 {
+				res = r
+			}
+		case <-ticker.C:
+			if !exited() {
+				continue
+			}
+		}
+		if !ended {
+			ended = true
+			end()
+		}
+	}
+	return res
+}
+
+// sessionWorker processes requests until the session exits.
+func sessionWorker(se *C.struct_fuse_session) C.int {
+	// libfuse keeps per-thread state, such as splice pipes, which must not change between
+	// receiving and processing a request.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	buf := C.SessionBufNew()
+	defer C.SessionBufFree(buf)
+
+	for {
+		res := C.SessionProcessNext(se, buf)
+		switch {
+		case res == -C.int(EINTR):
+			continue
+		case res < 0:
+			if C.fuse_session_exited(se) != 0 {
+				// The session was ended while this worker was reading.
+				return 0
+			}
+			// Stop the other workers as well.
+			C.fuse_session_exit(se)
+			return res
+		case res == 0:
+			return 0
+		}
+	}
+}
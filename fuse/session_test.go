@@ -0,0 +1,96 @@
+//go:build cgo && !nocgo
+
+package fuse
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSession simulates workers which are blocked reading requests until the session ends.
+type fakeSession struct {
+	exited atomic.Bool
+	ended  atomic.Int32
+	done   chan struct{}
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{done: make(chan struct{})}
+}
+
+func (s *fakeSession) work() int {
+	<-s.done
+	return 0
+}
+
+func (s *fakeSession) end() {
+	s.ended.Add(1)
+	close(s.done)
+}
+
+// runFakeSession runs the session loop, and fails the test if it does not return.
+func runFakeSession(t *testing.T, s *fakeSession, work func() int) int {
+	res := make(chan int, 1)
+	go func() {
+		res <- runSession(4, work, s.exited.Load, s.end)
+	}()
+	select {
+	case r := <-res:
+		require.Equal(t, int32(1), s.ended.Load())
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("session loop did not return")
+		return 0
+	}
+}
+
+func TestSessionLoopExit(t *testing.T) {
+	s := newFakeSession()
+	// The session is ended by a signal handler, which only sets the exit flag.
+	s.exited.Store(true)
+	require.Equal(t, 0, runFakeSession(t, s, s.work))
+}
+
+func TestSessionLoopWorkerError(t *testing.T) {
+	s := newFakeSession()
+	var failed atomic.Bool
+	work := func() int {
+		if failed.CompareAndSwap(false, true) {
+			return -int(EIO)
+		}
+		return s.work()
+	}
+	require.Equal(t, -int(EIO), runFakeSession(t, s, work))
+}
+
+func TestFuseDevice(t *testing.T) {
+	mountinfo := strings.Join([]string{
+		`22 1 0:21 / /sys rw,nosuid - sysfs sysfs rw`,
+		`40 22 0:35 / /mnt/a\040b rw,nosuid shared:1 - fuse.memfs memfs rw,user_id=0`,
+		`41 22 0:36 / /mnt/c rw - ext4 /dev/sda1 rw`,
+		`42 22 0:37 / /mnt/c rw - fuse memfs rw,user_id=0`,
+		`43 22 259:5 / /mnt/d rw - fuse memfs rw,user_id=0`,
+	}, "\n")
+
+	dev, ok := fuseDevice(strings.NewReader(mountinfo), "/mnt/a b")
+	require.True(t, ok)
+	require.EqualValues(t, 35, dev)
+
+	// The filesystem on top of a stack is used.
+	dev, ok = fuseDevice(strings.NewReader(mountinfo), "/mnt/c")
+	require.True(t, ok)
+	require.EqualValues(t, 37, dev)
+
+	dev, ok = fuseDevice(strings.NewReader(mountinfo), "/mnt/d")
+	require.True(t, ok)
+	require.EqualValues(t, 259<<20|5, dev)
+
+	_, ok = fuseDevice(strings.NewReader(mountinfo), "/sys")
+	require.False(t, ok)
+	_, ok = fuseDevice(strings.NewReader(mountinfo), "/mnt/missing")
+	require.False(t, ok)
+}
@@ -0,0 +1,72 @@
+package fuse
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+var _ error = OK
+
+// Error returns the description of the errno, as returned by strerror.
+func (s Status) Error() string {
+	if s == OK {
+		return "OK"
+	}
+	return syscall.Errno(s).Error()
+}
+
+// String returns the description of the errno.  See Error.
+func (s Status) String() string {
+	return s.Error()
+}
+
+// Unwrap returns the corresponding syscall.Errno, which allows errors.Is and errors.As to match
+// syscall errors and the errors defined by io/fs.
+func (s Status) Unwrap() error {
+	if s == OK {
+		return nil
+	}
+	return syscall.Errno(s)
+}
+
+// ToStatus converts an error returned by backend code into a Status.
+//
+// Errors which wrap a syscall.Errno, such as *os.PathError, map to that errno.  The errors defined
+// by os and context map to the closest errno, and any other error maps to EIO.  A nil error
+// maps to OK.
+func ToStatus(err error) Status {
+	if err == nil {
+		return OK
+	}
+
+	var status Status
+	if errors.As(err, &status) {
+		return status
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return Status(errno)
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ENOENT
+	case errors.Is(err, os.ErrExist):
+		return EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return EACCES
+	case errors.Is(err, os.ErrInvalid):
+		return EINVAL
+	case errors.Is(err, os.ErrClosed):
+		return EBADF
+	case errors.Is(err, errors.ErrUnsupported):
+		return ENOTSUP
+	case errors.Is(err, context.Canceled):
+		return EINTR
+	case errors.Is(err, context.DeadlineExceeded):
+		return ETIMEDOUT
+	}
+	return EIO
+}
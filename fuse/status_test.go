@@ -0,0 +1,51 @@
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusError(t *testing.T) {
+	var err error = ENOENT
+	require.Equal(t, syscall.ENOENT.Error(), err.Error())
+	require.Equal(t, "OK", OK.String())
+
+	require.True(t, errors.Is(err, syscall.ENOENT))
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	require.False(t, errors.Is(err, os.ErrExist))
+	require.True(t, errors.Is(fmt.Errorf("lookup: %w", EEXIST), os.ErrExist))
+
+	var errno syscall.Errno
+	require.True(t, errors.As(err, &errno))
+	require.Equal(t, syscall.ENOENT, errno)
+}
+
+func TestToStatus(t *testing.T) {
+	_, statErr := os.Stat("/nonexistent/file")
+
+	tests := []struct {
+		err      error
+		expected Status
+	}{
+		{nil, OK},
+		{ENOSPC, ENOSPC},
+		{fmt.Errorf("wrapped: %w", ENAMETOOLONG), ENAMETOOLONG},
+		{syscall.ELOOP, ELOOP},
+		{statErr, ENOENT},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.EMLINK}, EMLINK},
+		{os.ErrNotExist, ENOENT},
+		{os.ErrPermission, EACCES},
+		{errors.ErrUnsupported, ENOTSUP},
+		{context.DeadlineExceeded, ETIMEDOUT},
+		{errors.New("backend failure"), EIO},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, ToStatus(test.err), "%v", test.err)
+	}
+}
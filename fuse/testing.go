@@ -1,3 +1,5 @@
+//go:build cgo && !nocgo
+
 package fuse
 
 import (
@@ -51,8 +53,15 @@ type replyAddDirentry struct {
 	off   int64
 }
 
+// testReq holds the reply handler for a test request, along with a channel which is closed once
+// the reply has been handled.
+type testReq struct {
+	handler replyHandler
+	replied chan struct{}
+}
+
 var reqLoc sync.RWMutex
-var reqMap = make(map[int]replyHandler)
+var reqMap = make(map[int]*testReq)
 var nextReqID = 1
 
 func newReq(handler replyHandler, fsID int) C.fuse_req_t {
@@ -61,16 +70,27 @@ func newReq(handler replyHandler, fsID int) C.fuse_req_t {
 
 	id := nextReqID
 	nextReqID++
-	reqMap[id] = handler
+	reqMap[id] = &testReq{handler: handler, replied: make(chan struct{})}
 	return C.new_fuse_test_req(C.int(id), C.int(fsID))
 }
 
+// freeReq waits for the request to be replied to, which may happen after the bridge method has
+// returned if the filesystem is served asynchronously, and then releases the request.
 func freeReq(r C.fuse_req_t) {
-	delete(reqMap, int(C.fuse_test_req_id(r)))
+	id := int(C.fuse_test_req_id(r))
+	reqLoc.Lock()
+	tr := reqMap[id]
+	reqLoc.Unlock()
+
+	<-tr.replied
+
+	reqLoc.Lock()
+	delete(reqMap, id)
+	reqLoc.Unlock()
 	C.free_fuse_test_req(r)
 }
 
-func getHandler(id C.int) replyHandler {
+func getReq(id C.int) *testReq {
 	reqLoc.Lock()
 	defer reqLoc.Unlock()
 
@@ -103,9 +123,74 @@ func bridgeStatFs(fsID int, ino int64, handler replyHandler) {
 	C.bridge_statfs(req, C.fuse_ino_t(ino))
 }
 
+func bridgeOpen(fsID int, ino int64, flags int, handler replyHandler) {
+	req := newReq(handler, fsID)
+	defer freeReq(req)
+	fi := C.struct_fuse_file_info{flags: C.int(flags)}
+	C.bridge_open(req, C.fuse_ino_t(ino), &fi)
+}
+
+// bridgeOps returns the libfuse operations table which is used to mount a filesystem.
+func bridgeOps(fsID int) C.struct_fuse_lowlevel_ops {
+	var ops C.struct_fuse_lowlevel_ops
+	C.FillOps(&ops, toCOps(getMount(fsID).ops))
+	return ops
+}
+
+func bridgeRead(fsID int, ino int64, size int64, off int64, handler replyHandler) {
+	bridgeStartRead(fsID, ino, size, off, handler)()
+}
+
+// bridgeStartRead returns as soon as the bridge callback returns, without waiting for a reply.
+// The returned function waits for the reply and releases the request.
+func bridgeStartRead(fsID int, ino int64, size int64, off int64, handler replyHandler) func() {
+	req := newReq(handler, fsID)
+	C.bridge_read(req, C.fuse_ino_t(ino), C.size_t(size), C.off_t(off),
+		(*C.struct_fuse_file_info)(nil))
+	return func() { freeReq(req) }
+}
+
+func bridgeCreate(fsID int, parent int64, name string, mode int, handler replyHandler) {
+	req := newReq(handler, fsID)
+	defer freeReq(req)
+	cstr := C.CString(name)
+	defer C.free(unsafe.Pointer(cstr))
+	var fi C.struct_fuse_file_info
+	C.bridge_create(req, C.fuse_ino_t(parent), cstr, C.mode_t(mode), &fi)
+}
+
+func bridgeGetXAttr(fsID int, ino int64, name string, size int, handler replyHandler) {
+	req := newReq(handler, fsID)
+	defer freeReq(req)
+	cstr := C.CString(name)
+	defer C.free(unsafe.Pointer(cstr))
+	C.bridge_getxattr(req, C.fuse_ino_t(ino), cstr, C.size_t(size))
+}
+
+func bridgeListXAttr(fsID int, ino int64, size int, handler replyHandler) {
+	req := newReq(handler, fsID)
+	defer freeReq(req)
+	C.bridge_listxattr(req, C.fuse_ino_t(ino), C.size_t(size))
+}
+
+// interruptActive simulates the kernel interrupting every request currently being handled.
+func interruptActive() {
+	activeReqLock.Lock()
+	reqs := make([]C.fuse_req_t, 0, len(activeReqs))
+	for r := range activeReqs {
+		reqs = append(reqs, r)
+	}
+	activeReqLock.Unlock()
+
+	for _, r := range reqs {
+		ll_Interrupt(r)
+	}
+}
+
 func handleReply(req C.int, v interface{}) C.int {
-	h := getHandler(req)
-	return C.int(h(int(req), v))
+	tr := getReq(req)
+	defer close(tr.replied)
+	return C.int(tr.handler(int(req), v))
 }
 
 //export test_Reply_Err
@@ -173,5 +258,6 @@ func test_Add_Direntry(req C.int, buf *C.char, size C.size_t,
 		stbuf: stbuf,
 		off:   int64(off),
 	}
-	return handleReply(req, s)
+	// Not a reply, so the request remains active.
+	return C.int(getReq(req).handler(int(req), s))
 }
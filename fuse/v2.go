@@ -0,0 +1,735 @@
+package fuse
+
+import (
+	"context"
+	"iter"
+	"syscall"
+	"time"
+)
+
+// FileSystemV2 is a request based variant of FileSystem.
+//
+// Every method takes a context and a typed request.  Methods which return data to the kernel
+// also take a response, which the bridge passes in zeroed and sends to the kernel only when the
+// method returns OK.  New per-request data is added as fields on the request types, so that
+// implementations continue to compile as the API grows.
+//
+// The context is cancelled if the kernel interrupts the request.  See FileSystem for the
+// semantics of each operation.
+//
+// Existing FileSystem implementations can be used where a FileSystemV2 is expected by wrapping
+// them with AdaptFileSystem.  DefaultFileSystemV2 can be embedded to provide defaults for
+// operations which are not implemented.
+//
+// FileSystemV2 combines the single operation interfaces, such as Lookuper and Reader.  A
+// filesystem which only supports some operations can implement just those interfaces instead, so
+// that the kernel is told which operations are unsupported.  Embedding DefaultFileSystemV2
+// implements every operation.
+type FileSystemV2 interface {
+	Initer
+	Destroyer
+	StatFSer
+	Lookuper
+	Forgetter
+	GetAttrer
+	SetAttrer
+	ReadLinker
+	Mknoder
+	Mkdirer
+	Unlinker
+	Rmdirer
+	Symlinker
+	Renamer
+	Linker
+	Opener
+	Reader
+	Writer
+	Flusher
+	Releaser
+	FSyncer
+	DirOpener
+	DirReader
+	DirReleaser
+	DirFSyncer
+	XAttrSetter
+	XAttrGetter
+	XAttrLister
+	XAttrRemover
+	Accesser
+	Creator
+}
+
+// The interfaces below each provide a single operation.  A filesystem which is registered with
+// RegisterFSV2 or MountAndRunV2 only needs to implement the operations it supports, which are
+// detected when it is registered.  Other operations are not registered with libfuse, so the
+// kernel falls back to its default behavior.  For example, Mknod followed by Open is used to
+// create files if Creator is not implemented, and opening a file always succeeds if Opener is not
+// implemented.
+
+// Initer is implemented by filesystems which need to initialize or configure the connection.
+type Initer interface {
+	// Init initializes a filesystem.
+	// Called before any other filesystem method.
+	//
+	// resp.Conn is initialized with the values offered by the kernel, and may be changed to
+	// configure the connection.
+	//
+	// If an error is returned, the session is ended and the mount fails with that error.  Destroy
+	// is not called in this case.
+	Init(ctx context.Context, req *InitRequest, resp *InitResponse) Status
+}
+
+// Destroyer is implemented by filesystems which need to clean up on exit.
+type Destroyer interface {
+	// Destroy cleans up a filesystem.
+	// Called on filesystem exit.
+	Destroy(ctx context.Context)
+}
+
+// StatFSer is implemented by filesystems which report statistics.  If not implemented, the
+// statistics are zero, with a block size of 512 and a maximum name length of 255.
+type StatFSer interface {
+	// StatFS gets file system statistics.
+	StatFS(ctx context.Context, req *StatFSRequest, resp *StatFSResponse) Status
+}
+
+// Lookuper is implemented by filesystems which support looking up names.
+type Lookuper interface {
+	// Lookup finds a directory entry by name and get its attributes.
+	Lookup(ctx context.Context, req *LookupRequest, resp *EntryResponse) Status
+}
+
+// Exporter is implemented by filesystems which can be exported over NFS.  CAP_EXPORT_SUPPORT is
+// requested during Init, and the kernel then refers to inodes by number and generation from NFS
+// file handles, which may outlive the kernel's lookup references.  Lookups of "." and ".." are
+// passed to the Exporter rather than Lookuper.
+//
+// Every entry must have a non-zero generation, and an inode number and generation pair must not
+// refer to a different file over the life of the filesystem, including across mounts.  Entries
+// with a zero generation fail with EIO.  See InodeMap.
+type Exporter interface {
+	// ResolveInode returns the entry for an inode, which may have been forgotten.  Returns ESTALE
+	// if the inode no longer exists.
+	ResolveInode(ctx context.Context, req *ResolveRequest, resp *EntryResponse) Status
+
+	// ResolveParent returns the entry for the parent of a directory.
+	ResolveParent(ctx context.Context, req *ResolveRequest, resp *EntryResponse) Status
+}
+
+// Forgetter is implemented by filesystems which track the kernel's lookup references.
+type Forgetter interface {
+	// Forget limits the lifetime of an inode.
+	Forget(ctx context.Context, req *ForgetRequest)
+}
+
+// GetAttrer is implemented by filesystems which report file attributes.
+type GetAttrer interface {
+	// GetAttr gets file attributes.
+	GetAttr(ctx context.Context, req *GetAttrRequest, resp *AttrResponse) Status
+}
+
+// SetAttrer is implemented by filesystems which support changing file attributes.
+type SetAttrer interface {
+	// SetAttr sets file attributes.
+	SetAttr(ctx context.Context, req *SetAttrRequest, resp *AttrResponse) Status
+}
+
+// ReadLinker is implemented by filesystems which support symbolic links.
+type ReadLinker interface {
+	// ReadLink reads a symbolic link.
+	ReadLink(ctx context.Context, req *ReadLinkRequest, resp *ReadLinkResponse) Status
+}
+
+// Mknoder is implemented by filesystems which support creating file nodes.
+type Mknoder interface {
+	// Mknod creates a file node.
+	Mknod(ctx context.Context, req *MknodRequest, resp *EntryResponse) Status
+}
+
+// Mkdirer is implemented by filesystems which support creating directories.
+type Mkdirer interface {
+	// Mkdir creates a directory.
+	Mkdir(ctx context.Context, req *MkdirRequest, resp *EntryResponse) Status
+}
+
+// Unlinker is implemented by filesystems which support removing files.
+type Unlinker interface {
+	// Unlink removes a file.
+	Unlink(ctx context.Context, req *UnlinkRequest) Status
+}
+
+// Rmdirer is implemented by filesystems which support removing directories.
+type Rmdirer interface {
+	// Rmdir removes a directory.
+	Rmdir(ctx context.Context, req *RmdirRequest) Status
+}
+
+// Symlinker is implemented by filesystems which support creating symbolic links.
+type Symlinker interface {
+	// Symlink creates a symbolic link.
+	Symlink(ctx context.Context, req *SymlinkRequest, resp *EntryResponse) Status
+}
+
+// Renamer is implemented by filesystems which support renaming.
+type Renamer interface {
+	// Rename renames a file or directory.
+	Rename(ctx context.Context, req *RenameRequest) Status
+}
+
+// Linker is implemented by filesystems which support hard links.
+type Linker interface {
+	// Link creates a hard link.
+	Link(ctx context.Context, req *LinkRequest, resp *EntryResponse) Status
+}
+
+// Opener is implemented by filesystems which track open files.  If not implemented, opening a
+// file always succeeds with a zero handle.
+type Opener interface {
+	// Open makes a file available for read or write.
+	Open(ctx context.Context, req *OpenRequest, resp *OpenResponse) Status
+}
+
+// Reader is implemented by filesystems which support reading files.
+type Reader interface {
+	// Read reads data from an open file.
+	Read(ctx context.Context, req *ReadRequest, resp *ReadResponse) Status
+}
+
+// Writer is implemented by filesystems which support writing files.
+type Writer interface {
+	// Write writes data to an open file.
+	Write(ctx context.Context, req *WriteRequest, resp *WriteResponse) Status
+}
+
+// Flusher is implemented by filesystems which need to be told when a file is closed.
+type Flusher interface {
+	// Flush is called on each close() of an opened file.
+	Flush(ctx context.Context, req *FlushRequest) Status
+}
+
+// Releaser is implemented by filesystems which track open files.  If not implemented, releasing
+// a file always succeeds.
+type Releaser interface {
+	// Release drops an open file reference.
+	Release(ctx context.Context, req *ReleaseRequest) Status
+}
+
+// FSyncer is implemented by filesystems which support synchronizing files.
+type FSyncer interface {
+	// FSync synchronizes file contents.
+	FSync(ctx context.Context, req *FSyncRequest) Status
+}
+
+// DirOpener is implemented by filesystems which track open directories.  If not implemented,
+// opening a directory always succeeds with a zero handle.
+type DirOpener interface {
+	// OpenDir opens a directory.
+	OpenDir(ctx context.Context, req *OpenRequest, resp *OpenResponse) Status
+}
+
+// DirReader is implemented by filesystems which support listing directories.
+type DirReader interface {
+	// ReadDir reads a directory.
+	ReadDir(ctx context.Context, req *ReadDirRequest, resp *ReadDirResponse) Status
+}
+
+// DirLister is implemented by filesystems which list directories as a sequence of entries.  It
+// is used in place of DirReader when both are implemented, and the library handles offsets, "."
+// and "..", and the size of the reply.  See WriteDir.
+type DirLister interface {
+	// ListDir lists the entries in a directory, other than "." and "..".
+	ListDir(ctx context.Context, req *ListDirRequest, resp *ListDirResponse) Status
+}
+
+// DirReleaser is implemented by filesystems which track open directories.  If not implemented,
+// releasing a directory always succeeds.
+type DirReleaser interface {
+	// ReleaseDir drops an open directory reference.
+	ReleaseDir(ctx context.Context, req *ReleaseRequest) Status
+}
+
+// DirFSyncer is implemented by filesystems which support synchronizing directories.
+type DirFSyncer interface {
+	// FSyncDir synchronizes directory contents.
+	FSyncDir(ctx context.Context, req *FSyncRequest) Status
+}
+
+// XAttrSetter is implemented by filesystems which support setting extended attributes.
+type XAttrSetter interface {
+	// SetXAttr sets an extended attribute.
+	SetXAttr(ctx context.Context, req *SetXAttrRequest) Status
+}
+
+// XAttrGetter is implemented by filesystems which support reading extended attributes.
+type XAttrGetter interface {
+	// GetXAttr gets an extended attribute.
+	//
+	// The complete value is returned in resp.Value.  The bridge handles size queries and replies
+	// with ERANGE if the value does not fit in the caller's buffer.
+	GetXAttr(ctx context.Context, req *GetXAttrRequest, resp *GetXAttrResponse) Status
+}
+
+// XAttrLister is implemented by filesystems which support listing extended attributes.
+type XAttrLister interface {
+	// ListXAttrs lists the extended attribute names.
+	//
+	// The bridge handles packing the names, size queries and ERANGE replies.
+	ListXAttrs(ctx context.Context, req *ListXAttrsRequest, resp *ListXAttrsResponse) Status
+}
+
+// XAttrRemover is implemented by filesystems which support removing extended attributes.
+type XAttrRemover interface {
+	// RemoveXAttr removes an extended attribute.
+	RemoveXAttr(ctx context.Context, req *RemoveXAttrRequest) Status
+}
+
+// Accesser is implemented by filesystems which check access permissions.  If not implemented,
+// access checks succeed, unless the default_permissions mount option is used.  Access is not
+// called when default_permissions is used, which CAP_POSIX_ACL also enables.
+type Accesser interface {
+	// Access checks file access permissions.
+	Access(ctx context.Context, req *AccessRequest) Status
+}
+
+// Creator is implemented by filesystems which support atomically creating and opening files.
+// If not implemented, the kernel uses Mknod followed by Open.
+type Creator interface {
+	// Create creates and opens a file.
+	Create(ctx context.Context, req *CreateRequest, resp *CreateResponse) Status
+}
+
+// InitRequest is used by FileSystemV2.Init.
+type InitRequest struct {
+	// Conn holds the connection settings offered by the kernel.
+	Conn ConnInfo
+}
+
+// InitResponse is used by FileSystemV2.Init.
+type InitResponse struct {
+	// Conn holds the connection settings to use.
+	Conn ConnInfo
+}
+
+// StatFSRequest is used by FileSystemV2.StatFS.
+type StatFSRequest struct {
+	Ino int64
+}
+
+// StatFSResponse is used by FileSystemV2.StatFS.
+type StatFSResponse struct {
+	Stat StatVFS
+}
+
+// ResolveRequest is used by Exporter.
+type ResolveRequest struct {
+	Ino int64
+}
+
+// LookupRequest is used by FileSystemV2.Lookup.
+type LookupRequest struct {
+	Parent int64
+	Name   string
+}
+
+// EntryResponse is used by operations which return a directory entry.
+type EntryResponse struct {
+	Entry Entry
+}
+
+// ForgetRequest is used by FileSystemV2.Forget.
+type ForgetRequest struct {
+	Ino int64
+
+	// N is the number of lookups previously performed on this inode.
+	N int
+}
+
+// GetAttrRequest is used by FileSystemV2.GetAttr.
+type GetAttrRequest struct {
+	Ino int64
+
+	// File is for future use, currently always nil.
+	File *FileInfo
+}
+
+// AttrResponse is used by operations which return inode attributes.
+type AttrResponse struct {
+	Attr InoAttr
+}
+
+// SetAttrRequest is used by FileSystemV2.SetAttr and FileSystem.SetAttr.
+//
+// Each field describes an optional change.  Fields which are nil, false or TimeOmit leave the
+// attribute unchanged.  ApplyTo makes the requested changes to a set of attributes.
+type SetAttrRequest struct {
+	Ino int64
+
+	Mode *int   // Mode holds the new permission bits, along with the unchanged file type bits.
+	UID  *int   // UID is the new owner.
+	GID  *int   // GID is the new group.
+	Size *int64 // Size is the new file size, for truncate().
+
+	ATime SetTime    // ATime is the new access time.
+	MTime SetTime    // MTime is the new modification time.
+	CTime *time.Time // CTime is the new status change time.
+
+	// KillSUID clears the set-user-ID bit, and KillSGID clears the set-group-ID bit if the file
+	// is group executable.  These are set when the kernel leaves privilege handling to the
+	// filesystem, for example when a file is written with CAP_HANDLE_KILLPRIV.
+	KillSUID bool
+	KillSGID bool
+
+	// File is set if the SetAttr was invoked from ftruncate(), otherwise nil.
+	File *FileInfo
+}
+
+// SetTimeOp selects how a timestamp is changed by SetAttr.
+type SetTimeOp int
+
+const (
+	TimeOmit SetTimeOp = iota // TimeOmit leaves the timestamp unchanged.
+	TimeSet                   // TimeSet sets the timestamp to SetTime.Time.
+	TimeNow                   // TimeNow sets the timestamp to the current time.
+)
+
+// SetTime describes a change to a timestamp, in the same way as utimensat(2).
+type SetTime struct {
+	Op   SetTimeOp
+	Time time.Time // Time is only used with TimeSet.
+}
+
+// Resolve returns the new timestamp, given the current time, and whether the timestamp changes.
+func (t SetTime) Resolve(now time.Time) (time.Time, bool) {
+	switch t.Op {
+	case TimeSet:
+		return t.Time, true
+	case TimeNow:
+		return now, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// ApplyTo makes the requested changes to attr.  The status change time is set to the current time
+// if anything changed, unless CTime is set explicitly.
+func (r *SetAttrRequest) ApplyTo(attr *InoAttr) {
+	now := time.Now()
+	changed := false
+	if r.Mode != nil {
+		attr.Mode = *r.Mode
+		changed = true
+	}
+	if r.UID != nil {
+		uid := *r.UID
+		attr.UID = &uid
+		changed = true
+	}
+	if r.GID != nil {
+		gid := *r.GID
+		attr.GID = &gid
+		changed = true
+	}
+	if r.Size != nil {
+		attr.Size = *r.Size
+		changed = true
+	}
+	if t, ok := r.ATime.Resolve(now); ok {
+		attr.ATime = t
+		changed = true
+	}
+	if t, ok := r.MTime.Resolve(now); ok {
+		attr.MTime = t
+		changed = true
+	}
+	if r.KillSUID && attr.Mode&syscall.S_ISUID != 0 {
+		attr.Mode &^= syscall.S_ISUID
+		changed = true
+	}
+	if r.KillSGID && attr.Mode&(syscall.S_ISGID|syscall.S_IXGRP) == syscall.S_ISGID|syscall.S_IXGRP {
+		attr.Mode &^= syscall.S_ISGID
+		changed = true
+	}
+
+	switch {
+	case r.CTime != nil:
+		attr.CTime = *r.CTime
+	case changed:
+		attr.CTime = now
+	}
+}
+
+// newSetAttrRequest returns a SetAttrRequest holding the members of attr which are selected by
+// mask.
+func newSetAttrRequest(ino int64, mask SetAttrMask, attr *InoAttr, fi *FileInfo) *SetAttrRequest {
+	in := &SetAttrRequest{Ino: ino, File: fi}
+	if mask&SET_ATTR_MODE != 0 {
+		mode := attr.Mode
+		in.Mode = &mode
+	}
+	if mask&SET_ATTR_UID != 0 && attr.UID != nil {
+		uid := *attr.UID
+		in.UID = &uid
+	}
+	if mask&SET_ATTR_GID != 0 && attr.GID != nil {
+		gid := *attr.GID
+		in.GID = &gid
+	}
+	if mask&SET_ATTR_SIZE != 0 {
+		size := attr.Size
+		in.Size = &size
+	}
+	in.ATime = newSetTime(mask&SET_ATTR_ATIME != 0, mask&SET_ATTR_ATIME_NOW != 0, attr.ATime)
+	in.MTime = newSetTime(mask&SET_ATTR_MTIME != 0, mask&SET_ATTR_MTIME_NOW != 0, attr.MTime)
+	if mask&SET_ATTR_CTIME != 0 {
+		ctime := attr.CTime
+		in.CTime = &ctime
+	}
+	in.KillSUID = mask&SET_ATTR_KILL_SUID != 0
+	in.KillSGID = mask&SET_ATTR_KILL_SGID != 0
+	return in
+}
+
+func newSetTime(set, now bool, t time.Time) SetTime {
+	switch {
+	case now:
+		return SetTime{Op: TimeNow}
+	case set:
+		return SetTime{Op: TimeSet, Time: t}
+	default:
+		return SetTime{}
+	}
+}
+
+// ReadLinkRequest is used by FileSystemV2.ReadLink.
+type ReadLinkRequest struct {
+	Ino int64
+}
+
+// ReadLinkResponse is used by FileSystemV2.ReadLink.
+type ReadLinkResponse struct {
+	Target string
+}
+
+// MknodRequest is used by FileSystemV2.Mknod.
+type MknodRequest struct {
+	Parent int64
+	Name   string
+	Mode   int
+	Rdev   int
+}
+
+// MkdirRequest is used by FileSystemV2.Mkdir.
+type MkdirRequest struct {
+	Parent int64
+	Name   string
+	Mode   int
+}
+
+// UnlinkRequest is used by FileSystemV2.Unlink.
+type UnlinkRequest struct {
+	Parent int64
+	Name   string
+}
+
+// RmdirRequest is used by FileSystemV2.Rmdir.
+type RmdirRequest struct {
+	Parent int64
+	Name   string
+}
+
+// SymlinkRequest is used by FileSystemV2.Symlink.
+type SymlinkRequest struct {
+	Link   string // Link is the target of the symbolic link.
+	Parent int64
+	Name   string
+}
+
+// RenameRequest is used by FileSystemV2.Rename.
+type RenameRequest struct {
+	Parent    int64
+	Name      string
+	NewParent int64
+	NewName   string
+	Flags     int
+}
+
+// LinkRequest is used by FileSystemV2.Link.
+type LinkRequest struct {
+	Ino       int64
+	NewParent int64
+	NewName   string
+}
+
+// OpenRequest is used by FileSystemV2.Open and FileSystemV2.OpenDir.
+type OpenRequest struct {
+	Ino   int64
+	Flags int
+}
+
+// AccessMode returns the access mode requested by the open flags.
+func (r *OpenRequest) AccessMode() AccessMode {
+	return AccessMode(r.Flags & 3)
+}
+
+// OpenResponse is used by FileSystemV2.Open and FileSystemV2.OpenDir.
+type OpenResponse struct {
+	// Handle is an arbitrary value, which is passed to other operations on the open file.
+	Handle uint64
+
+	// DirectIO bypasses the page cache for the file.
+	DirectIO bool
+
+	// KeepCache keeps previously cached data for the file, rather than invalidating it on open.
+	KeepCache bool
+
+	// NonSeekable indicates that the file is not seekable.
+	NonSeekable bool
+
+	// CacheReaddir allows the kernel to cache directory entries.  Only used by OpenDir.
+	CacheReaddir bool
+
+	// NoFlush skips Flush calls when the file is closed.
+	NoFlush bool
+}
+
+// ReadRequest is used by FileSystemV2.Read.
+type ReadRequest struct {
+	Ino    int64
+	Size   int64
+	Offset int64
+	File   *FileInfo
+}
+
+// ReadResponse is used by FileSystemV2.Read.
+type ReadResponse struct {
+	Data []byte
+}
+
+// WriteRequest is used by FileSystemV2.Write.
+//
+// Data is only valid until the method returns.
+type WriteRequest struct {
+	Ino    int64
+	Data   []byte
+	Offset int64
+	File   *FileInfo
+}
+
+// WriteResponse is used by FileSystemV2.Write.
+type WriteResponse struct {
+	Written int
+}
+
+// FlushRequest is used by FileSystemV2.Flush.
+type FlushRequest struct {
+	Ino  int64
+	File *FileInfo
+}
+
+// ReleaseRequest is used by FileSystemV2.Release and FileSystemV2.ReleaseDir.
+type ReleaseRequest struct {
+	Ino  int64
+	File *FileInfo
+}
+
+// FSyncRequest is used by FileSystemV2.FSync and FileSystemV2.FSyncDir.
+type FSyncRequest struct {
+	Ino      int64
+	DataOnly bool
+	File     *FileInfo
+}
+
+// ReadDirRequest is used by FileSystemV2.ReadDir.
+type ReadDirRequest struct {
+	Ino    int64
+	Offset int64
+	Size   int
+	File   *FileInfo
+}
+
+// ReadDirResponse is used by FileSystemV2.ReadDir.
+//
+// Entries are added with the embedded DirEntryWriter.
+type ReadDirResponse struct {
+	DirEntryWriter
+}
+
+// ListDirRequest is used by DirLister.ListDir.
+type ListDirRequest struct {
+	Ino  int64
+	File *FileInfo
+}
+
+// ListDirResponse is used by DirLister.ListDir.
+type ListDirResponse struct {
+	// Parent is the parent of the directory, which is listed as "..".  Defaults to the directory
+	// itself.
+	Parent int64
+
+	// Entries lists the directory.  The sequence may be stopped early once the reply is full.
+	Entries iter.Seq[DirEntry]
+}
+
+// SetXAttrRequest is used by FileSystemV2.SetXAttr.
+//
+// Value is only valid until the method returns.
+type SetXAttrRequest struct {
+	Ino   int64
+	Name  string
+	Value []byte
+	Flags XAttrFlags
+}
+
+// GetXAttrRequest is used by FileSystemV2.GetXAttr.
+type GetXAttrRequest struct {
+	Ino  int64
+	Name string
+}
+
+// GetXAttrResponse is used by FileSystemV2.GetXAttr.
+type GetXAttrResponse struct {
+	Value []byte
+}
+
+// ListXAttrsRequest is used by FileSystemV2.ListXAttrs.
+type ListXAttrsRequest struct {
+	Ino int64
+}
+
+// ListXAttrsResponse is used by FileSystemV2.ListXAttrs.
+type ListXAttrsResponse struct {
+	Names []string
+}
+
+// RemoveXAttrRequest is used by FileSystemV2.RemoveXAttr.
+type RemoveXAttrRequest struct {
+	Ino  int64
+	Name string
+}
+
+// AccessRequest is used by FileSystemV2.Access.
+type AccessRequest struct {
+	Ino  int64
+	Mask int
+}
+
+// CreateRequest is used by FileSystemV2.Create.
+type CreateRequest struct {
+	Parent int64
+	Name   string
+	Mode   int
+	Flags  int
+}
+
+// AccessMode returns the access mode requested by the open flags.
+func (r *CreateRequest) AccessMode() AccessMode {
+	return AccessMode(r.Flags & 3)
+}
+
+// CreateResponse is used by FileSystemV2.Create.
+type CreateResponse struct {
+	Entry Entry
+
+	// OpenResponse holds the handle and settings for the open file.
+	OpenResponse
+}
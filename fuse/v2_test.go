@@ -0,0 +1,70 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountAdaptsFileSystem(t *testing.T) {
+	m := newMount(NewMemFS(), nil)
+	require.IsType(t, &fsAdapter{}, m.fs)
+	require.True(t, m.ops["Lookup"])
+	require.NotNil(t, m.lookups)
+}
+
+func TestSetAttrRequest(t *testing.T) {
+	uid, gid := 10, 20
+	mtime := time.Unix(1000, 5)
+	attr := &InoAttr{Mode: S_IFREG | 0o644, UID: &uid, GID: &gid, Size: 7, MTime: mtime}
+
+	t.Run("Only masked fields are set", func(t *testing.T) {
+		req := newSetAttrRequest(2, SET_ATTR_GID|SET_ATTR_SIZE|SET_ATTR_MTIME, attr, nil)
+		require.Equal(t, &SetAttrRequest{
+			Ino:   2,
+			GID:   &gid,
+			Size:  &attr.Size,
+			MTime: SetTime{Op: TimeSet, Time: mtime},
+		}, req)
+	})
+
+	t.Run("Now takes precedence over the time", func(t *testing.T) {
+		req := newSetAttrRequest(2, SET_ATTR_ATIME|SET_ATTR_ATIME_NOW, attr, nil)
+		require.Equal(t, SetTime{Op: TimeNow}, req.ATime)
+		require.Equal(t, SetTime{}, req.MTime)
+	})
+
+	t.Run("ApplyTo changes the requested fields", func(t *testing.T) {
+		mode, size := S_IFREG|0o600, int64(3)
+		req := &SetAttrRequest{Mode: &mode, Size: &size, MTime: SetTime{Op: TimeNow}}
+		a := *attr
+		before := time.Now()
+		req.ApplyTo(&a)
+
+		require.Equal(t, mode, a.Mode)
+		require.EqualValues(t, 3, a.Size)
+		require.Equal(t, uid, *a.UID)
+		require.True(t, a.ATime.IsZero())
+		require.False(t, a.MTime.Before(before))
+		require.Equal(t, a.MTime, a.CTime)
+	})
+
+	t.Run("ApplyTo leaves ctime alone without changes", func(t *testing.T) {
+		a := *attr
+		(&SetAttrRequest{}).ApplyTo(&a)
+		require.True(t, a.CTime.IsZero())
+	})
+
+	t.Run("KillSGID only applies to group executable files", func(t *testing.T) {
+		req := &SetAttrRequest{KillSUID: true, KillSGID: true}
+		a := InoAttr{Mode: syscall.S_ISUID | syscall.S_ISGID | 0o755}
+		req.ApplyTo(&a)
+		require.Equal(t, 0o755, a.Mode)
+
+		a = InoAttr{Mode: syscall.S_ISGID | 0o644}
+		req.ApplyTo(&a)
+		require.Equal(t, syscall.S_ISGID|0o644, a.Mode)
+	})
+}
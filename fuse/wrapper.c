@@ -1,12 +1,16 @@
+//go:build cgo && !nocgo
+
 #include "bridge.h"
 
 #include <fuse_common.h>
 #include <fuse_lowlevel.h>
 
+#include <errno.h>      // for ENOSYS
 #include <stdio.h>      // for NULL
+#include <stdlib.h>     // for calloc, free
+#include <string.h>     // for memset
 #include <sys/stat.h>   // for stat
 #include <sys/types.h>  // for off_t
-#include <unistd.h>     // for getgid, getuid
 
 #include "_cgo_export.h"  // IWYU pragma: keep
 
@@ -16,64 +20,63 @@
 
 static const struct stat emptyStat;
 
-static struct fuse_lowlevel_ops bridge_ll_ops = {
-    .init = bridge_init,
-    .destroy = bridge_destroy,
-    .lookup = bridge_lookup,
-    .forget = bridge_forget,
-    .getattr = bridge_getattr,
-    .setattr = bridge_setattr,
-    .readlink = bridge_readlink,
-    .mknod = bridge_mknod,
-    .mkdir = bridge_mkdir,
-    .unlink = bridge_unlink,
-    .rmdir = bridge_rmdir,
-    .symlink = bridge_symlink,
-    .rename = bridge_rename,
-    .link = bridge_link,
-    .open = bridge_open,
-    .read = bridge_read,
-    .write = bridge_write,
-    .flush = bridge_flush,
-    .release = bridge_release,
-    .fsync = bridge_fsync,
-    .opendir = bridge_opendir,
-    .readdir = bridge_readdir,
-    .releasedir = bridge_releasedir,
-    .fsyncdir = bridge_fsyncdir,
-    .statfs = bridge_statfs,
-    .setxattr = bridge_setxattr,
-    .getxattr = bridge_getxattr,
-    .listxattr = bridge_listxattr,
-    .removexattr = bridge_removexattr,
-    .access = bridge_access,
-    .create = bridge_create,
-    //.getlk
-    //.setlk
-    //.bmap
-    //.ioctl
-    //.poll
-    //.write_buf
-    //.retrieve_reply
-    //.forget_multi
-    //.flock
-    //.fallocate
-};
+void FillOps(struct fuse_lowlevel_ops *ll_ops, uint64_t ops) {
+  memset(ll_ops, 0, sizeof(*ll_ops));
+  ll_ops->init = bridge_init;
+  ll_ops->destroy = bridge_destroy;
+  if (ops & BRIDGE_OP_STATFS) ll_ops->statfs = bridge_statfs;
+  if (ops & BRIDGE_OP_LOOKUP) ll_ops->lookup = bridge_lookup;
+  if (ops & BRIDGE_OP_FORGET) ll_ops->forget = bridge_forget;
+#if FUSE_USE_VERSION >= 30
+  if (ops & BRIDGE_OP_FORGET) ll_ops->forget_multi = bridge_forget_multi;
+#endif
+  if (ops & BRIDGE_OP_GETATTR) ll_ops->getattr = bridge_getattr;
+  if (ops & BRIDGE_OP_SETATTR) ll_ops->setattr = bridge_setattr;
+  if (ops & BRIDGE_OP_READLINK) ll_ops->readlink = bridge_readlink;
+  if (ops & BRIDGE_OP_MKNOD) ll_ops->mknod = bridge_mknod;
+  if (ops & BRIDGE_OP_MKDIR) ll_ops->mkdir = bridge_mkdir;
+  if (ops & BRIDGE_OP_UNLINK) ll_ops->unlink = bridge_unlink;
+  if (ops & BRIDGE_OP_RMDIR) ll_ops->rmdir = bridge_rmdir;
+  if (ops & BRIDGE_OP_SYMLINK) ll_ops->symlink = bridge_symlink;
+  if (ops & BRIDGE_OP_RENAME) ll_ops->rename = bridge_rename;
+  if (ops & BRIDGE_OP_LINK) ll_ops->link = bridge_link;
+  if (ops & BRIDGE_OP_OPEN) ll_ops->open = bridge_open;
+  if (ops & BRIDGE_OP_READ) ll_ops->read = bridge_read;
+  if (ops & BRIDGE_OP_WRITE) ll_ops->write = bridge_write;
+  if (ops & BRIDGE_OP_FLUSH) ll_ops->flush = bridge_flush;
+  if (ops & BRIDGE_OP_RELEASE) ll_ops->release = bridge_release;
+  if (ops & BRIDGE_OP_FSYNC) ll_ops->fsync = bridge_fsync;
+  if (ops & BRIDGE_OP_OPENDIR) ll_ops->opendir = bridge_opendir;
+  if (ops & BRIDGE_OP_READDIR) ll_ops->readdir = bridge_readdir;
+  if (ops & BRIDGE_OP_RELEASEDIR) ll_ops->releasedir = bridge_releasedir;
+  if (ops & BRIDGE_OP_FSYNCDIR) ll_ops->fsyncdir = bridge_fsyncdir;
+  if (ops & BRIDGE_OP_SETXATTR) ll_ops->setxattr = bridge_setxattr;
+  if (ops & BRIDGE_OP_GETXATTR) ll_ops->getxattr = bridge_getxattr;
+  if (ops & BRIDGE_OP_LISTXATTR) ll_ops->listxattr = bridge_listxattr;
+  if (ops & BRIDGE_OP_REMOVEXATTR) ll_ops->removexattr = bridge_removexattr;
+  if (ops & BRIDGE_OP_ACCESS) ll_ops->access = bridge_access;
+  if (ops & BRIDGE_OP_CREATE) ll_ops->create = bridge_create;
+  // Not yet supported: getlk, setlk, bmap, ioctl, poll, write_buf, retrieve_reply, flock,
+  // fallocate.
+}
 
 #if (FUSE_USE_VERSION >= 20 && FUSE_USE_VERSION < 30)
-int fuse2MountAndRun(int id, int argc, char *argv[]) {
+int fuse2MountAndRun(int id, int argc, char *argv[], uint64_t ops) {
   struct fuse_args args = FUSE_ARGS_INIT(argc, argv);
 	struct fuse_chan *ch;
 	char *mountpoint;
 	int err = -1;
+	struct bridge_userdata ud = {id, NULL};
+	struct fuse_lowlevel_ops ll_ops;
 
+	FillOps(&ll_ops, ops);
 	if (fuse_parse_cmdline(&args, &mountpoint, NULL, NULL) != -1 &&
 	    (ch = fuse_mount(mountpoint, &args)) != NULL) {
 		struct fuse_session *se;
 
-		se = fuse_lowlevel_new(&args, &bridge_ll_ops,
-				       sizeof(bridge_ll_ops), &id);
+		se = fuse_lowlevel_new(&args, &ll_ops, sizeof(ll_ops), &ud);
 		if (se != NULL) {
+			ud.se = se;
 			if (fuse_set_signal_handlers(se) != -1) {
 				fuse_session_add_chan(se, ch);
 				err = fuse_session_loop(se);
@@ -90,11 +93,13 @@ int fuse2MountAndRun(int id, int argc, char *argv[]) {
 }
 
 #else
-int fuse3MountAndRun(int id, int argc, char *argv[]) {
+int fuse3MountAndRun(int id, int argc, char *argv[], int workers, uint64_t ops) {
   struct fuse_args args = FUSE_ARGS_INIT(argc, argv);
   struct fuse_session *se;
   struct fuse_cmdline_opts opts;
   struct fuse_loop_config config;
+  struct bridge_userdata ud = {id, NULL};
+  struct fuse_lowlevel_ops ll_ops;
   int ret = -1;
 
   if (fuse_parse_cmdline(&args, &opts) != 0) {
@@ -120,8 +125,10 @@ int fuse3MountAndRun(int id, int argc, char *argv[]) {
     goto err_out1;
   }
 
-  se = fuse_session_new(&args, &bridge_ll_ops, sizeof(bridge_ll_ops), &id);
+  FillOps(&ll_ops, ops);
+  se = fuse_session_new(&args, &ll_ops, sizeof(ll_ops), &ud);
   if (se == NULL) goto err_out1;
+  ud.se = se;
 
   if (fuse_set_signal_handlers(se) != 0) goto err_out2;
 
@@ -130,7 +137,9 @@ int fuse3MountAndRun(int id, int argc, char *argv[]) {
   fuse_daemonize(opts.foreground);
 
   /* Block until ctrl+c or fusermount -u */
-  if (opts.singlethread)
+  if (workers > 0)
+    ret = ll_SessionLoop(se, workers, opts.mountpoint);
+  else if (opts.singlethread)
     ret = fuse_session_loop(se);
   else {
     config.clone_fd = opts.clone_fd;
@@ -151,31 +160,44 @@ err_out1:
 }
 #endif
 
-int MountAndRun(int id, int argc, char *argv[]) {
+int MountAndRun(int id, int argc, char *argv[], int workers, uint64_t ops) {
 #if (FUSE_USE_VERSION >= 20 && FUSE_USE_VERSION < 30)
-  return fuse2MountAndRun(id, argc, argv);
+  return fuse2MountAndRun(id, argc, argv, ops);
 #else
-  return fuse3MountAndRun(id, argc, argv);
+  return fuse3MountAndRun(id, argc, argv, workers, ops);
 #endif
 }
 
-// Returns 0 on success.
-int DirBufAdd(struct DirBuf *db, const char *name, fuse_ino_t ino, int mode, off_t next) {
+struct fuse_buf *SessionBufNew() { return calloc(1, sizeof(struct fuse_buf)); }
+
+void SessionBufFree(struct fuse_buf *buf) {
+  free(buf->mem);
+  free(buf);
+}
+
+int SessionProcessNext(struct fuse_session *se, struct fuse_buf *buf) {
+#if (FUSE_USE_VERSION >= 20 && FUSE_USE_VERSION < 30)
+  return -ENOSYS;
+#else
+  if (fuse_session_exited(se)) {
+    return 0;
+  }
+
+  int res = fuse_session_receive_buf(se, buf);
+  if (res > 0) {
+    fuse_session_process_buf(se, buf);
+  }
+  return res;
+#endif
+}
+
+size_t AddDirEntry(fuse_req_t req, char *buf, size_t size, const char *name, fuse_ino_t ino,
+                   int mode, off_t next) {
   struct stat stbuf = emptyStat;
   stbuf.st_ino = ino;
   stbuf.st_mode = mode;
-  stbuf.st_uid = getuid();
-  stbuf.st_gid = getgid();
-
-  char *buf = db->buf + db->offset;
-  size_t left = db->size - db->offset;
-  size_t size = fuse_add_direntry(db->req, buf, left, name, &stbuf, next);
-  if (size < left) {
-    db->offset += size;
-    return 0;
-  }
 
-  return 1;
+  return fuse_add_direntry(req, buf, size, name, &stbuf, next);
 }
 
 void FillTimespec(struct timespec *out, time_t sec, unsigned long nsec) {
@@ -11,25 +11,70 @@
 
 #include <fuse_lowlevel.h>  // IWYU pragma: export
 
-#include <sys/types.h>  // for off_t
+#include <stdint.h>       // for uint64_t
+#include <sys/statvfs.h>  // for statvfs
+#include <sys/types.h>    // for off_t
+
+// Flags for the operations implemented by a filesystem.  Init and destroy are always registered.
+#define BRIDGE_OP_STATFS (1ULL << 0)
+#define BRIDGE_OP_LOOKUP (1ULL << 1)
+#define BRIDGE_OP_FORGET (1ULL << 2)
+#define BRIDGE_OP_GETATTR (1ULL << 3)
+#define BRIDGE_OP_SETATTR (1ULL << 4)
+#define BRIDGE_OP_READLINK (1ULL << 5)
+#define BRIDGE_OP_MKNOD (1ULL << 6)
+#define BRIDGE_OP_MKDIR (1ULL << 7)
+#define BRIDGE_OP_UNLINK (1ULL << 8)
+#define BRIDGE_OP_RMDIR (1ULL << 9)
+#define BRIDGE_OP_SYMLINK (1ULL << 10)
+#define BRIDGE_OP_RENAME (1ULL << 11)
+#define BRIDGE_OP_LINK (1ULL << 12)
+#define BRIDGE_OP_OPEN (1ULL << 13)
+#define BRIDGE_OP_READ (1ULL << 14)
+#define BRIDGE_OP_WRITE (1ULL << 15)
+#define BRIDGE_OP_FLUSH (1ULL << 16)
+#define BRIDGE_OP_RELEASE (1ULL << 17)
+#define BRIDGE_OP_FSYNC (1ULL << 18)
+#define BRIDGE_OP_OPENDIR (1ULL << 19)
+#define BRIDGE_OP_READDIR (1ULL << 20)
+#define BRIDGE_OP_RELEASEDIR (1ULL << 21)
+#define BRIDGE_OP_FSYNCDIR (1ULL << 22)
+#define BRIDGE_OP_SETXATTR (1ULL << 23)
+#define BRIDGE_OP_GETXATTR (1ULL << 24)
+#define BRIDGE_OP_LISTXATTR (1ULL << 25)
+#define BRIDGE_OP_REMOVEXATTR (1ULL << 26)
+#define BRIDGE_OP_ACCESS (1ULL << 27)
+#define BRIDGE_OP_CREATE (1ULL << 28)
+
+// Fills in a libfuse operations table with the bridge functions for the operations in ops.
+// Operations which are not in ops are left unset, so that libfuse applies its defaults.
+void FillOps(struct fuse_lowlevel_ops *ll_ops, uint64_t ops);
 
 // Mounts the filesystem and runs the FUSE event loop.
 // This call does not return until the filesystem is unmounted.
 // Returns an error code, or 0 on success.
 //
+// If workers is greater than zero, requests are read and dispatched by that many goroutines
+// rather than by the libfuse event loop.  This is only supported with FUSE 3.
+//
+// Only the operations in ops are registered with libfuse.  See FillOps.
+//
 // Takes ownership of the arguments, using free() to release them.
-int MountAndRun(int id, int argc, char *argv[]);
+int MountAndRun(int id, int argc, char *argv[], int workers, uint64_t ops);
 
-struct DirBuf {
-  fuse_req_t req;
-  char *buf;
-  size_t size;
+// Allocates a buffer for SessionProcessNext.
+struct fuse_buf *SessionBufNew();
+void SessionBufFree(struct fuse_buf *buf);
 
-  size_t offset;
-};
+// Reads the next request from the kernel into buf, and dispatches it to the bridge methods.
+// Returns a positive value if a request was read, 0 if the session has ended, or a negative
+// error code.
+int SessionProcessNext(struct fuse_session *se, struct fuse_buf *buf);
 
-// Returns 0 on success.
-int DirBufAdd(struct DirBuf *db, const char *name, fuse_ino_t ino, int mode, off_t next);
+// Adds a directory entry to buf, if it fits in size bytes.  Returns the size of the entry, even
+// if it did not fit.  A NULL buf may be used to compute the size.
+size_t AddDirEntry(fuse_req_t req, char *buf, size_t size, const char *name, fuse_ino_t ino,
+                   int mode, off_t next);
 
 // Helpers to copy time values into timespec.
 // This avoids typedef related issues.
@@ -39,9 +84,113 @@ void FillTimespec(struct timespec *out, time_t sec, unsigned long nsec);
 // This should only be called in test code, and cannot be turned off once enabled.
 void enable_bridge_test_mode();
 
+// Reply helpers, which pass through to the corresponding fuse_reply_* method.
+// In bridge test mode, the reply is passed to the Go test interceptors instead.
+int reply_err(fuse_req_t req, int err);
+void reply_none(fuse_req_t req);
+int reply_entry(fuse_req_t req, struct fuse_entry_param *ent);
+int reply_create(fuse_req_t req, struct fuse_entry_param *ent, struct fuse_file_info *fi);
+int reply_attr(fuse_req_t req, struct stat *attr, double timeout);
+int reply_readlink(fuse_req_t req, const char *link);
+int reply_open(fuse_req_t req, struct fuse_file_info *fi);
+int reply_write(fuse_req_t req, size_t count);
 int reply_buf(fuse_req_t req, char *buf, size_t size);
+int reply_statfs(fuse_req_t req, struct statvfs *stbuf);
+int reply_xattr(fuse_req_t req, size_t count);
+
+// Asks FUSE to call ll_Interrupt if the kernel interrupts the request.
+void register_interrupt(fuse_req_t req);
+
+// Credentials of the process which made a request.
+struct bridge_caller {
+  unsigned uid;
+  unsigned gid;
+  int pid;
+  unsigned umask;
+};
+
+// Returns the caller of a request.  In bridge test mode, this is the test process.
+struct bridge_caller get_caller(fuse_req_t req);
 
-// CGO can't access C bitfields, so provide a helper.
-static inline int get_writepage(struct fuse_file_info *fi) { return fi->writepage; }
+// Capabilities which are not available in older FUSE versions are never supported.
+#ifndef FUSE_CAP_ATOMIC_O_TRUNC
+#define FUSE_CAP_ATOMIC_O_TRUNC 0
+#endif
+#ifndef FUSE_CAP_EXPORT_SUPPORT
+#define FUSE_CAP_EXPORT_SUPPORT 0
+#endif
+#ifndef FUSE_CAP_SPLICE_WRITE
+#define FUSE_CAP_SPLICE_WRITE 0
+#endif
+#ifndef FUSE_CAP_SPLICE_MOVE
+#define FUSE_CAP_SPLICE_MOVE 0
+#endif
+#ifndef FUSE_CAP_SPLICE_READ
+#define FUSE_CAP_SPLICE_READ 0
+#endif
+#ifndef FUSE_CAP_WRITEBACK_CACHE
+#define FUSE_CAP_WRITEBACK_CACHE 0
+#endif
+#ifndef FUSE_CAP_PARALLEL_DIROPS
+#define FUSE_CAP_PARALLEL_DIROPS 0
+#endif
+#ifndef FUSE_CAP_POSIX_ACL
+#define FUSE_CAP_POSIX_ACL 0
+#endif
+#ifndef FUSE_CAP_DONT_MASK
+#define FUSE_CAP_DONT_MASK 0
+#endif
+#ifndef FUSE_CAP_HANDLE_KILLPRIV
+#define FUSE_CAP_HANDLE_KILLPRIV 0
+#endif
+#ifndef FUSE_CAP_CACHE_SYMLINKS
+#define FUSE_CAP_CACHE_SYMLINKS 0
+#endif
+#ifndef FUSE_CAP_NO_OPENDIR_SUPPORT
+#define FUSE_CAP_NO_OPENDIR_SUPPORT 0
+#endif
+#ifndef FUSE_CAP_EXPLICIT_INVAL_DATA
+#define FUSE_CAP_EXPLICIT_INVAL_DATA 0
+#endif
+
+// time_gran is only available with FUSE 3.
+static inline unsigned get_time_gran(struct fuse_conn_info *conn) {
+#if FUSE_USE_VERSION >= 30
+  return conn->time_gran;
+#else
+  return 0;
+#endif
+}
+static inline void set_time_gran(struct fuse_conn_info *conn, unsigned gran) {
+#if FUSE_USE_VERSION >= 30
+  conn->time_gran = gran;
+#endif
+}
+
+// CGO can't access C bitfields, so provide helpers.
+#define FILE_INFO_BITFIELD(name)                                                         \
+  static inline int get_##name(struct fuse_file_info *fi) { return fi->name; }           \
+  static inline void set_##name(struct fuse_file_info *fi, int v) { fi->name = v != 0; }
+
+FILE_INFO_BITFIELD(writepage)
+FILE_INFO_BITFIELD(direct_io)
+FILE_INFO_BITFIELD(keep_cache)
+FILE_INFO_BITFIELD(flush)
+FILE_INFO_BITFIELD(nonseekable)
+FILE_INFO_BITFIELD(flock_release)
+
+// cache_readdir and noflush are only available in newer FUSE versions, and are ignored otherwise.
+#if FUSE_VERSION >= FUSE_MAKE_VERSION(3, 5)
+FILE_INFO_BITFIELD(cache_readdir)
+#else
+static inline int get_cache_readdir(struct fuse_file_info *fi) { return 0; }
+static inline void set_cache_readdir(struct fuse_file_info *fi, int v) {}
+#endif
+#if FUSE_VERSION >= FUSE_MAKE_VERSION(3, 11)
+FILE_INFO_BITFIELD(noflush)
+#else
+static inline int get_noflush(struct fuse_file_info *fi) { return 0; }
+static inline void set_noflush(struct fuse_file_info *fi, int v) {}
+#endif
 
 #endif  // _WRAPPER_H_
@@ -0,0 +1,138 @@
+package fuse
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// xattrNamespaces holds the prefixes of the supported extended attribute namespaces.
+var xattrNamespaces = []string{"user.", "trusted.", "security.", "system."}
+
+// XAttrStore holds the extended attributes of an inode, and implements the semantics of the
+// extended attribute calls:
+//
+//   - Names must be in the user, trusted, security or system namespace, or ENOTSUP is returned.
+//     The only system attributes are POSIX ACLs, which are validated.
+//   - Names and values are limited to XATTR_NAME_MAX and XATTR_SIZE_MAX, and the list of names to
+//     XATTR_LIST_MAX.
+//   - XATTR_CREATE and XATTR_REPLACE are applied, and missing attributes return ENODATA.
+//
+// Permission checks, such as only allowing user attributes on regular files and directories, are
+// left to the filesystem.  The zero value is an empty store, and is safe for concurrent use.
+type XAttrStore struct {
+	mu    sync.Mutex
+	attrs map[string][]byte
+}
+
+// CheckXAttrName returns ENOTSUP if name is not in a supported namespace, or ERANGE if it is too
+// long.
+func CheckXAttrName(name string) Status {
+	if len(name) > XATTR_NAME_MAX {
+		return ERANGE
+	}
+	for _, ns := range xattrNamespaces {
+		if len(name) > len(ns) && strings.HasPrefix(name, ns) {
+			if ns == "system." && name != XATTR_POSIX_ACL_ACCESS &&
+				name != XATTR_POSIX_ACL_DEFAULT {
+				return ENOTSUP
+			}
+			return OK
+		}
+	}
+	return ENOTSUP
+}
+
+// Get returns the value of an attribute.
+func (s *XAttrStore) Get(name string) ([]byte, Status) {
+	if err := CheckXAttrName(name); err != OK {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.attrs[name]
+	if !ok {
+		return nil, ENODATA
+	}
+	return slices.Clone(value), OK
+}
+
+// Set sets the value of an attribute.  As on Linux, if both XATTR_CREATE and XATTR_REPLACE are
+// set, Set fails with EEXIST if the attribute exists, and with ENODATA if it does not.  An ACL
+// without entries removes the attribute.
+func (s *XAttrStore) Set(name string, value []byte, flags XAttrFlags) Status {
+	if flags&^(XATTR_CREATE|XATTR_REPLACE) != 0 {
+		return EINVAL
+	}
+	if err := CheckXAttrName(name); err != OK {
+		return err
+	}
+	if len(value) > XATTR_SIZE_MAX {
+		return E2BIG
+	}
+	var empty bool
+	if name == XATTR_POSIX_ACL_ACCESS || name == XATTR_POSIX_ACL_DEFAULT {
+		acl, err := DecodeACL(value)
+		if err != OK {
+			return err
+		}
+		empty = acl == nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.attrs[name]
+	switch {
+	case exists && flags&XATTR_CREATE != 0:
+		return EEXIST
+	case !exists && flags&XATTR_REPLACE != 0:
+		return ENODATA
+	case empty:
+		delete(s.attrs, name)
+		return OK
+	case !exists && s.listSize()+len(name)+1 > XATTR_LIST_MAX:
+		return ENOSPC
+	}
+
+	if s.attrs == nil {
+		s.attrs = make(map[string][]byte)
+	}
+	s.attrs[name] = slices.Clone(value)
+	return OK
+}
+
+// listSize returns the size of the list of names, as returned by ListXAttrs.
+func (s *XAttrStore) listSize() int {
+	var size int
+	for name := range s.attrs {
+		size += len(name) + 1
+	}
+	return size
+}
+
+// List returns the attribute names, in sorted order.
+func (s *XAttrStore) List() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.attrs))
+}
+
+// Remove removes an attribute.
+func (s *XAttrStore) Remove(name string) Status {
+	if err := CheckXAttrName(name); err != OK {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.attrs[name]; !ok {
+		return ENODATA
+	}
+	delete(s.attrs, name)
+	return OK
+}
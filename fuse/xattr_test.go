@@ -0,0 +1,76 @@
+package fuse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXAttrStore(t *testing.T) {
+	var s XAttrStore
+
+	_, err := s.Get("user.a")
+	require.Equal(t, ENODATA, err)
+	require.Equal(t, ENODATA, s.Set("user.a", []byte("1"), XATTR_REPLACE))
+	require.Equal(t, OK, s.Set("user.a", []byte("1"), XATTR_CREATE))
+	require.Equal(t, EEXIST, s.Set("user.a", []byte("2"), XATTR_CREATE))
+	require.Equal(t, OK, s.Set("user.a", []byte("2"), XATTR_REPLACE))
+	require.Equal(t, EEXIST, s.Set("user.a", nil, XATTR_CREATE|XATTR_REPLACE))
+	require.Equal(t, ENODATA, s.Set("user.b", nil, XATTR_CREATE|XATTR_REPLACE))
+	require.Equal(t, EINVAL, s.Set("user.a", nil, 4))
+
+	value, err := s.Get("user.a")
+	require.Equal(t, OK, err)
+	require.Equal(t, []byte("2"), value)
+
+	require.Equal(t, OK, s.Set("trusted.b", nil, 0))
+	require.Equal(t, []string{"trusted.b", "user.a"}, s.List())
+	require.Equal(t, OK, s.Remove("trusted.b"))
+	require.Equal(t, ENODATA, s.Remove("trusted.b"))
+
+	// Namespace and size rules.
+	require.Equal(t, ENOTSUP, s.Set("other.a", nil, 0))
+	require.Equal(t, ENOTSUP, s.Set("user.", nil, 0))
+	require.Equal(t, ENOTSUP, s.Set("system.other", nil, 0))
+	_, err = s.Get("other.a")
+	require.Equal(t, ENOTSUP, err)
+	require.Equal(t, ERANGE, s.Set("user."+strings.Repeat("a", XATTR_NAME_MAX), nil, 0))
+	require.Equal(t, E2BIG, s.Set("user.big", make([]byte, XATTR_SIZE_MAX+1), 0))
+	require.Equal(t, EINVAL, s.Set(XATTR_POSIX_ACL_ACCESS, []byte("acl"), 0))
+	require.Equal(t, OK, s.Set(XATTR_POSIX_ACL_ACCESS, ACLFromMode(0o644).Encode(), 0))
+	require.Equal(t, OK, s.Set(XATTR_POSIX_ACL_ACCESS, ACL(nil).Encode(), 0))
+	_, err = s.Get(XATTR_POSIX_ACL_ACCESS)
+	require.Equal(t, ENODATA, err)
+}
+
+func TestMemFSXAttr(t *testing.T) {
+	fs := NewMemFS()
+
+	file, err := fs.Mknod(1, "file", S_IFREG|0o644, 0)
+	require.Equal(t, OK, err)
+	require.Equal(t, OK, fs.SetXAttr(file.Ino, "user.a", []byte("1"), XATTR_CREATE))
+	require.Equal(t, EEXIST, fs.SetXAttr(file.Ino, "user.a", []byte("1"), XATTR_CREATE))
+	require.Equal(t, OK, fs.SetXAttr(file.Ino, XATTR_POSIX_ACL_ACCESS,
+		ACL{
+			{Tag: ACL_USER_OBJ, Perm: 6},
+			{Tag: ACL_USER, Perm: 6, ID: 1001},
+			{Tag: ACL_GROUP_OBJ, Perm: 4},
+			{Tag: ACL_MASK, Perm: 6},
+			{Tag: ACL_OTHER, Perm: 4},
+		}.Encode(), XATTR_CREATE))
+	require.Equal(t, ENODATA, fs.SetXAttr(1, XATTR_POSIX_ACL_DEFAULT,
+		ACLFromMode(0o755).Encode(), XATTR_REPLACE))
+
+	names, err := fs.ListXAttrs(file.Ino)
+	require.Equal(t, OK, err)
+	require.Equal(t, []string{XATTR_POSIX_ACL_ACCESS, "user.a"}, names)
+
+	value, err := GetSizedXAttr(fs, file.Ino, "user.a")
+	require.Equal(t, OK, err)
+	require.Equal(t, []byte("1"), value)
+	require.Equal(t, OK, fs.RemoveXAttr(file.Ino, "user.a"))
+	_, err = GetSizedXAttr(fs, file.Ino, "user.a")
+	require.Equal(t, ENODATA, err)
+	require.Equal(t, ENOTSUP, fs.SetXAttr(file.Ino, "other.a", nil, 0))
+}